@@ -0,0 +1,350 @@
+// Package agent keeps a set of port mappings alive on behalf of other
+// programs. An Agent renews each mapping in the background, tracks the
+// gateway's external address, and can be driven at runtime through the
+// JSON API served by NewHandler.
+//
+// Usage:
+//
+//	a := agent.New(natpmp.NewClient(gatewayIP))
+//	defer a.Close()
+//	http.ListenAndServe("127.0.0.1:5352", agent.NewHandler(a))
+package agent
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/portmap"
+)
+
+var (
+	// ErrExists is returned by Add for a port which is already mapped.
+	ErrExists = errors.New("port is already mapped")
+	// ErrNotFound is returned by Remove for a port which is not mapped.
+	ErrNotFound = errors.New("port is not mapped")
+	// ErrClosed is returned by Add after the Agent is closed.
+	ErrClosed = errors.New("agent is closed")
+)
+
+const (
+	defaultAddressInterval = 5 * time.Minute
+	renewRetryInterval     = 30 * time.Second
+)
+
+// Option is the type for configuring the Agent.
+type Option func(*Agent)
+
+// AddressInterval returns an option which sets how often the external
+// address is checked. The default is 5 minutes.
+func AddressInterval(d time.Duration) Option {
+	return func(a *Agent) {
+		if d > 0 {
+			a.addressInterval = d
+		}
+	}
+}
+
+// WithClock returns an option which uses the specified Clock for renewals
+// and address checks. Primarily for testing with a clock.Fake.
+func WithClock(c clock.Clock) Option {
+	return func(a *Agent) {
+		a.clock = c
+	}
+}
+
+// Mapping is the state of a mapping kept by the Agent.
+type Mapping struct {
+	Protocol     string
+	InternalPort int
+	ExternalPort int
+	// Lifetime is the lifetime granted at the last renewal. Zero means the
+	// mapping is permanent and is not renewed.
+	Lifetime time.Duration
+	// RequestedLifetime is the lifetime asked for at each renewal.
+	RequestedLifetime time.Duration
+	Expires           time.Time
+	LastRenewal       time.Time
+	// LastErr is the error from the last renewal, nil if it succeeded.
+	LastErr error
+}
+
+// Status is the gateway's external address as last checked.
+type Status struct {
+	ExternalAddress netip.Addr
+	// Epoch is the gateway's epoch, zero if the protocol has none.
+	Epoch   time.Duration
+	Checked time.Time
+	// Err is the error from the last check, nil if it succeeded.
+	Err error
+}
+
+type mappingKey struct {
+	protocol     string
+	internalPort int
+}
+
+// Agent keeps mappings renewed on one gateway. It is safe for concurrent
+// use.
+type Agent struct {
+	mapper          portmap.PortMapper
+	clock           clock.Clock
+	addressInterval time.Duration
+
+	mu       sync.Mutex
+	mappings map[mappingKey]*kept
+	status   Status
+	closed   bool
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// kept is a mapping and its renewal goroutine.
+type kept struct {
+	Mapping
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns an Agent which maps ports with the mapper, and starts
+// checking the external address.
+func New(mapper portmap.PortMapper, opts ...Option) *Agent {
+	a := &Agent{
+		mapper:          mapper,
+		clock:           clock.Real(),
+		addressInterval: defaultAddressInterval,
+		mappings:        make(map[mappingKey]*kept),
+		stop:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	go a.checkAddress()
+	return a
+}
+
+// Add maps the port and keeps it renewed until it is removed or the Agent
+// is closed. The arguments are those of natpmp.Client.AddPortMapping.
+func (a *Agent) Add(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (Mapping, error) {
+	if lifetime <= 0 {
+		return Mapping{}, fmt.Errorf("%w: %s", natpmp.ErrInvalidLifetime, lifetime)
+	}
+	key := mappingKey{protocol, internalPort}
+	a.mu.Lock()
+	switch {
+	case a.closed:
+		a.mu.Unlock()
+		return Mapping{}, ErrClosed
+	case a.mappings[key] != nil:
+		a.mu.Unlock()
+		return Mapping{}, fmt.Errorf("%w: %s %d", ErrExists, protocol, internalPort)
+	}
+	// Reserve the key while the gateway is asked.
+	k := &kept{stop: make(chan struct{}), done: make(chan struct{})}
+	a.mappings[key] = k
+	a.mu.Unlock()
+
+	m, err := a.mapper.AddPortMapping(protocol, internalPort, requestedExternalPort, lifetime)
+	a.mu.Lock()
+	if err != nil {
+		delete(a.mappings, key)
+		a.mu.Unlock()
+		return Mapping{}, err
+	}
+	if a.closed {
+		// Close has already released the other mappings. The gateway may
+		// take a while to answer, so the lock is not held meanwhile.
+		delete(a.mappings, key)
+		a.mu.Unlock()
+		a.mapper.DeletePortMapping(protocol, internalPort)
+		return Mapping{}, ErrClosed
+	}
+	defer a.mu.Unlock()
+	now := a.clock.Now()
+	k.Mapping = Mapping{
+		Protocol:          protocol,
+		InternalPort:      internalPort,
+		ExternalPort:      int(m.MappedExternalPort),
+		Lifetime:          m.Lifetime,
+		RequestedLifetime: lifetime,
+		Expires:           expires(now, m.Lifetime),
+		LastRenewal:       now,
+	}
+	go a.renew(k, m.Lifetime/2)
+	return k.Mapping, nil
+}
+
+// expires returns when a mapping granted at now for the lifetime expires,
+// the zero time if it is permanent.
+func expires(now time.Time, lifetime time.Duration) time.Time {
+	if lifetime == 0 {
+		return time.Time{}
+	}
+	return now.Add(lifetime)
+}
+
+// Remove stops renewing the mapping for the internal port and deletes it
+// from the gateway.
+func (a *Agent) Remove(protocol string, internalPort int) error {
+	key := mappingKey{protocol, internalPort}
+	a.mu.Lock()
+	k, ok := a.mappings[key]
+	if !ok || k.Protocol == "" {
+		a.mu.Unlock()
+		return fmt.Errorf("%w: %s %d", ErrNotFound, protocol, internalPort)
+	}
+	delete(a.mappings, key)
+	a.mu.Unlock()
+	return a.release(k)
+}
+
+// release stops the renewals of the mapping and deletes it.
+func (a *Agent) release(k *kept) error {
+	close(k.stop)
+	<-k.done
+	return a.mapper.DeletePortMapping(k.Protocol, k.InternalPort)
+}
+
+// Mappings returns the mappings kept by the Agent, ordered by protocol and
+// internal port.
+func (a *Agent) Mappings() []Mapping {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	mappings := make([]Mapping, 0, len(a.mappings))
+	for _, k := range a.mappings {
+		if k.Protocol != "" {
+			mappings = append(mappings, k.Mapping)
+		}
+	}
+	slices.SortFunc(mappings, func(x, y Mapping) int {
+		return cmp.Or(cmp.Compare(x.Protocol, y.Protocol), cmp.Compare(x.InternalPort, y.InternalPort))
+	})
+	return mappings
+}
+
+// Status returns the external address as last checked.
+func (a *Agent) Status() Status {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status
+}
+
+// ExternalAddress returns the external address as last checked, checking
+// it now if it has not been checked yet. The epoch is advanced by the time
+// since the check, as the gateway's would be.
+func (a *Agent) ExternalAddress() (netip.Addr, time.Duration, error) {
+	s := a.Status()
+	if s.Checked.IsZero() {
+		return a.mapper.GetExternalAddress()
+	}
+	if s.Err != nil {
+		return netip.Addr{}, 0, s.Err
+	}
+	return s.ExternalAddress, s.Epoch + a.clock.Now().Sub(s.Checked).Truncate(time.Second), nil
+}
+
+// Mapping returns the mapping kept for the internal port.
+func (a *Agent) Mapping(protocol string, internalPort int) (Mapping, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k, ok := a.mappings[mappingKey{protocol, internalPort}]
+	if !ok || k.Protocol == "" {
+		return Mapping{}, false
+	}
+	return k.Mapping, true
+}
+
+// Close stops all renewals and deletes the mappings from the gateway. It
+// does not wait for an address check in progress, which ends on its own.
+func (a *Agent) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.stop)
+		a.mu.Lock()
+		a.closed = true
+		var kept []*kept
+		for key, k := range a.mappings {
+			if k.Protocol != "" {
+				kept = append(kept, k)
+				delete(a.mappings, key)
+			}
+		}
+		a.mu.Unlock()
+		var errs []error
+		for _, k := range kept {
+			errs = append(errs, a.release(k))
+		}
+		a.closeErr = errors.Join(errs...)
+	})
+	return a.closeErr
+}
+
+func (a *Agent) renew(k *kept, next time.Duration) {
+	defer close(k.done)
+	if next <= 0 {
+		// A permanent mapping is not renewed.
+		<-k.stop
+		return
+	}
+	timer := a.clock.NewTimer(next)
+	defer timer.Stop()
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-timer.C():
+		}
+		a.mu.Lock()
+		m := k.Mapping
+		a.mu.Unlock()
+		// Ask for the port we were given, so the mapping stays the same.
+		granted, err := a.mapper.AddPortMapping(m.Protocol, m.InternalPort, m.ExternalPort, m.RequestedLifetime)
+		now := a.clock.Now()
+		a.mu.Lock()
+		k.LastErr = err
+		if err == nil {
+			k.ExternalPort = int(granted.MappedExternalPort)
+			k.Lifetime = granted.Lifetime
+			k.Expires = expires(now, granted.Lifetime)
+			k.LastRenewal = now
+		}
+		a.mu.Unlock()
+		switch {
+		case err != nil:
+			timer.Reset(renewRetryInterval)
+		case granted.Lifetime > 0:
+			timer.Reset(granted.Lifetime / 2)
+		default:
+			<-k.stop
+			return
+		}
+	}
+}
+
+func (a *Agent) checkAddress() {
+	timer := a.clock.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-timer.C():
+		}
+		addr, epoch, err := a.mapper.GetExternalAddress()
+		a.mu.Lock()
+		a.status.Checked = a.clock.Now()
+		a.status.Err = err
+		if err == nil {
+			a.status.ExternalAddress, a.status.Epoch = addr, epoch
+		}
+		a.mu.Unlock()
+		timer.Reset(a.addressInterval)
+	}
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/clock/clocktest"
+	"github.com/nveeser/go-natpmp/portmap/portmaptest"
+)
+
+func TestAgentRenews(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	mapper := &portmaptest.Mapper{PortOffset: 1}
+	a := New(mapper, WithClock(fake), AddressInterval(time.Hour))
+
+	m, err := a.Add("tcp", 8080, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("Add() failed: %v", err)
+	}
+	if m.ExternalPort != 8081 || m.Lifetime != time.Minute || !m.Expires.Equal(start.Add(time.Minute)) {
+		t.Errorf("Add()=%+v", m)
+	}
+	if _, err := a.Add("tcp", 8080, 0, time.Minute); !errors.Is(err, ErrExists) {
+		t.Errorf("Add() again err=%v, want ErrExists", err)
+	}
+
+	// Renewed at half the lifetime, asking for the granted port.
+	clocktest.WaitTimers(t, fake, 2)
+	fake.Advance(30 * time.Second)
+	clocktest.WaitTimers(t, fake, 2)
+	if got := a.Mappings(); len(got) != 1 || !got[0].LastRenewal.Equal(start.Add(30*time.Second)) {
+		t.Errorf("Mappings() after renewal=%+v", got)
+	}
+
+	// A failed renewal is recorded and retried.
+	mapper.SetErr(errors.New("gateway down"))
+	fake.Advance(30 * time.Second)
+	clocktest.WaitTimers(t, fake, 2)
+	if got := a.Mappings(); len(got) != 1 || got[0].LastErr == nil {
+		t.Errorf("Mappings() after failed renewal=%+v", got)
+	}
+	mapper.SetErr(nil)
+	fake.Advance(renewRetryInterval)
+	clocktest.WaitTimers(t, fake, 2)
+	if got := a.Mappings(); len(got) != 1 || got[0].LastErr != nil {
+		t.Errorf("Mappings() after retry=%+v", got)
+	}
+
+	if err := a.Remove("tcp", 8080); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	if err := a.Remove("tcp", 8080); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Remove() again err=%v, want ErrNotFound", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	want := []string{
+		"add tcp 8080 0 1m0s",
+		"add tcp 8080 8081 1m0s",
+		"add tcp 8080 8081 1m0s",
+		"add tcp 8080 8081 1m0s",
+		"delete tcp 8080",
+	}
+	got := mapper.Calls()
+	if len(got) != len(want) {
+		t.Fatalf("calls=%q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("calls=%q, want %q", got, want)
+			break
+		}
+	}
+}
+
+func TestAgentClose(t *testing.T) {
+	mapper := &portmaptest.Mapper{}
+	a := New(mapper)
+	for _, port := range []int{5000, 5001} {
+		if _, err := a.Add("udp", port, 0, time.Hour); err != nil {
+			t.Fatalf("Add() failed: %v", err)
+		}
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if _, err := a.Add("udp", 5002, 0, time.Hour); !errors.Is(err, ErrClosed) {
+		t.Errorf("Add() after Close err=%v, want ErrClosed", err)
+	}
+	deletes := 0
+	for _, c := range mapper.Calls() {
+		if c == "delete udp 5000" || c == "delete udp 5001" {
+			deletes++
+		}
+	}
+	if deletes != 2 || len(a.Mappings()) != 0 {
+		t.Errorf("calls=%q, Mappings()=%v", mapper.Calls(), a.Mappings())
+	}
+}
+
+// slowMapper is a portmaptest.Mapper whose gateway does not answer address
+// checks and deletions until release is closed, nor new mappings until add
+// is.
+// adding receives a value when a new mapping is asked for.
+type slowMapper struct {
+	*portmaptest.Mapper
+	add, release chan struct{}
+	adding       chan struct{}
+}
+
+func (s *slowMapper) GetExternalAddress() (netip.Addr, time.Duration, error) {
+	<-s.release
+	return s.Mapper.GetExternalAddress()
+}
+
+func (s *slowMapper) AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (*natpmp.PortMapping, error) {
+	s.adding <- struct{}{}
+	<-s.add
+	return s.Mapper.AddPortMapping(protocol, internalPort, requestedExternalPort, lifetime)
+}
+
+func (s *slowMapper) DeletePortMapping(protocol string, internalPort int) error {
+	<-s.release
+	return s.Mapper.DeletePortMapping(protocol, internalPort)
+}
+
+func TestAgentCloseSlowGateway(t *testing.T) {
+	mapper := &slowMapper{Mapper: &portmaptest.Mapper{}, add: make(chan struct{}), release: make(chan struct{}), adding: make(chan struct{}, 1)}
+	defer close(mapper.release)
+	a := New(mapper)
+
+	added := make(chan error, 1)
+	go func() {
+		_, err := a.Add("udp", 5000, 0, time.Hour)
+		added <- err
+	}()
+	<-mapper.adding
+	// Close does not wait for the address check.
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	// Nor do the other methods wait while Add deletes its mapping.
+	close(mapper.add)
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(mapper.Calls(), "add udp 5000 0 1h0m0s") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Add() did not reach the gateway")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if got := a.Mappings(); len(got) != 0 {
+		t.Errorf("Mappings()=%v", got)
+	}
+	a.Status()
+	select {
+	case err := <-added:
+		t.Fatalf("Add() returned %v before the mapping was deleted", err)
+	default:
+	}
+}
+
+func TestAgentStatus(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	mapper := &portmaptest.Mapper{}
+	a := New(mapper, WithClock(fake), AddressInterval(time.Minute))
+	defer a.Close()
+
+	clocktest.WaitTimers(t, fake, 1)
+	if s := a.Status(); s.ExternalAddress != netip.MustParseAddr("203.0.113.5") || s.Epoch != 1000*time.Second || s.Err != nil {
+		t.Errorf("Status()=%+v", s)
+	}
+	mapper.SetErr(errors.New("gateway down"))
+	fake.Advance(time.Minute)
+	clocktest.WaitTimers(t, fake, 1)
+	if s := a.Status(); s.ExternalAddress != netip.MustParseAddr("203.0.113.5") || s.Err == nil {
+		t.Errorf("Status() after failure=%+v", s)
+	}
+}
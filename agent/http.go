@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+)
+
+// mappingJSON is a Mapping in the JSON API. Durations are in seconds.
+type mappingJSON struct {
+	Protocol     string    `json:"protocol"`
+	InternalPort int       `json:"internal_port"`
+	ExternalPort int       `json:"external_port"`
+	Lifetime     int64     `json:"lifetime"`
+	TimeLeft     int64     `json:"time_left"`
+	Expires      time.Time `json:"expires,omitzero"`
+	LastRenewal  time.Time `json:"last_renewal"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+type statusJSON struct {
+	ExternalAddress string    `json:"external_address,omitempty"`
+	Epoch           int64     `json:"epoch"`
+	Checked         time.Time `json:"checked,omitzero"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// addRequest is the body of POST /mappings. ExternalPort and Lifetime are
+// optional; the lifetime defaults to natpmp.DefaultLifetime.
+type addRequest struct {
+	Protocol     string `json:"protocol"`
+	InternalPort int    `json:"internal_port"`
+	ExternalPort int    `json:"external_port"`
+	Lifetime     int64  `json:"lifetime"`
+}
+
+type errorJSON struct {
+	Error string `json:"error"`
+}
+
+// HandlerOption is the type for configuring the handler returned by
+// NewHandler.
+type HandlerOption func(*handler)
+
+// AllowRemote returns an option which accepts requests addressed to any IP
+// address, for a handler served on a non-loopback address. Requests must
+// still name the server by IP address rather than by host name.
+func AllowRemote() HandlerOption {
+	return func(h *handler) {
+		h.allowRemote = true
+	}
+}
+
+// NewHandler returns an http.Handler serving the Agent's JSON API:
+//
+//	GET    /status                     the external address and epoch
+//	GET    /mappings                   the mappings being kept
+//	POST   /mappings                   add a mapping
+//	DELETE /mappings/{protocol}/{port} remove a mapping
+//
+// It does no authentication, so it should only be served on a loopback
+// address or a Unix socket. To keep web pages from using it, requests
+// which carry an Origin header, name a host other than a loopback address
+// or localhost, or post a body which is not application/json are refused.
+func NewHandler(a *Agent, opts ...HandlerOption) http.Handler {
+	h := &handler{agent: a}
+	for _, opt := range opts {
+		opt(h)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", h.status)
+	mux.HandleFunc("GET /mappings", h.list)
+	mux.HandleFunc("POST /mappings", h.add)
+	mux.HandleFunc("DELETE /mappings/{protocol}/{port}", h.remove)
+	h.mux = mux
+	return h
+}
+
+type handler struct {
+	agent       *Agent
+	allowRemote bool
+	mux         *http.ServeMux
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browsers send Origin with cross-site requests, and a page using DNS
+	// rebinding reaches the handler under its own host name.
+	if r.Header.Get("Origin") != "" {
+		writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+		return
+	}
+	if !h.allowedHost(r.Host) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not allowed", r.Host))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// allowedHost reports whether the request's Host names this server.
+func (h *handler) allowedHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return false
+	}
+	return addr.IsLoopback() || h.allowRemote
+}
+
+func (h *handler) status(w http.ResponseWriter, r *http.Request) {
+	s := h.agent.Status()
+	resp := statusJSON{Epoch: int64(s.Epoch / time.Second), Checked: s.Checked}
+	if s.ExternalAddress.IsValid() {
+		resp.ExternalAddress = s.ExternalAddress.String()
+	}
+	if s.Err != nil {
+		resp.Error = s.Err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	now := h.agent.clock.Now()
+	mappings := h.agent.Mappings()
+	resp := make([]mappingJSON, 0, len(mappings))
+	for _, m := range mappings {
+		resp = append(resp, toJSON(m, now))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *handler) add(w http.ResponseWriter, r *http.Request) {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json"))
+		return
+	}
+	var req addRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Protocol != "tcp" && req.Protocol != "udp" {
+		writeError(w, http.StatusBadRequest, errors.New(`protocol must be "tcp" or "udp"`))
+		return
+	}
+	if req.InternalPort < 1 || req.InternalPort > 65535 || req.ExternalPort < 0 || req.ExternalPort > 65535 {
+		writeError(w, http.StatusBadRequest, errors.New("port out of range"))
+		return
+	}
+	lifetime := natpmp.DefaultLifetime
+	if req.Lifetime != 0 {
+		lifetime = time.Duration(req.Lifetime) * time.Second
+	}
+	m, err := h.agent.Add(req.Protocol, req.InternalPort, req.ExternalPort, lifetime)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, toJSON(m, h.agent.clock.Now()))
+}
+
+func (h *handler) remove(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := h.agent.Remove(r.PathValue("protocol"), port); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errorStatus returns the HTTP status for an error from the Agent. Other
+// errors come from the gateway.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, natpmp.ErrInvalidLifetime):
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+func toJSON(m Mapping, now time.Time) mappingJSON {
+	j := mappingJSON{
+		Protocol:     m.Protocol,
+		InternalPort: m.InternalPort,
+		ExternalPort: m.ExternalPort,
+		Lifetime:     int64(m.Lifetime / time.Second),
+		Expires:      m.Expires,
+		LastRenewal:  m.LastRenewal,
+	}
+	if !m.Expires.IsZero() {
+		j.TimeLeft = max(int64(m.Expires.Sub(now).Round(time.Second)/time.Second), 0)
+	}
+	if m.LastErr != nil {
+		j.LastError = m.LastErr.Error()
+	}
+	return j
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorJSON{Error: err.Error()})
+}
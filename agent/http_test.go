@@ -0,0 +1,201 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/clock/clocktest"
+	"github.com/nveeser/go-natpmp/portmap/portmaptest"
+)
+
+func TestHandler(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	mapper := &portmaptest.Mapper{}
+	a := New(mapper, WithClock(fake))
+	defer a.Close()
+	clocktest.WaitTimers(t, fake, 1)
+	srv := httptest.NewServer(NewHandler(a))
+	defer srv.Close()
+
+	do := func(method, path, body string, wantStatus int, v any) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != wantStatus {
+			t.Errorf("%s %s status=%d, want %d", method, path, resp.StatusCode, wantStatus)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Errorf("%s %s: decoding response: %v", method, path, err)
+			}
+		}
+	}
+
+	var added mappingJSON
+	do("POST", "/mappings", `{"protocol":"tcp","internal_port":8080,"external_port":9090,"lifetime":600}`, http.StatusCreated, &added)
+	if added.ExternalPort != 9090 || added.Lifetime != 600 || added.TimeLeft != 600 {
+		t.Errorf("POST /mappings=%+v", added)
+	}
+	do("POST", "/mappings", `{"protocol":"udp","internal_port":5000}`, http.StatusCreated, nil)
+
+	var errResp errorJSON
+	do("POST", "/mappings", `{"protocol":"tcp","internal_port":8080}`, http.StatusConflict, &errResp)
+	if errResp.Error == "" {
+		t.Errorf("conflict response has no error")
+	}
+	do("POST", "/mappings", `{"protocol":"sctp","internal_port":1}`, http.StatusBadRequest, nil)
+	do("POST", "/mappings", `{"protocol":"tcp","internal_port":70000}`, http.StatusBadRequest, nil)
+	do("POST", "/mappings", `{"protocol":"tcp","port":1}`, http.StatusBadRequest, nil)
+
+	var list []mappingJSON
+	do("GET", "/mappings", "", http.StatusOK, &list)
+	if len(list) != 2 || list[0].Protocol != "tcp" || list[1].Protocol != "udp" || list[1].Lifetime != 7200 {
+		t.Errorf("GET /mappings=%+v", list)
+	}
+
+	var status statusJSON
+	do("GET", "/status", "", http.StatusOK, &status)
+	if status.Error != "" || status.ExternalAddress != "203.0.113.5" || status.Epoch != 1000 {
+		t.Errorf("GET /status=%+v", status)
+	}
+
+	do("DELETE", "/mappings/tcp/8080", "", http.StatusNoContent, nil)
+	do("DELETE", "/mappings/tcp/8080", "", http.StatusNotFound, nil)
+	do("DELETE", "/mappings/tcp/x", "", http.StatusBadRequest, nil)
+
+	mapper.SetErr(errors.New("gateway down"))
+	do("POST", "/mappings", `{"protocol":"tcp","internal_port":8081}`, http.StatusBadGateway, nil)
+
+	do("GET", "/mappings", "", http.StatusOK, &list)
+	if len(list) != 1 || list[0].InternalPort != 5000 {
+		t.Errorf("GET /mappings after delete=%+v", list)
+	}
+}
+
+func TestHandlerRefusesWebPages(t *testing.T) {
+	a := New(&portmaptest.Mapper{}, WithClock(clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))))
+	defer a.Close()
+	body := `{"protocol":"tcp","internal_port":8080}`
+	testCases := []struct {
+		name       string
+		opts       []HandlerOption
+		host       string
+		header     http.Header
+		method     string
+		wantStatus int
+	}{
+		{
+			name:       "json",
+			header:     http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+			method:     "POST",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "form",
+			header:     http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+			method:     "POST",
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "text",
+			header:     http.Header{"Content-Type": {"text/plain"}},
+			method:     "POST",
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "cross origin",
+			header:     http.Header{"Content-Type": {"application/json"}, "Origin": {"https://example.com"}},
+			method:     "POST",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "rebound host",
+			host:       "attacker.example:5352",
+			method:     "GET",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "localhost",
+			host:       "localhost:5352",
+			method:     "GET",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "remote address",
+			host:       "192.0.2.1:5352",
+			method:     "GET",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "remote address allowed",
+			opts:       []HandlerOption{AllowRemote()},
+			host:       "192.0.2.1:5352",
+			method:     "GET",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "remote name",
+			opts:       []HandlerOption{AllowRemote()},
+			host:       "attacker.example",
+			method:     "GET",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a.Remove("tcp", 8080)
+			req := httptest.NewRequest(tc.method, "/mappings", strings.NewReader(body))
+			if tc.host != "" {
+				req.Host = tc.host
+			} else {
+				req.Host = "127.0.0.1:5352"
+			}
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			NewHandler(a, tc.opts...).ServeHTTP(w, req)
+			if w.Code != tc.wantStatus {
+				t.Errorf("%s status=%d, want %d: %s", tc.method, w.Code, tc.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name         string
+		m            Mapping
+		wantTimeLeft int64
+		wantError    string
+	}{
+		{name: "time left", m: Mapping{Lifetime: time.Hour, Expires: now.Add(90 * time.Second)}, wantTimeLeft: 90},
+		{name: "expired", m: Mapping{Lifetime: time.Hour, Expires: now.Add(-time.Second), LastErr: errors.New("down")}, wantError: "down"},
+		{name: "permanent", m: Mapping{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			j := toJSON(tc.m, now)
+			if j.TimeLeft != tc.wantTimeLeft || j.LastError != tc.wantError {
+				t.Errorf("toJSON()=%+v", j)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/agent"
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/portmap/portmaptest"
+)
+
+func startBroker(t *testing.T, mapper *portmaptest.Mapper) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix domain sockets not available: %v", err)
+	}
+	a := agent.New(mapper)
+	s := NewServer(a)
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Close()
+		a.Close()
+	})
+	return path
+}
+
+func dial(t *testing.T, path string) *Client {
+	t.Helper()
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestBroker(t *testing.T) {
+	mapper := &portmaptest.Mapper{PortOffset: 1}
+	path := startBroker(t, mapper)
+	a, b := dial(t, path), dial(t, path)
+
+	addr, epoch, err := a.GetExternalAddress()
+	if err != nil || addr != netip.MustParseAddr("203.0.113.5") || epoch != 1000*time.Second {
+		t.Errorf("GetExternalAddress()=%v, %s, %v", addr, epoch, err)
+	}
+
+	m, err := a.AddPortMapping("tcp", 8080, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("AddPortMapping() failed: %v", err)
+	}
+	if m.InternalPort != 8080 || m.MappedExternalPort != 8081 || m.Lifetime != time.Hour || m.RequestedLifetime != time.Hour {
+		t.Errorf("AddPortMapping()=%+v", m)
+	}
+	// Asking again returns the mapping the broker is renewing.
+	if again, err := a.AddPortMapping("tcp", 8080, 0, time.Hour); err != nil || *again != *m {
+		t.Errorf("AddPortMapping() again=%+v, %v", again, err)
+	}
+
+	if _, err := b.AddPortMapping("tcp", 8080, 0, time.Hour); !errors.Is(err, natpmp.ErrMappingOwned) {
+		t.Errorf("AddPortMapping() by another client err=%v, want ErrMappingOwned", err)
+	}
+	if err := b.DeletePortMapping("tcp", 8080); !errors.Is(err, natpmp.ErrMappingOwned) {
+		t.Errorf("DeletePortMapping() by another client err=%v, want ErrMappingOwned", err)
+	}
+	if err := b.DeletePortMapping("udp", 9); !errors.Is(err, ErrNotMapped) {
+		t.Errorf("DeletePortMapping() of unmapped port err=%v, want ErrNotMapped", err)
+	}
+
+	if _, err := b.AddPortMapping("udp", 5000, 0, time.Hour); err != nil {
+		t.Fatalf("AddPortMapping() failed: %v", err)
+	}
+	if _, err := b.AddPortMapping("udp", 5000, 0, 0); err != nil {
+		t.Fatalf("AddPortMapping(lifetime=0) failed: %v", err)
+	}
+
+	// Closing a client deletes its mappings, freeing the port for others.
+	a.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(mapper.Calls(), "delete tcp 8080") {
+		if time.Now().After(deadline) {
+			t.Fatalf("mapping not deleted after Close; calls=%q", mapper.Calls())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := b.AddPortMapping("tcp", 8080, 0, time.Hour); err != nil {
+		t.Errorf("AddPortMapping() after owner closed failed: %v", err)
+	}
+
+	want := []string{"add tcp 8080 0 1h0m0s", "add udp 5000 0 1h0m0s", "delete udp 5000", "delete tcp 8080", "add tcp 8080 0 1h0m0s"}
+	if got := mapper.Calls(); !slices.Equal(got, want) {
+		t.Errorf("calls=%q, want %q", got, want)
+	}
+}
+
+func TestBrokerGatewayErrors(t *testing.T) {
+	mapper := &portmaptest.Mapper{PortOffset: 1}
+	c := dial(t, startBroker(t, mapper))
+	for _, want := range []error{natpmp.OutOfResources, natpmp.PCPNoResources, natpmp.NotAuthorized} {
+		mapper.SetErr(fmt.Errorf("AddPortMapping Failed: %w", want))
+		_, err := c.AddPortMapping("udp", 5000, 0, time.Hour)
+		if !errors.Is(err, want) {
+			t.Errorf("AddPortMapping() err=%v, want %v", err, want)
+		}
+	}
+}
+
+func TestBrokerBadRequests(t *testing.T) {
+	mapper := &portmaptest.Mapper{PortOffset: 1}
+	c := dial(t, startBroker(t, mapper))
+	testCases := []struct {
+		name     string
+		protocol string
+		internal int
+		external int
+	}{
+		{name: "protocol", protocol: "sctp", internal: 8080},
+		{name: "internal port zero", protocol: "tcp", internal: 0},
+		{name: "internal port too large", protocol: "tcp", internal: 70000},
+		{name: "external port too large", protocol: "udp", internal: 8080, external: 70000},
+		{name: "external port negative", protocol: "udp", internal: 8080, external: -1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := c.AddPortMapping(tc.protocol, tc.internal, tc.external, time.Hour); err == nil {
+				t.Errorf("AddPortMapping() got no error")
+			}
+			// A delete has no external port.
+			if tc.external != 0 {
+				return
+			}
+			if err := c.DeletePortMapping(tc.protocol, tc.internal); err == nil || errors.Is(err, ErrNotMapped) {
+				t.Errorf("DeletePortMapping() err=%v, want a bad request", err)
+			}
+		})
+	}
+	if calls := mapper.Calls(); len(calls) != 0 {
+		t.Errorf("calls=%q, want none", calls)
+	}
+	// The port is still free for a valid request.
+	if _, err := c.AddPortMapping("tcp", 4464, 0, time.Hour); err != nil {
+		t.Errorf("AddPortMapping() failed: %v", err)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	testCases := []struct {
+		name    string
+		frame   []byte
+		wantErr bool
+	}{
+		{name: "request", frame: []byte("\x00\x00\x00\x0c{\"op\":\"add\"}")},
+		{name: "truncated", frame: []byte("\x00\x00\x00\x0d{\"op\""), wantErr: true},
+		{name: "too large", frame: []byte("\x00\x10\x00\x01{}"), wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				client.Write(tc.frame)
+				client.Close()
+			}()
+			var req request
+			err := readFrame(server, &req)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("readFrame()=%+v, want error", req)
+				}
+				return
+			}
+			if err != nil || req.Op != opAdd {
+				t.Errorf("readFrame()=%+v, %v", req, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/portmap"
+)
+
+// ErrNotMapped is returned by DeletePortMapping for a port which the
+// broker has no mapping for.
+var ErrNotMapped = errors.New("port is not mapped by the broker")
+
+// Client sends mapping requests to a broker Server. It has only the
+// portmap.PortMapper methods of natpmp.Client, which behave like
+// natpmp.Client's except where noted; the PCP, batch, range and state
+// methods need the gateway itself and are not provided. The gateway's
+// result codes can be checked with errors.Is, such as
+// errors.Is(err, natpmp.OutOfResources). Mappings are renewed by the
+// broker, and deleted when the Client is closed. It is safe for concurrent
+// use; requests are sent one at a time.
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+var _ portmap.PortMapper = (*Client)(nil)
+
+// Dial connects to the broker listening on the Unix domain socket at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient returns a Client which talks to a broker over conn.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn}
+}
+
+// Close closes the connection, and the broker deletes the Client's
+// mappings.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// GetExternalAddress returns the external address of the router, as last
+// checked by the broker, and the gateway's epoch advanced to now.
+func (c *Client) GetExternalAddress() (addr netip.Addr, duration time.Duration, err error) {
+	resp, err := c.call(request{Op: opExternalAddress})
+	if err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("ExternalAddress Failed: %w", err)
+	}
+	addr, err = netip.ParseAddr(resp.ExternalAddress)
+	if err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("ExternalAddress Failed: %w", err)
+	}
+	return addr, time.Duration(resp.Epoch) * time.Second, nil
+}
+
+// AddPortMapping asks the broker to map the port and keep it renewed, or,
+// with a lifetime of 0, to delete it. Ports mapped by another client of the
+// broker fail with natpmp.ErrMappingOwned. Since the broker renews the
+// mapping, asking again returns the current mapping.
+func (c *Client) AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (*natpmp.PortMapping, error) {
+	if lifetime < 0 {
+		return nil, fmt.Errorf("%w: %s is negative", natpmp.ErrInvalidLifetime, lifetime)
+	}
+	secs := int64(lifetime.Round(time.Second) / time.Second)
+	if lifetime > 0 && secs == 0 {
+		return nil, fmt.Errorf("%w: %s rounds to 0 seconds, which deletes the mapping", natpmp.ErrInvalidLifetime, lifetime)
+	}
+	resp, err := c.call(request{
+		Op:           opAdd,
+		Protocol:     protocol,
+		InternalPort: internalPort,
+		ExternalPort: requestedExternalPort,
+		Lifetime:     secs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("AddPortMapping Failed: %w", err)
+	}
+	return &natpmp.PortMapping{
+		InternalPort:       uint16(resp.InternalPort),
+		MappedExternalPort: uint16(resp.ExternalPort),
+		Lifetime:           time.Duration(resp.Lifetime) * time.Second,
+		RequestedLifetime:  time.Duration(resp.RequestedLifetime) * time.Second,
+	}, nil
+}
+
+// DeletePortMapping asks the broker to delete the mapping for the port.
+// Unlike natpmp.Client, which succeeds for a port that is not mapped, it
+// returns ErrNotMapped if the broker has no mapping for the port, and
+// natpmp.ErrMappingOwned if another client of the broker made it.
+func (c *Client) DeletePortMapping(protocol string, internalPort int) error {
+	if _, err := c.call(request{Op: opDelete, Protocol: protocol, InternalPort: internalPort}); err != nil {
+		return fmt.Errorf("DeletePortMapping Failed: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) call(req request) (response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := writeFrame(c.conn, req); err != nil {
+		return response{}, err
+	}
+	var resp response
+	if err := readFrame(c.conn, &resp); err != nil {
+		return response{}, err
+	}
+	if resp.Error == "" {
+		return resp, nil
+	}
+	switch resp.Code {
+	case codeOwned:
+		return resp, fmt.Errorf("%w: %s", natpmp.ErrMappingOwned, resp.Error)
+	case codeNotFound:
+		return resp, fmt.Errorf("%w: %s", ErrNotMapped, resp.Error)
+	case codeInvalidLifetime:
+		return resp, fmt.Errorf("%w: %s", natpmp.ErrInvalidLifetime, resp.Error)
+	case codeResult:
+		return resp, &gatewayErr{msg: resp.Error, result: natpmp.ResultCodeErr(resp.Result)}
+	case codePCPResult:
+		return resp, &gatewayErr{msg: resp.Error, result: natpmp.PCPResultCodeErr(resp.Result)}
+	}
+	return resp, errors.New(resp.Error)
+}
+
+// gatewayErr is a failure reported by the gateway to the broker. It has
+// the broker's message, and unwraps to the gateway's result code.
+type gatewayErr struct {
+	msg    string
+	result error
+}
+
+func (e *gatewayErr) Error() string { return e.msg }
+
+func (e *gatewayErr) Unwrap() error { return e.result }
@@ -0,0 +1,106 @@
+// Package broker shares one mapping agent between the processes on a host.
+// A Server owns the natpmp.Client and renews the mappings; applications
+// connect to it over a Unix domain socket with Dial, and get a Client. Only
+// the portmap.PortMapper methods of natpmp.Client are provided:
+// GetExternalAddress, AddPortMapping and DeletePortMapping. A mapping
+// belongs to the connection which made it, and is deleted when that
+// connection closes.
+//
+// Usage:
+//
+//	// In the process which owns the gateway:
+//	l, err := net.Listen("unix", "/run/natpmp/broker.sock")
+//	go broker.NewServer(agent.New(natpmp.NewClient(gatewayIP))).Serve(l)
+//
+//	// In each application:
+//	c, err := broker.Dial("/run/natpmp/broker.sock")
+//	mapping, err := c.AddPortMapping("tcp", 8080, 8080, natpmp.DefaultLifetime)
+package broker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Each message is a 4-byte big-endian length followed by that many bytes
+// of JSON: a request from the client, then its response from the server.
+const maxFrameSize = 64 << 10
+
+// Operations in a request.
+const (
+	opExternalAddress = "external_address"
+	opAdd             = "add"
+	opDelete          = "delete"
+)
+
+type request struct {
+	Op           string `json:"op"`
+	Protocol     string `json:"protocol,omitempty"`
+	InternalPort int    `json:"internal_port,omitempty"`
+	ExternalPort int    `json:"external_port,omitempty"`
+	// Lifetime is in seconds.
+	Lifetime int64 `json:"lifetime,omitempty"`
+}
+
+type response struct {
+	Error string `json:"error,omitempty"`
+	// Code classifies Error so the client can return a matching error.
+	Code string `json:"code,omitempty"`
+	// Result is the gateway's result code, for the codeResult and
+	// codePCPResult codes.
+	Result          int    `json:"result,omitempty"`
+	ExternalAddress string `json:"external_address,omitempty"`
+	// Epoch and the lifetimes are in seconds.
+	Epoch             int64 `json:"epoch,omitempty"`
+	InternalPort      int   `json:"internal_port,omitempty"`
+	ExternalPort      int   `json:"external_port,omitempty"`
+	Lifetime          int64 `json:"lifetime,omitempty"`
+	RequestedLifetime int64 `json:"requested_lifetime,omitempty"`
+}
+
+// Error codes in a response.
+const (
+	codeOwned           = "owned"
+	codeNotFound        = "not_found"
+	codeInvalidLifetime = "invalid_lifetime"
+	codeBadRequest      = "bad_request"
+	codeGateway         = "gateway"
+	// codeResult is a NAT-PMP result code, and codePCPResult a PCP one.
+	codeResult    = "result"
+	codePCPResult = "pcp_result"
+)
+
+func writeFrame(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds %d", len(b), maxFrameSize)
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(b)), uint32(len(b)))
+	_, err = w.Write(append(frame, b...))
+	return err
+}
+
+func readFrame(r io.Reader, v any) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds %d", n, maxFrameSize)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
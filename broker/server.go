@@ -0,0 +1,249 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nveeser/go-natpmp/agent"
+	"github.com/nveeser/go-natpmp/natpmp"
+)
+
+// Server answers mapping requests from local applications with an Agent,
+// which renews the mappings. It is safe for concurrent use.
+type Server struct {
+	agent *agent.Agent
+
+	mu sync.Mutex
+	// owners holds the connection which made each mapping.
+	owners    map[mappingKey]*serverConn
+	listeners map[net.Listener]bool
+	conns     map[*serverConn]bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+type mappingKey struct {
+	protocol     string
+	internalPort int
+}
+
+type serverConn struct {
+	conn net.Conn
+	// keys are the mappings made on this connection.
+	keys map[mappingKey]bool
+}
+
+// NewServer returns a Server which makes mappings with the Agent. The
+// Agent is not closed with the Server.
+func NewServer(a *agent.Agent) *Server {
+	return &Server{
+		agent:     a,
+		owners:    make(map[mappingKey]*serverConn),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[*serverConn]bool),
+	}
+}
+
+// Serve accepts connections on the listener, normally a Unix domain socket,
+// until the listener fails or the Server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &serverConn{conn: conn, keys: make(map[mappingKey]bool)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return net.ErrClosed
+		}
+		s.conns[c] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(c)
+	}
+}
+
+// Close stops the listeners, closes the connections and deletes the
+// mappings made through them.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveConn(c *serverConn) {
+	defer s.wg.Done()
+	defer s.release(c)
+	for {
+		var req request
+		if err := readFrame(c.conn, &req); err != nil {
+			return
+		}
+		if err := writeFrame(c.conn, s.handle(c, req)); err != nil {
+			return
+		}
+	}
+}
+
+// release closes the connection and deletes its mappings.
+func (s *Server) release(c *serverConn) {
+	c.conn.Close()
+	s.mu.Lock()
+	delete(s.conns, c)
+	var keys []mappingKey
+	for key := range c.keys {
+		delete(s.owners, key)
+		keys = append(keys, key)
+	}
+	s.mu.Unlock()
+	for _, key := range keys {
+		s.agent.Remove(key.protocol, key.internalPort)
+	}
+}
+
+func (s *Server) handle(c *serverConn, req request) response {
+	switch req.Op {
+	case opExternalAddress:
+		addr, epoch, err := s.agent.ExternalAddress()
+		if err != nil {
+			return errorResponse(err)
+		}
+		return response{ExternalAddress: addr.String(), Epoch: int64(epoch / time.Second)}
+	case opAdd:
+		if err := checkPorts(req); err != nil {
+			return response{Error: err.Error(), Code: codeBadRequest}
+		}
+		if req.Lifetime == 0 {
+			return s.delete(c, req)
+		}
+		return s.add(c, req)
+	case opDelete:
+		if err := checkPorts(req); err != nil {
+			return response{Error: err.Error(), Code: codeBadRequest}
+		}
+		return s.delete(c, req)
+	}
+	return response{Error: fmt.Sprintf("unknown op %q", req.Op), Code: codeBadRequest}
+}
+
+// checkPorts checks the protocol and ports of a request, before they are
+// used as a key or converted to the gateway's 16-bit ports.
+func checkPorts(req request) error {
+	if req.Protocol != "tcp" && req.Protocol != "udp" {
+		return errors.New(`protocol must be "tcp" or "udp"`)
+	}
+	if req.InternalPort < 1 || req.InternalPort > 65535 || req.ExternalPort < 0 || req.ExternalPort > 65535 {
+		return errors.New("port out of range")
+	}
+	return nil
+}
+
+// add maps the port for the connection. The Agent renews it, so a request
+// for a port the connection already has returns the current mapping.
+func (s *Server) add(c *serverConn, req request) response {
+	key := mappingKey{req.Protocol, req.InternalPort}
+	s.mu.Lock()
+	owner := s.owners[key]
+	if owner == nil {
+		// Reserve the port while the gateway is asked.
+		s.owners[key] = c
+		c.keys[key] = true
+	}
+	s.mu.Unlock()
+	switch {
+	case owner == c:
+		if m, ok := s.agent.Mapping(req.Protocol, req.InternalPort); ok {
+			return mappingResponse(m)
+		}
+		return response{Error: "mapping is being added", Code: codeOwned}
+	case owner != nil:
+		return response{Error: fmt.Sprintf("%s port %d is mapped by another application", req.Protocol, req.InternalPort), Code: codeOwned}
+	}
+
+	m, err := s.agent.Add(req.Protocol, req.InternalPort, req.ExternalPort, time.Duration(req.Lifetime)*time.Second)
+	if err != nil {
+		s.mu.Lock()
+		delete(s.owners, key)
+		delete(c.keys, key)
+		s.mu.Unlock()
+		return errorResponse(err)
+	}
+	return mappingResponse(m)
+}
+
+func (s *Server) delete(c *serverConn, req request) response {
+	key := mappingKey{req.Protocol, req.InternalPort}
+	s.mu.Lock()
+	owner := s.owners[key]
+	if owner == c {
+		delete(s.owners, key)
+		delete(c.keys, key)
+	}
+	s.mu.Unlock()
+	switch {
+	case owner == nil:
+		return response{Error: fmt.Sprintf("%s port %d is not mapped", req.Protocol, req.InternalPort), Code: codeNotFound}
+	case owner != c:
+		return response{Error: fmt.Sprintf("%s port %d is mapped by another application", req.Protocol, req.InternalPort), Code: codeOwned}
+	}
+	if err := s.agent.Remove(req.Protocol, req.InternalPort); err != nil {
+		return errorResponse(err)
+	}
+	return response{InternalPort: req.InternalPort}
+}
+
+func mappingResponse(m agent.Mapping) response {
+	return response{
+		InternalPort:      m.InternalPort,
+		ExternalPort:      m.ExternalPort,
+		Lifetime:          int64(m.Lifetime / time.Second),
+		RequestedLifetime: int64(m.RequestedLifetime / time.Second),
+	}
+}
+
+func errorResponse(err error) response {
+	resp := response{Error: err.Error(), Code: codeGateway}
+	var (
+		result    natpmp.ResultCodeErr
+		pcpResult natpmp.PCPResultCodeErr
+	)
+	switch {
+	case errors.Is(err, agent.ErrExists):
+		resp.Code = codeOwned
+	case errors.Is(err, agent.ErrNotFound):
+		resp.Code = codeNotFound
+	case errors.Is(err, natpmp.ErrInvalidLifetime):
+		resp.Code = codeInvalidLifetime
+	case errors.As(err, &result):
+		resp.Code, resp.Result = codeResult, int(result)
+	case errors.As(err, &pcpResult):
+		resp.Code, resp.Result = codePCPResult, int(pcpResult)
+	}
+	return resp
+}
@@ -4,6 +4,9 @@ package flags
 
 import (
 	"flag"
+	"fmt"
+	"net"
+	"net/netip"
 )
 
 type Config struct {
@@ -11,6 +14,17 @@ type Config struct {
 	Gateway IPValue
 	Port    int
 	AddSpec PortSpec
+	// Command is the subcommand, such as "list", or empty for the default.
+	Command string
+	// HTTPAddr, when set, keeps running and serves the mapping API there.
+	// An address without a host is served on 127.0.0.1.
+	HTTPAddr string
+	// HTTPRemote allows HTTPAddr to be other than a loopback address. The
+	// API has no authentication, so this exposes it to the network.
+	HTTPRemote bool
+	// BrokerPath, when set, keeps running and serves the broker on this
+	// Unix domain socket.
+	BrokerPath string
 }
 
 func (c *Config) ParseArgs(fs *flag.FlagSet, args []string) error {
@@ -21,6 +35,9 @@ func (c *Config) ParseArgs(fs *flag.FlagSet, args []string) error {
 	fs.IntVar(&c.Port, "P", 0, "Port to use for NAT-PMP Protocol")
 	fs.Var(&c.AddSpec, "a", "port specification <public port> <private port> <Protocol> [Lifetime]")
 	fs.Var(&c.Gateway, "g", "gateway address")
+	fs.StringVar(&c.HTTPAddr, "http", "", "keep mappings renewed and serve the JSON mapping API on this loopback address, such as 127.0.0.1:5352")
+	fs.BoolVar(&c.HTTPRemote, "http-remote", false, "allow -http to serve the unauthenticated API on a non-loopback address")
+	fs.StringVar(&c.BrokerPath, "broker", "", "keep mappings renewed and serve the broker on this Unix domain socket")
 
 	var positionalArgs []string
 	var err error
@@ -38,5 +55,40 @@ func (c *Config) ParseArgs(fs *flag.FlagSet, args []string) error {
 		positionalArgs = append(positionalArgs, args[0])
 		args = args[1:]
 	}
-	return fs.Parse(positionalArgs)
+	if err := fs.Parse(positionalArgs); err != nil {
+		return err
+	}
+	switch fs.Arg(0) {
+	case "", "list":
+		c.Command = fs.Arg(0)
+	default:
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+	if c.HTTPAddr != "" {
+		addr, err := httpAddr(c.HTTPAddr, c.HTTPRemote)
+		if err != nil {
+			return err
+		}
+		c.HTTPAddr = addr
+	}
+	return nil
+}
+
+// httpAddr returns the address to serve the API on, which is loopback
+// unless remote is set.
+func httpAddr(addr string, remote bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid -http address: %w", err)
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if remote || host == "localhost" {
+		return addr, nil
+	}
+	if ip, err := netip.ParseAddr(host); err != nil || !ip.IsLoopback() {
+		return "", fmt.Errorf("-http address %s is not a loopback address; the API has no authentication, so set -http-remote to serve it there", addr)
+	}
+	return addr, nil
 }
@@ -44,6 +44,49 @@ func TestFlags(t *testing.T) {
 				AddSpec: PortSpec{10, 10, "udp", 100 * time.Second},
 			},
 		},
+		{
+			name:       "list",
+			args:       []string{"list"},
+			wantConfig: &Config{Command: "list"},
+		},
+		{
+			name: "http",
+			args: []string{"-http", "127.0.0.1:5352", "-a", "10", "10", "tcp"},
+			wantConfig: &Config{
+				HTTPAddr: "127.0.0.1:5352",
+				AddSpec:  PortSpec{10, 10, "tcp", 0},
+			},
+		},
+		{
+			name:       "http-default-host",
+			args:       []string{"-http", ":5352"},
+			wantConfig: &Config{HTTPAddr: "127.0.0.1:5352"},
+		},
+		{
+			name:       "http-remote",
+			args:       []string{"-http", "0.0.0.0:5352", "-http-remote"},
+			wantConfig: &Config{HTTPAddr: "0.0.0.0:5352", HTTPRemote: true},
+		},
+		{
+			name:    "err/http-not-loopback",
+			args:    []string{"-http", "0.0.0.0:5352"},
+			wantErr: errors.New("not a loopback address"),
+		},
+		{
+			name:    "err/http-name",
+			args:    []string{"-http", "router.lan:5352"},
+			wantErr: errors.New("not a loopback address"),
+		},
+		{
+			name:       "broker",
+			args:       []string{"-broker", "/run/natpmp/broker.sock"},
+			wantConfig: &Config{BrokerPath: "/run/natpmp/broker.sock"},
+		},
+		{
+			name:    "err/unknown-command",
+			args:    []string{"remove"},
+			wantErr: errors.New("unknown command"),
+		},
 		{
 			name:    "err/missing-external",
 			args:    []string{"-a", "10"},
@@ -2,10 +2,13 @@ module github.com/nveeser/go-natpmp
 
 go 1.24.3
 
+require (
+	github.com/google/go-cmp v0.7.0
+	github.com/jackpal/gateway v1.1.1
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/google/go-cmp v0.7.0 // indirect
-	github.com/jackpal/gateway v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.2 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
@@ -0,0 +1,103 @@
+package natpmp
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+// addrCache holds the external address from the last GetExternalAddress,
+// for the TTL set with CacheExternalAddress.
+type addrCache struct {
+	addr    netip.Addr
+	epoch   time.Duration
+	fetched time.Time
+}
+
+// Cached returns the external address kept by CacheExternalAddress, with
+// the epoch advanced by the time since it was fetched, without asking the
+// gateway. It reports false if there is no address or it has expired.
+func (c *Client) Cached() (addr netip.Addr, epoch time.Duration, ok bool) {
+	if c.addrTTL <= 0 {
+		return netip.Addr{}, 0, false
+	}
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	if !c.cache.addr.IsValid() {
+		return netip.Addr{}, 0, false
+	}
+	elapsed := c.clock.Now().Sub(c.cache.fetched)
+	if elapsed < 0 || elapsed >= c.addrTTL {
+		return netip.Addr{}, 0, false
+	}
+	return c.cache.addr, c.cache.epoch + elapsed.Truncate(time.Second), true
+}
+
+// Refresh asks the gateway for its external address even if it is cached,
+// and caches the answer. Cancelling ctx abandons the request.
+func (c *Client) Refresh(ctx context.Context) (addr netip.Addr, epoch time.Duration, err error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var r wire.ExternalAddressRequest
+	req, _ := r.AppendBinary(buf.req[:0])
+	result, _, err := c.send(ctx, req, buf.resp[:], wire.ExternalAddressResponseSize)
+	if err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("ExternalAddress Failed: %w", err)
+	}
+	return c.decodeExternalAddress(result)
+}
+
+// decodeExternalAddress decodes the response to an external address
+// request and caches it.
+func (c *Client) decodeExternalAddress(result []byte) (netip.Addr, time.Duration, error) {
+	var resp wire.ExternalAddressResponse
+	if err := resp.UnmarshalBinary(result); err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("ExternalAddress Failed: %w", err)
+	}
+	addr, epoch := resp.Addr(), time.Duration(resp.EpochSecs)*time.Second
+	c.cacheAddress(addr, epoch)
+	return addr, epoch, nil
+}
+
+// cacheAddress caches the address answered or announced by the gateway.
+func (c *Client) cacheAddress(addr netip.Addr, epoch time.Duration) {
+	if c.addrTTL <= 0 {
+		return
+	}
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	if addr.IsUnspecified() {
+		// The gateway has no external address (RFC 6886 section 3.2).
+		c.cache = addrCache{}
+		return
+	}
+	c.cache = addrCache{addr: addr, epoch: epoch, fetched: c.clock.Now()}
+}
+
+func (c *Client) invalidate() {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	c.cache = addrCache{}
+}
+
+// observe drops the cached address if a response from the gateway hints
+// that it changed: the epoch went backwards, so the gateway rebooted, or a
+// PCP mapping was given a different IPv4 external address. external is
+// the zero Addr if the response has none.
+func (c *Client) observe(epoch time.Duration, external netip.Addr) {
+	if c.addrTTL <= 0 {
+		return
+	}
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	switch {
+	case !c.cache.addr.IsValid():
+	case epochRegressed(c.cache.epoch, c.cache.fetched, epoch, c.clock.Now()):
+		c.cache = addrCache{}
+	case external.Is4() && !external.IsUnspecified() && external != c.cache.addr:
+		c.cache = addrCache{}
+	}
+}
@@ -0,0 +1,245 @@
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+)
+
+// scriptTransport answers each request with respond, counting them. A nil
+// response waits until the deadline or until the transport is closed.
+type scriptTransport struct {
+	respond func(req []byte) []byte
+
+	mu      sync.Mutex
+	sent    int
+	gateway net.IP
+	closed  chan struct{}
+}
+
+func (s *scriptTransport) Open(gw net.IP, port int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gateway = gw
+	s.closed = make(chan struct{})
+	return nil
+}
+
+func (s *scriptTransport) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return nil
+}
+
+func (s *scriptTransport) Send(req, resp []byte, deadline time.Time) ([]byte, net.IP, error) {
+	s.mu.Lock()
+	s.sent++
+	closed := s.closed
+	s.mu.Unlock()
+	if r := s.respond(req); r != nil {
+		return resp[:copy(resp, r)], s.gateway, nil
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil, nil, os.ErrDeadlineExceeded
+	case <-closed:
+		return nil, nil, net.ErrClosed
+	}
+}
+
+func (s *scriptTransport) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+func TestCacheExternalAddress(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1e9, 0))
+	var (
+		epoch  uint32 = 1000
+		result uint16
+	)
+	st := &scriptTransport{respond: func(req []byte) []byte {
+		resp := []byte{0, req[1] | 0x80, 0, 0, 0, 0, 0, 0, 203, 0, 113, 5}
+		binary.BigEndian.PutUint16(resp[2:], result)
+		binary.BigEndian.PutUint32(resp[4:], epoch)
+		switch {
+		case result != 0:
+			return resp[:headerSize]
+		case req[1] != 0:
+			// A mapping response, granting the request.
+			return append(resp[:8], req[4], req[5], req[6], req[7], req[8], req[9], req[10], req[11])
+		}
+		return resp
+	}}
+	c := NewClient(net.IPv4(192, 168, 1, 1), WithTransport(st), WithClock(fake), CacheExternalAddress(time.Minute))
+
+	get := func(wantEpoch time.Duration, wantSent int) {
+		t.Helper()
+		addr, epoch, err := c.GetExternalAddress()
+		if err != nil || addr != netip.MustParseAddr("203.0.113.5") || epoch != wantEpoch {
+			t.Errorf("GetExternalAddress()=%v, %s, %v; want epoch %s", addr, epoch, err, wantEpoch)
+		}
+		if got := st.count(); got != wantSent {
+			t.Errorf("sent %d requests, want %d", got, wantSent)
+		}
+	}
+	cached := func(want bool) {
+		t.Helper()
+		if _, _, ok := c.Cached(); ok != want {
+			t.Errorf("Cached() ok=%t, want %t", ok, want)
+		}
+	}
+
+	cached(false)
+	get(1000*time.Second, 1)
+	// Cached, with the epoch advanced.
+	fake.Advance(10*time.Second + 500*time.Millisecond)
+	get(1010*time.Second, 1)
+	cached(true)
+
+	// Refresh asks even though the address is cached.
+	epoch = 1010
+	if addr, e, err := c.Refresh(context.Background()); err != nil || addr != netip.MustParseAddr("203.0.113.5") || e != 1010*time.Second {
+		t.Errorf("Refresh()=%v, %s, %v", addr, e, err)
+	}
+	get(1010*time.Second, 2)
+
+	// Expired.
+	fake.Advance(time.Minute)
+	cached(false)
+	epoch = 1070
+	get(1070*time.Second, 3)
+
+	// A mapping response with an earlier epoch means the gateway rebooted.
+	epoch = 5
+	if _, err := c.AddPortMapping("udp", 1000, 1000, time.Hour); err != nil {
+		t.Fatalf("AddPortMapping() failed: %v", err)
+	}
+	cached(false)
+	get(5*time.Second, 5)
+
+	// Network Failure means the gateway may have lost its address.
+	result = uint16(NetworkFailure)
+	if _, err := c.AddPortMapping("udp", 1000, 1000, time.Hour); !errors.Is(err, NetworkFailure) {
+		t.Fatalf("AddPortMapping() err=%v, want NetworkFailure", err)
+	}
+	cached(false)
+	result = 0
+	get(5*time.Second, 7)
+
+	// Announcements replace the cached address.
+	c.cacheAddress(netip.MustParseAddr("198.51.100.7"), 6*time.Second)
+	if addr, _, ok := c.Cached(); !ok || addr != netip.MustParseAddr("198.51.100.7") {
+		t.Errorf("Cached()=%v, %t after an announcement", addr, ok)
+	}
+	c.cacheAddress(netip.IPv4Unspecified(), 7*time.Second)
+	cached(false)
+}
+
+func TestObserve(t *testing.T) {
+	testCases := []struct {
+		name     string
+		epoch    time.Duration
+		external netip.Addr
+		wantKept bool
+	}{
+		{name: "epoch advanced", epoch: 1060 * time.Second, wantKept: true},
+		{name: "epoch regressed", epoch: 30 * time.Second},
+		{name: "same pcp address", epoch: 1060 * time.Second, external: netip.MustParseAddr("203.0.113.5"), wantKept: true},
+		{name: "different pcp address", epoch: 1060 * time.Second, external: netip.MustParseAddr("198.51.100.7")},
+		{name: "ipv6 pinhole", epoch: 1060 * time.Second, external: netip.MustParseAddr("2001:db8::1"), wantKept: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := clock.NewFake(time.Unix(1e9, 0))
+			c := NewClient(net.IPv4(192, 168, 1, 1), WithClock(fake), CacheExternalAddress(time.Hour))
+			c.cacheAddress(netip.MustParseAddr("203.0.113.5"), 1000*time.Second)
+			fake.Advance(time.Minute)
+			c.observe(tc.epoch, tc.external)
+			if _, _, ok := c.Cached(); ok != tc.wantKept {
+				t.Errorf("Cached() ok=%t, want %t", ok, tc.wantKept)
+			}
+		})
+	}
+}
+
+func TestRefreshCancel(t *testing.T) {
+	st := &scriptTransport{respond: func([]byte) []byte { return nil }}
+	c := NewClient(net.IPv4(192, 168, 1, 1), WithTransport(st), CacheExternalAddress(time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for st.count() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	start := time.Now()
+	if _, _, err := c.Refresh(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Refresh() err=%v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Refresh() took %s after being cancelled", elapsed)
+	}
+}
+
+// closeRaceTransport cancels the request while sending it, and holds the
+// Close made for the cancellation until release is closed.
+type closeRaceTransport struct {
+	cancel  func()
+	closing chan struct{}
+	release chan struct{}
+	closes  atomic.Int32
+}
+
+func (t *closeRaceTransport) Open(net.IP, int) error { return nil }
+
+func (t *closeRaceTransport) Close() error {
+	if t.closes.Add(1) == 1 {
+		close(t.closing)
+		<-t.release
+	}
+	return nil
+}
+
+func (t *closeRaceTransport) Send(req, resp []byte, deadline time.Time) ([]byte, net.IP, error) {
+	t.cancel()
+	<-t.closing
+	return resp[:copy(resp, []byte{0, 128, 0, 0, 0, 0, 3, 232, 203, 0, 113, 5})], net.IPv4(192, 168, 1, 1), nil
+}
+
+func TestRefreshCancelWaitsForClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := &closeRaceTransport{cancel: cancel, closing: make(chan struct{}), release: make(chan struct{})}
+	c := NewClient(net.IPv4(192, 168, 1, 1), WithTransport(tr))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Refresh(ctx)
+	}()
+	// Returning now would let the next request open the transport, only for
+	// the cancellation to close it.
+	select {
+	case <-done:
+		t.Errorf("Refresh() returned while the transport was being closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(tr.release)
+	<-done
+}
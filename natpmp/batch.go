@@ -0,0 +1,291 @@
+package natpmp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+const defaultMaxInFlight = 8
+
+// MappingRequest describes one mapping to add with AddPortMappings.
+// The fields have the same meaning as the arguments to AddPortMapping.
+type MappingRequest struct {
+	Protocol              string
+	InternalPort          int
+	RequestedExternalPort int
+	Lifetime              time.Duration
+}
+
+// MappingResult holds the outcome of one MappingRequest.
+// Exactly one of Mapping and Err is set, except that both are set when the
+// mapping was granted but could not be recorded in the Registry or StateStore.
+type MappingResult struct {
+	Request MappingRequest
+	Mapping *PortMapping
+	Err     error
+}
+
+// AddPortMappings adds many port mappings at once. Up to MaxInFlight
+// requests are outstanding at a time and all of them share one
+// retransmission schedule, so a lost packet delays the batch by one
+// retransmission rather than one per request.
+//
+// Responses are matched to requests by protocol and internal port, so each
+// protocol and internal port may only appear once in the batch.
+// The returned error is only set if the batch could not be sent at all;
+// the outcome of each request is in its MappingResult.
+//
+// If the Transport is not a PacketTransport the requests are sent one at a time.
+func (c *Client) AddPortMappings(reqs []MappingRequest) ([]MappingResult, error) {
+	results := make([]MappingResult, len(reqs))
+	for i, r := range reqs {
+		results[i].Request = r
+	}
+	pt, ok := c.transport.(PacketTransport)
+	if !ok {
+		for i, r := range reqs {
+			results[i].Mapping, results[i].Err = c.AddPortMapping(r.Protocol, r.InternalPort, r.RequestedExternalPort, r.Lifetime)
+		}
+		return results, nil
+	}
+
+	b := &batch{
+		transport: pt,
+		gatewayIP: c.gatewayIP,
+		results:   results,
+		wire:      make([]wire.MappingRequest, len(reqs)),
+		index:     make(map[batchKey]int),
+		inFlight:  make(map[int]bool),
+		window:    c.maxInFlight,
+		pace:      func() error { return c.limiter.wait(context.Background(), c.clock) },
+	}
+	fresh := make([]bool, len(reqs))
+	for i, r := range reqs {
+		req, err := newMappingReq(r.Protocol, r.InternalPort, r.RequestedExternalPort, r.Lifetime)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		key := batchKey{req.Opcode, req.InternalPort}
+		if _, dup := b.index[key]; dup {
+			results[i].Err = fmt.Errorf("duplicate request for %s port %d", r.Protocol, r.InternalPort)
+			continue
+		}
+		if fresh[i], err = c.claim(r.Protocol, req.InternalPort); err != nil {
+			results[i].Err = err
+			continue
+		}
+		b.index[key] = i
+		b.wire[i] = req
+		b.queue = append(b.queue, i)
+	}
+	if len(b.queue) == 0 {
+		return results, nil
+	}
+	defer func() {
+		for _, i := range b.index {
+			r := &results[i]
+			r.Err = c.track(r.Request.Protocol, b.wire[i].InternalPort, fresh[i], r.Mapping, r.Err)
+		}
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := pt.Open(c.gatewayIP, c.port); err != nil {
+		err = fmt.Errorf("error net.DialUDP(): %w", err)
+		// The deferred track releases the claims of the failed requests.
+		for _, i := range b.queue {
+			results[i].Err = err
+		}
+		return nil, err
+	}
+	defer pt.Close()
+	if lt, ok := pt.(localAddrTransport); ok {
+		b.local, _ = localAddr(lt.LocalAddr())
+	}
+
+	retry := c.newRetry()
+	_, err := retry.run(b.round)
+	if err == nil {
+		return results, nil
+	}
+	for _, i := range b.pending() {
+		results[i].Err = fmt.Errorf("AddPortMappings Failed: %w", err)
+	}
+	return results, nil
+}
+
+type batchKey struct {
+	opcode       wire.Opcode
+	internalPort uint16
+}
+
+type batch struct {
+	transport PacketTransport
+	gatewayIP net.IP
+	results   []MappingResult
+	wire      []wire.MappingRequest
+	index     map[batchKey]int
+
+	// queue holds the requests which have not been sent yet,
+	// inFlight the requests which have been sent but not answered.
+	queue    []int
+	inFlight map[int]bool
+	window   int
+	// pace waits for the Limiter before a request is first sent.
+	pace func() error
+	// local is the address the requests are sent from, if known.
+	local netip.Addr
+	// serial holds the opcodes answered with a header-only failure while
+	// several of their requests were in flight. Those requests are then
+	// sent one at a time, so the next such failure can be matched.
+	serial map[wire.Opcode]bool
+
+	buf rpcBuffer
+}
+
+func (b *batch) pending() []int {
+	pending := append([]int(nil), b.queue...)
+	for i := range b.inFlight {
+		pending = append(pending, i)
+	}
+	return pending
+}
+
+// round (re)sends every outstanding request and reads responses until all
+// requests are answered or the deadline passes.
+func (b *batch) round(deadline time.Time) error {
+	for i := range b.inFlight {
+		if err := b.send(i, deadline); err != nil {
+			return err
+		}
+	}
+	if err := b.fill(deadline); err != nil {
+		return err
+	}
+	for len(b.inFlight) > 0 {
+		result, remoteIP, err := b.transport.Read(b.buf.resp[:], deadline)
+		if err != nil {
+			return err
+		}
+		if !remoteIP.Equal(b.gatewayIP) {
+			continue
+		}
+		b.receive(result)
+		if err := b.fill(deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fill sends queued requests until the window is full.
+func (b *batch) fill(deadline time.Time) error {
+	for len(b.inFlight) < b.window {
+		q := slices.IndexFunc(b.queue, func(i int) bool {
+			op := b.wire[i].Opcode
+			return !b.serial[op] || b.inFlightOf(op) == nil
+		})
+		if q < 0 {
+			return nil
+		}
+		i := b.queue[q]
+		b.queue = slices.Delete(b.queue, q, q+1)
+		b.inFlight[i] = true
+		if err := b.pace(); err != nil {
+			return err
+		}
+		if err := b.send(i, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *batch) send(i int, deadline time.Time) error {
+	req, _ := b.wire[i].AppendBinary(b.buf.req[:0])
+	return b.transport.Write(req, deadline)
+}
+
+// receive records a response for the request it answers.
+// Responses which do not answer an outstanding request are ignored.
+func (b *batch) receive(result []byte) {
+	if len(result) < headerSize {
+		return
+	}
+	op := wire.Opcode(result[1]).Request()
+	if result[0] != wire.Version {
+		// The gateway does not speak NAT-PMP, so every request fails. A
+		// stray packet which answers none of the requests is ignored.
+		if len(b.inFlightOf(op)) > 0 {
+			b.fail(func(*wire.MappingRequest) bool { return true }, &VersionErr{Version: int(result[0])})
+		}
+		return
+	}
+	var header wire.ErrorResponse
+	if err := header.UnmarshalBinary(result); err == nil && header.ResultCode != wire.Success {
+		// A failure with only the common header cannot be matched by
+		// internal port. It is only taken as the answer when one request
+		// with the opcode is in flight; otherwise the others go back to
+		// the queue to be sent one at a time, and the retransmission of
+		// the one left in flight draws the failure again if it is its own.
+		switch inFlight := b.inFlightOf(op); len(inFlight) {
+		case 0:
+		case 1:
+			b.fail(func(r *wire.MappingRequest) bool { return r.Opcode == op }, ResultCodeErr(header.ResultCode))
+		default:
+			if b.serial == nil {
+				b.serial = make(map[wire.Opcode]bool)
+			}
+			b.serial[op] = true
+			slices.Sort(inFlight)
+			for _, i := range inFlight[1:] {
+				delete(b.inFlight, i)
+			}
+			b.queue = append(inFlight[1:], b.queue...)
+		}
+		return
+	}
+	var resp wire.MappingResponse
+	if err := resp.UnmarshalBinary(result); err != nil {
+		return
+	}
+	i, ok := b.index[batchKey{resp.Opcode.Request(), resp.InternalPort}]
+	if !ok || !b.inFlight[i] {
+		return
+	}
+	delete(b.inFlight, i)
+	if resp.ResultCode != 0 {
+		b.results[i].Err = fmt.Errorf("AddPortMappings Failed: %w", ResultCodeErr(resp.ResultCode))
+		return
+	}
+	b.results[i].Mapping = portMapping(&resp, &b.wire[i])
+	b.results[i].Mapping.InternalAddr = b.local
+}
+
+// inFlightOf returns the requests in flight with the opcode.
+func (b *batch) inFlightOf(op wire.Opcode) []int {
+	var reqs []int
+	for i := range b.inFlight {
+		if b.wire[i].Opcode == op {
+			reqs = append(reqs, i)
+		}
+	}
+	return reqs
+}
+
+// fail records the error for every outstanding request which matches.
+func (b *batch) fail(match func(*wire.MappingRequest) bool, err error) {
+	for i := range b.inFlight {
+		if match(&b.wire[i]) {
+			b.results[i].Err = fmt.Errorf("AddPortMappings Failed: %w", err)
+			delete(b.inFlight, i)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package natpmp
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+func TestAddPortMappings(t *testing.T) {
+	var reqs []MappingRequest
+	for port := 5000; port < 5050; port++ {
+		reqs = append(reqs, MappingRequest{"udp", port, port, time.Hour})
+	}
+	reqs = append(reqs,
+		MappingRequest{"tcp", 5000, 5000, time.Hour},
+		MappingRequest{"udp", 5000, 6000, time.Hour},
+		MappingRequest{"sctp", 5000, 5000, time.Hour},
+	)
+
+	dropped := map[uint16]bool{}
+	gw := &fakeGateway{
+		// Lose the first request for every tenth port.
+		drop: func(r wire.MappingRequest) bool {
+			if r.InternalPort%10 != 0 || dropped[r.InternalPort] {
+				return false
+			}
+			dropped[r.InternalPort] = true
+			return true
+		},
+	}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw), MaxInFlight(16))
+
+	start := time.Now()
+	results, err := c.AddPortMappings(reqs)
+	if err != nil {
+		t.Fatalf("AddPortMappings() got err: %v", err)
+	}
+	// Lost packets share retransmissions rather than each costing one.
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("AddPortMappings() took %s", elapsed)
+	}
+	if len(results) != len(reqs) {
+		t.Fatalf("got %d results, want %d", len(results), len(reqs))
+	}
+	for i, r := range results[:51] {
+		if r.Err != nil {
+			t.Errorf("results[%d].Err=%v", i, r.Err)
+			continue
+		}
+		if r.Request != reqs[i] {
+			t.Errorf("results[%d].Request=%+v != %+v", i, r.Request, reqs[i])
+		}
+		if int(r.Mapping.InternalPort) != reqs[i].InternalPort || int(r.Mapping.MappedExternalPort) != reqs[i].RequestedExternalPort {
+			t.Errorf("results[%d].Mapping=%+v", i, r.Mapping)
+		}
+	}
+	if err := results[51].Err; err == nil {
+		t.Errorf("duplicate request expected error")
+	}
+	if err := results[52].Err; err == nil {
+		t.Errorf("unknown protocol expected error")
+	}
+	if got := len(gw.mappingRequests()); got != 51+len(dropped) {
+		t.Errorf("gateway got %d requests, want %d", got, 51+len(dropped))
+	}
+}
+
+// closedGateway is a fakeGateway which cannot be opened.
+type closedGateway struct {
+	*fakeGateway
+}
+
+func (closedGateway) Open(net.IP, int) error { return errors.New("cannot bind source address") }
+
+func TestAddPortMappingsOpenFails(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	registry := &Registry{Dir: t.TempDir()}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(closedGateway{&fakeGateway{}}), WithStateStore(store), WithRegistry(registry))
+	if _, err := c.AddPortMappings([]MappingRequest{{"tcp", 80, 80, time.Hour}, {"udp", 53, 53, time.Hour}}); !errContains(err, "cannot bind") {
+		t.Fatalf("AddPortMappings() err=%v, want the Open error", err)
+	}
+	if owners, err := registry.List(); err != nil || len(owners) != 0 {
+		t.Errorf("List()=%+v, %v; want the claims released", owners, err)
+	}
+	if records, err := store.Load(); err != nil || len(records) != 0 {
+		t.Errorf("Load()=%+v, %v; want nothing recorded", records, err)
+	}
+}
+
+func TestAddPortMappingsTimeout(t *testing.T) {
+	gw := &fakeGateway{
+		drop: func(r wire.MappingRequest) bool { return r.InternalPort == 81 },
+	}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw), Timeout(500*time.Millisecond))
+	results, err := c.AddPortMappings([]MappingRequest{
+		{"tcp", 80, 80, time.Hour},
+		{"tcp", 81, 81, time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("AddPortMappings() got err: %v", err)
+	}
+	if results[0].Err != nil {
+		t.Errorf("results[0].Err=%v", results[0].Err)
+	}
+	if !errContains(results[1].Err, "Timed out") {
+		t.Errorf("results[1].Err=%v, want timeout", results[1].Err)
+	}
+}
+
+func TestAddPortMappingsUnsupportedOpcode(t *testing.T) {
+	// The gateway only maps UDP, and answers TCP requests with just a header.
+	gw := &fakeGateway{
+		unsupported: func(r wire.MappingRequest) bool { return r.Opcode == 2 },
+	}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw))
+	results, err := c.AddPortMappings([]MappingRequest{
+		{"tcp", 80, 80, time.Hour},
+		{"udp", 80, 80, time.Hour},
+		{"tcp", 81, 81, time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("AddPortMappings() got err: %v", err)
+	}
+	for _, i := range []int{0, 2} {
+		if !errors.Is(results[i].Err, UnsupportedOpcode) {
+			t.Errorf("results[%d].Err=%v, want %v", i, results[i].Err, UnsupportedOpcode)
+		}
+	}
+	if results[1].Err != nil {
+		t.Errorf("results[1].Err=%v", results[1].Err)
+	}
+}
+
+// strayGateway is a fakeGateway which queues a stray packet ahead of the
+// response to the first request.
+type strayGateway struct {
+	*fakeGateway
+	stray []byte
+}
+
+func (g *strayGateway) Write(req []byte, deadline time.Time) error {
+	if g.stray != nil {
+		g.queued <- g.stray
+		g.stray = nil
+	}
+	return g.fakeGateway.Write(req, deadline)
+}
+
+func TestAddPortMappingsStray(t *testing.T) {
+	testCases := []struct {
+		name  string
+		stray []byte
+	}{
+		{
+			// Such as a late reply to an earlier request.
+			name:  "header-only failure",
+			stray: []byte{0, 0x82, 0, byte(OutOfResources), 0, 0, 0x3, 0xe8},
+		},
+		{
+			name:  "version for another opcode",
+			stray: []byte{2, 0x81, 0, 1, 0, 0, 0, 0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := &strayGateway{fakeGateway: &fakeGateway{}, stray: tc.stray}
+			c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw))
+			results, err := c.AddPortMappings([]MappingRequest{
+				{"tcp", 80, 80, time.Hour},
+				{"tcp", 81, 81, time.Hour},
+			})
+			if err != nil {
+				t.Fatalf("AddPortMappings() got err: %v", err)
+			}
+			for i, r := range results {
+				if r.Err != nil {
+					t.Errorf("results[%d].Err=%v", i, r.Err)
+				}
+			}
+		})
+	}
+}
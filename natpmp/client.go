@@ -10,63 +10,106 @@
 package natpmp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/netip"
+	"sync"
 	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/wire"
 )
 
 // Client is a NAT-PMP protocol client.
+// It is safe for concurrent use; requests are sent to the gateway one at a time.
 type Client struct {
-	gatewayIP net.IP
-	port      int
-	timeout   time.Duration
-	transport Transport
+	gatewayIP      net.IP
+	port           int
+	timeout        time.Duration
+	attemptTimeout time.Duration
+	transport      Transport
+	maxInFlight    int
+	clock          clock.Clock
+	store          StateStore
+	registry       *Registry
+	limiter        *Limiter
+	coalesce       bool
+	addrTTL        time.Duration
+	source         netip.Addr
+	device         string
+
+	// mu serializes use of the transport.
+	mu sync.Mutex
+	// storeMu serializes updates to the store.
+	storeMu sync.Mutex
+	// claims holds the Registry claims for the mappings made by this Client.
+	claimsMu sync.Mutex
+	claims   map[claimKey]*Claim
+	// flights holds the requests being sent, for coalescing.
+	flightsMu sync.Mutex
+	flights   map[flightKey]*flight
+	// cache holds the external address, when addrTTL is set.
+	cacheMu sync.Mutex
+	cache   addrCache
 }
 
 // NewClient create a NAT-PMP client for the NAT-PMP server at the gateway.
-// Uses default timeout which is around 128 seconds.
+// By default requests follow the RFC 6886 retransmission schedule, which
+// gives up after 9 attempts and around 128 seconds.
 func NewClient(gatewayIP net.IP, opts ...Option) (nat *Client) {
 	c := &Client{
-		gatewayIP: gatewayIP,
-		port:      defaultPort,
-		transport: DefaultTransport(),
+		gatewayIP:   gatewayIP,
+		port:        defaultPort,
+		transport:   DefaultTransport(),
+		maxInFlight: defaultMaxInFlight,
+		clock:       clock.Real(),
+		coalesce:    true,
 	}
 	for _, opt := range opts {
 		opt(c)
 	}
+	if t, ok := c.transport.(*udpTransport); ok {
+		t.source, t.device = c.source, c.device
+	}
 	return c
 }
 
 // GetExternalAddress returns the external address of the router.
 // Note that this call can take up to 128 seconds to return.
+// With CacheExternalAddress, a recent answer is returned without asking.
 func (c *Client) GetExternalAddress() (addr netip.Addr, duration time.Duration, err error) {
-	var resp extAddrResp
-	if err := c.rpc(&extAddrReq{0, 0}, &resp); err != nil {
-		return netip.Addr{}, 0, fmt.Errorf("ExternalAddress Failed: %w", err)
-	}
-	return netip.AddrFrom4(resp.IPAddr), time.Duration(resp.DurationSecs) * time.Second, nil
+	return c.externalAddress(context.Background())
 }
 
-type extAddrReq struct {
-	Version byte
-	Opcode  byte
+// externalAddress is GetExternalAddress. Cancelling ctx abandons the
+// request.
+func (c *Client) externalAddress(ctx context.Context) (netip.Addr, time.Duration, error) {
+	if addr, epoch, ok := c.Cached(); ok {
+		return addr, epoch, nil
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var r wire.ExternalAddressRequest
+	req, _ := r.AppendBinary(buf.req[:0])
+	result, _, err := c.rpc(ctx, req, buf.resp[:], wire.ExternalAddressResponseSize)
+	if err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("ExternalAddress Failed: %w", err)
+	}
+	return c.decodeExternalAddress(result)
 }
 
-func (r extAddrReq) version() int { return int(r.Version) }
-func (r extAddrReq) opcode() byte { return r.Opcode }
+// DefaultLifetime is the port mapping lifetime recommended by RFC 6886.
+const DefaultLifetime = 7200 * time.Second
 
-type extAddrResp struct {
-	Version      byte
-	Opcode       byte
-	ResultCode   uint16
-	DurationSecs uint32
-	IPAddr       [4]byte
-}
+// maxLifetime is the longest lifetime which can be sent to the gateway.
+const maxLifetime = math.MaxUint32 * time.Second
 
-func (r extAddrResp) version() int    { return int(r.Version) }
-func (r extAddrResp) opcode() byte    { return r.Opcode }
-func (r extAddrResp) resultCode() int { return int(r.ResultCode) }
+// ErrInvalidLifetime is matched (using errors.Is) by the error returned
+// for a lifetime which cannot be sent to the gateway.
+var ErrInvalidLifetime = errors.New("invalid mapping lifetime")
 
 // PortMapping holds the result of calling AddPortMapping.
 type PortMapping struct {
@@ -76,61 +119,133 @@ type PortMapping struct {
 	MappedExternalPort uint16
 	// aka PortMappingLifetimeInSeconds
 	Lifetime time.Duration
+	// RequestedLifetime is the lifetime sent to the gateway, after rounding.
+	RequestedLifetime time.Duration
+	// RetryStats describes the attempts made before the gateway responded.
+	RetryStats RetryStats
+	// InternalAddr is the local address the request was sent from, which
+	// is the internal address the gateway maps the port to. It is the zero
+	// Addr if the Transport does not report its local address.
+	InternalAddr netip.Addr
+}
+
+// LifetimeReduced reports whether the gateway granted a shorter lifetime
+// than was requested.
+func (m *PortMapping) LifetimeReduced() bool {
+	return m.Lifetime < m.RequestedLifetime
+}
+
+// lifetimeSecs converts a lifetime to the whole number of seconds sent to
+// the gateway. Lifetimes are rounded to the nearest second and clamped to
+// the largest value the protocol allows. Only a lifetime of exactly 0
+// deletes a mapping; a positive lifetime which would round to 0 is an error.
+func lifetimeSecs(lifetime time.Duration) (uint32, error) {
+	switch {
+	case lifetime < 0:
+		return 0, fmt.Errorf("%w: %s is negative", ErrInvalidLifetime, lifetime)
+	case lifetime == 0:
+		return 0, nil
+	case lifetime >= maxLifetime:
+		return math.MaxUint32, nil
+	}
+	secs := lifetime.Round(time.Second) / time.Second
+	if secs == 0 {
+		return 0, fmt.Errorf("%w: %s rounds to 0 seconds, which deletes the mapping", ErrInvalidLifetime, lifetime)
+	}
+	return uint32(secs), nil
 }
 
 // AddPortMapping Adds (or deletes) a port mapping. To delete a mapping, set the requestedExternalPort and lifetime to 0.
+// The lifetime is rounded to the nearest second; use DefaultLifetime unless there is a reason not to.
 // Note that this call can take up to 128 seconds to return.
 func (c *Client) AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (result *PortMapping, err error) {
-	var opcode byte
+	return c.addPortMappingContext(context.Background(), protocol, internalPort, requestedExternalPort, lifetime)
+}
+
+// addPortMappingContext is AddPortMapping. Cancelling ctx abandons the
+// request.
+func (c *Client) addPortMappingContext(ctx context.Context, protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (*PortMapping, error) {
+	req, err := newMappingReq(protocol, internalPort, requestedExternalPort, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	fresh, err := c.claim(protocol, req.InternalPort)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.addPortMapping(ctx, req)
+	return m, c.track(protocol, req.InternalPort, fresh, m, err)
+}
+
+// track updates the Registry and StateStore with the outcome of a mapping
+// request, returning err or the error updating them.
+func (c *Client) track(protocol string, internalPort uint16, fresh bool, m *PortMapping, err error) error {
+	if cerr := c.updateClaim(protocol, internalPort, fresh, m); cerr != nil && err == nil {
+		err = fmt.Errorf("error updating registry: %w", cerr)
+	}
+	if err != nil || m == nil {
+		return err
+	}
+	if err := c.record(protocol, m); err != nil {
+		return fmt.Errorf("error recording mapping: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) addPortMapping(ctx context.Context, req wire.MappingRequest) (*PortMapping, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	reqBytes, _ := req.AppendBinary(buf.req[:0])
+	data, info, err := c.rpc(ctx, reqBytes, buf.resp[:], wire.MappingResponseSize)
+	if err != nil {
+		return nil, fmt.Errorf("AddPortMapping Failed: %w", err)
+	}
+	var resp wire.MappingResponse
+	if err := resp.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("AddPortMapping Failed: %w", err)
+	}
+	m := portMapping(&resp, &req)
+	m.RetryStats = info.stats
+	m.InternalAddr = info.local
+	return m, nil
+}
+
+func newMappingReq(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (wire.MappingRequest, error) {
+	var opcode wire.Opcode
 	switch protocol {
 	case "udp":
-		opcode = 1
+		opcode = wire.OpMapUDP
 	case "tcp":
-		opcode = 2
+		opcode = wire.OpMapTCP
 	default:
-		return nil, fmt.Errorf("unknown protocol %v", protocol)
+		return wire.MappingRequest{}, fmt.Errorf("unknown protocol %v", protocol)
 	}
-	req := mappingReq{
-		Version:       0,
-		Opcode:        opcode,
-		InternalPort:  uint16(internalPort),
-		RequestedPort: uint16(requestedExternalPort),
-		LifetimeSecs:  uint32(lifetime.Seconds()),
+	secs, err := lifetimeSecs(lifetime)
+	if err != nil {
+		return wire.MappingRequest{}, err
 	}
-	var resp mappingResp
-	if err := c.rpc(&req, &resp); err != nil {
-		return nil, fmt.Errorf("ExternalAddress Failed: %w", err)
-	}
-	return &PortMapping{
-		EpochDuration:      time.Duration(resp.DurationSecs) * time.Second,
-		InternalPort:       resp.InternalPort,
-		MappedExternalPort: resp.MappedPort,
-		Lifetime:           time.Duration(resp.LifetimeSecs) * time.Second,
+	return wire.MappingRequest{
+		Opcode:                opcode,
+		InternalPort:          uint16(internalPort),
+		SuggestedExternalPort: uint16(requestedExternalPort),
+		LifetimeSecs:          secs,
 	}, nil
 }
 
-type mappingReq struct {
-	Version       byte
-	Opcode        byte
-	_             int16 // reserved
-	InternalPort  uint16
-	RequestedPort uint16
-	LifetimeSecs  uint32
+// DeletePortMapping deletes the mapping for the internal port.
+// Note that this call can take up to 128 seconds to return.
+func (c *Client) DeletePortMapping(protocol string, internalPort int) error {
+	_, err := c.AddPortMapping(protocol, internalPort, 0, 0)
+	return err
 }
 
-func (r mappingReq) version() int { return int(r.Version) }
-func (r mappingReq) opcode() byte { return r.Opcode }
-
-type mappingResp struct {
-	Version      byte
-	Opcode       byte
-	ResultCode   uint16
-	DurationSecs uint32
-	InternalPort uint16
-	MappedPort   uint16
-	LifetimeSecs uint32
+// portMapping returns the mapping granted by the response to the request.
+func portMapping(resp *wire.MappingResponse, req *wire.MappingRequest) *PortMapping {
+	return &PortMapping{
+		EpochDuration:      time.Duration(resp.EpochSecs) * time.Second,
+		InternalPort:       resp.InternalPort,
+		MappedExternalPort: resp.MappedExternalPort,
+		Lifetime:           time.Duration(resp.LifetimeSecs) * time.Second,
+		RequestedLifetime:  time.Duration(req.LifetimeSecs) * time.Second,
+	}
 }
-
-func (r mappingResp) version() int    { return int(r.Version) }
-func (r mappingResp) opcode() byte    { return r.Opcode }
-func (r mappingResp) resultCode() int { return int(r.ResultCode) }
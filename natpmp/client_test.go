@@ -2,12 +2,20 @@ package natpmp
 
 import (
 	"bytes"
+	"encoding"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/netip"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/wire"
 )
 
 func TestGetExternalAddress(t *testing.T) {
@@ -186,6 +194,52 @@ func TestAddPortMapping(t *testing.T) {
 	}
 }
 
+func TestLifetime(t *testing.T) {
+	testCases := []struct {
+		name     string
+		lifetime time.Duration
+		wantSecs uint32
+		wantErr  error
+	}{
+		{"delete", 0, 0, nil},
+		{"whole seconds", 1200 * time.Second, 1200, nil},
+		{"round down", 1400 * time.Millisecond, 1, nil},
+		{"round up", 1500 * time.Millisecond, 2, nil},
+		{"half second", 500 * time.Millisecond, 1, nil},
+		{"rounds to delete", 499 * time.Millisecond, 0, ErrInvalidLifetime},
+		{"negative", -time.Second, 0, ErrInvalidLifetime},
+		{"clamped", 200 * 365 * 24 * time.Hour, math.MaxUint32, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := &fakeGateway{grantLifetime: 60}
+			c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw))
+			result, err := c.AddPortMapping("udp", 123, 456, tc.lifetime)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("err=%v != %v", err, tc.wantErr)
+				}
+				if reqs := gw.mappingRequests(); len(reqs) != 0 {
+					t.Errorf("invalid lifetime was sent: %+v", reqs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got err: %v", err)
+			}
+			if got := gw.mappingRequests()[0].LifetimeSecs; got != tc.wantSecs {
+				t.Errorf("LifetimeSecs=%d != %d", got, tc.wantSecs)
+			}
+			if result.RequestedLifetime != time.Duration(tc.wantSecs)*time.Second {
+				t.Errorf("RequestedLifetime=%s", result.RequestedLifetime)
+			}
+			if want := tc.wantSecs > 60; result.LifetimeReduced() != want {
+				t.Errorf("LifetimeReduced()=%t != %t", result.LifetimeReduced(), want)
+			}
+		})
+	}
+}
+
 func TestProtocolChecks(t *testing.T) {
 	testCases := []struct {
 		name                  string
@@ -237,6 +291,37 @@ func TestProtocolChecks(t *testing.T) {
 				resp: []uint8{0x0, 0x82, 0x0, 0x11, 0x0, 0x14, 0x4, 0x96, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
 			},
 		},
+		{
+			"Short unsupported version",
+			"tcp", 123, 456, time.Duration(1200) * time.Second,
+			nil,
+			UnsupportedVersion,
+			testCall{
+				req:  []uint8{0x0, 0x2, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+				resp: []uint8{0x0, 0x82, 0x0, 0x1, 0x0, 0x14, 0x4, 0x96},
+			},
+		},
+		{
+			"Short unsupported opcode",
+			"tcp", 123, 456, time.Duration(1200) * time.Second,
+			nil,
+			UnsupportedOpcode,
+			testCall{
+				req:  []uint8{0x0, 0x2, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+				resp: []uint8{0x0, 0x82, 0x0, 0x5, 0x0, 0x14, 0x4, 0x96},
+			},
+		},
+		{
+			"PCP only gateway",
+			"tcp", 123, 456, time.Duration(1200) * time.Second,
+			nil,
+			fmt.Errorf("gateway only supports PCP"),
+			testCall{
+				req: []uint8{0x0, 0x2, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+				// PCP response header: UNSUPP_VERSION, lifetime and epoch.
+				resp: []uint8{0x2, 0x82, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -250,9 +335,12 @@ func TestProtocolChecks(t *testing.T) {
 			c := NewClient(remote.IP, WithTransport(transport))
 			result, err := c.AddPortMapping(tc.protocol, tc.internalPort, tc.requestedExternalPort, tc.lifetime)
 			if tc.err != nil {
-				if !errContains(err, tc.err.Error()) {
+				if !errors.Is(err, tc.err) && !errContains(err, tc.err.Error()) {
 					t.Errorf("err=%v != %v", err, tc.err)
 				}
+				if !strings.HasPrefix(err.Error(), "AddPortMapping Failed: ") {
+					t.Errorf("err=%q, want the AddPortMapping prefix", err)
+				}
 				return
 			}
 			if result != nil {
@@ -337,3 +425,150 @@ func (t *testTransport) Send(req, resp []byte, deadline time.Time) ([]byte, net.
 	n := copy(resp, t.testCall.resp)
 	return resp[:n], t.gateway, nil
 }
+
+// fakeGateway is a PacketTransport which answers NAT-PMP requests like a
+// gateway, recording the mapping requests it receives.
+type fakeGateway struct {
+	extAddr [4]byte
+	// grantLifetime overrides the lifetime in mapping responses when non-zero.
+	grantLifetime uint32
+	// grantPort picks the external port for a mapping request when non-nil.
+	grantPort func(requested uint16) uint16
+	// drop loses the request (after recording it) when it returns true.
+	drop func(req wire.MappingRequest) bool
+	// unsupported answers the request with a header-only Unsupported Opcode
+	// response when it returns true.
+	unsupported func(req wire.MappingRequest) bool
+	// epoch overrides the 1000 second epoch in mapping responses when non-zero.
+	epoch uint32
+
+	// clock, when set, is advanced to the deadline instead of waiting for
+	// it when there is no response to read.
+	clock *clock.Fake
+
+	mu       sync.Mutex
+	gateway  net.IP
+	requests []wire.MappingRequest
+	// sentAt holds the clock time of each mapping request.
+	sentAt []time.Time
+	queued chan []byte
+}
+
+var _ PacketTransport = (*fakeGateway)(nil)
+
+func (g *fakeGateway) Open(gw net.IP, port int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.gateway = gw
+	g.queued = make(chan []byte, 1024)
+	return nil
+}
+func (g *fakeGateway) Close() error { return nil }
+func (g *fakeGateway) Send(req, resp []byte, deadline time.Time) ([]byte, net.IP, error) {
+	if err := g.Write(req, deadline); err != nil {
+		return nil, nil, err
+	}
+	return g.Read(resp, deadline)
+}
+
+func (g *fakeGateway) Write(req []byte, deadline time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, err := g.respond(req)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		g.queued <- r
+	}
+	return nil
+}
+
+func (g *fakeGateway) Read(resp []byte, deadline time.Time) ([]byte, net.IP, error) {
+	if g.clock != nil {
+		select {
+		case r := <-g.queued:
+			n := copy(resp, r)
+			return resp[:n], g.gateway, nil
+		default:
+			g.clock.AdvanceTo(deadline)
+			return nil, nil, os.ErrDeadlineExceeded
+		}
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-g.queued:
+		n := copy(resp, r)
+		return resp[:n], g.gateway, nil
+	case <-timer.C:
+		return nil, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// respond returns the gateway's response to the request,
+// or nil if the request is dropped.
+func (g *fakeGateway) respond(req []byte) ([]byte, error) {
+	if len(req) < 2 {
+		return nil, fmt.Errorf("short request %v", req)
+	}
+	switch req[1] {
+	case 0:
+		return encodeTestResp(&wire.ExternalAddressResponse{
+			ResponseHeader: wire.ResponseHeader{Opcode: 0x80, EpochSecs: 1000},
+			ExternalAddr:   g.extAddr,
+		}), nil
+	case 1, 2:
+		var mr wire.MappingRequest
+		if err := mr.UnmarshalBinary(req); err != nil {
+			return nil, err
+		}
+		g.requests = append(g.requests, mr)
+		if g.clock != nil {
+			g.sentAt = append(g.sentAt, g.clock.Now())
+		}
+		if g.drop != nil && g.drop(mr) {
+			return nil, nil
+		}
+		if g.unsupported != nil && g.unsupported(mr) {
+			return []byte{0x0, byte(mr.Opcode.Response()), 0x0, byte(UnsupportedOpcode), 0x0, 0x0, 0x3, 0xe8}, nil
+		}
+		r := &wire.MappingResponse{
+			ResponseHeader:     wire.ResponseHeader{Opcode: mr.Opcode.Response(), EpochSecs: 1000},
+			InternalPort:       mr.InternalPort,
+			MappedExternalPort: mr.SuggestedExternalPort,
+			LifetimeSecs:       mr.LifetimeSecs,
+		}
+		if g.epoch != 0 {
+			r.EpochSecs = g.epoch
+		}
+		if g.grantLifetime != 0 && mr.LifetimeSecs != 0 {
+			r.LifetimeSecs = g.grantLifetime
+		}
+		if g.grantPort != nil && mr.LifetimeSecs != 0 {
+			r.MappedExternalPort = g.grantPort(mr.SuggestedExternalPort)
+		}
+		return encodeTestResp(r), nil
+	}
+	return nil, fmt.Errorf("unexpected opcode %d", req[1])
+}
+
+func (g *fakeGateway) sendTimes() []time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]time.Time(nil), g.sentAt...)
+}
+
+func (g *fakeGateway) mappingRequests() []wire.MappingRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]wire.MappingRequest(nil), g.requests...)
+}
+
+func encodeTestResp(r encoding.BinaryMarshaler) []byte {
+	b, err := r.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
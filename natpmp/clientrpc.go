@@ -1,90 +1,179 @@
 package natpmp
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"net"
-	"reflect"
+	"net/netip"
 	"time"
 )
 
 const defaultPort = 5351
-const maxRetries = 9
-const initialPause = 250 * time.Millisecond
 
-type request interface {
-	version() int
-	opcode() byte
+// rpcInfo describes how a request was sent to the gateway.
+type rpcInfo struct {
+	stats RetryStats
+	// local is the address the request was sent from, the zero Addr if the
+	// Transport does not report it.
+	local netip.Addr
 }
-type response interface {
-	request
-	resultCode() int
+
+// rpc sends the encoded request to the gateway and checks the common header
+// of the response, which must be exactly size bytes. The response is read
+// into resp and the returned slice shares its memory. Callers sending the
+// same request at once share one exchange, unless Coalesce(false) is set
+// or ctx can be cancelled, since one caller cancelling must not abandon
+// the others' request.
+func (c *Client) rpc(ctx context.Context, req, resp []byte, size int) ([]byte, rpcInfo, error) {
+	send := func() ([]byte, rpcInfo, error) { return c.send(ctx, req, resp, size) }
+	if !c.coalesce || ctx.Done() != nil {
+		return send()
+	}
+	return c.coalesced(req, resp, send)
 }
 
-func (c *Client) rpc(req request, resp response) error {
+// send is rpc for one caller, paced by the Limiter. Cancelling ctx
+// abandons the request.
+func (c *Client) send(ctx context.Context, req, resp []byte, size int) ([]byte, rpcInfo, error) {
+	if err := c.limiter.wait(ctx, c.clock); err != nil {
+		return nil, rpcInfo{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, rpcInfo{}, err
+	}
 	if err := c.transport.Open(c.gatewayIP, c.port); err != nil {
-		return fmt.Errorf("error net.DialUDP(): %w", err)
+		return nil, rpcInfo{}, fmt.Errorf("error net.DialUDP(): %w", err)
 	}
 	defer c.transport.Close()
-
-	var reqBuf bytes.Buffer
-	if err := binary.Write(&reqBuf, binary.BigEndian, req); err != nil {
-		return fmt.Errorf("error Write(%T) request: %w", req, err)
+	var info rpcInfo
+	if lt, ok := c.transport.(localAddrTransport); ok {
+		info.local, _ = localAddr(lt.LocalAddr())
+	}
+	if ctx.Done() != nil {
+		// Closing the transport ends a Send waiting for its deadline.
+		defer c.closeOnCancel(ctx)()
 	}
 
-	retry := &retry{
-		initial:    initialPause,
-		maxRetries: maxRetries,
-		timeout:    c.timeout,
-		retryDelay: retryTimeoutErrors,
-		retryImmediate: func(err error) bool {
-			// Ignore this packet.
-			// Continue without increasing retransmission timeout or deadline.
-			return errors.Is(err, &mistmatchedGatewayErr{})
-		},
+	result, stats, err := c.exchange(req, resp, nil)
+	info.stats = stats
+	if ctx.Err() != nil {
+		return nil, info, ctx.Err()
 	}
-	if retry.timeout == 0 {
-		retry.timeout = 1 * time.Second
+	if err != nil {
+		return nil, info, err
 	}
+	if err := checkHeader(result, req[1]|0x80); err != nil {
+		if errors.Is(err, NetworkFailure) {
+			// The gateway may have lost its external address.
+			c.invalidate()
+		}
+		return nil, info, err
+	}
+	if err := checkSize(result, size); err != nil {
+		return nil, info, err
+	}
+	c.observe(time.Duration(binary.BigEndian.Uint32(result[4:]))*time.Second, netip.Addr{})
+	return result, info, nil
+}
 
-	// 16 bytes is the maximum result size.
-	result := make([]byte, 16)
-	err := retry.run(func(deadline time.Time) error {
-		d, remoteIP, err := c.transport.Send(reqBuf.Bytes(), result, deadline)
+// closeOnCancel closes the transport when ctx is cancelled, until the
+// returned stop func is called. Stop waits for a close which has started,
+// so that it cannot close the transport after the caller releases c.mu and
+// the next request opens it. The caller must hold c.mu.
+func (c *Client) closeOnCancel(ctx context.Context) (stop func()) {
+	closed := make(chan struct{})
+	stopClose := context.AfterFunc(ctx, func() {
+		defer close(closed)
+		c.transport.Close()
+	})
+	return func() {
+		if !stopClose() {
+			<-closed
+		}
+	}
+}
+
+// exchange sends the request on the open transport until a response
+// arrives from the gateway, following the retransmission schedule.
+// Responses which accept rejects with errIgnored are dropped like those
+// from other addresses. The caller must hold c.mu.
+func (c *Client) exchange(req, resp []byte, accept func([]byte) error) ([]byte, RetryStats, error) {
+	retry := c.newRetry()
+	var result []byte
+	stats, err := retry.run(func(deadline time.Time) error {
+		d, remoteIP, err := c.transport.Send(req, resp, deadline)
+		if err != nil {
+			return err
+		}
 		if !remoteIP.Equal(c.gatewayIP) {
 			// Ignore this packet.
 			// Continue without increasing retransmission timeout or deadline.
 			return &mistmatchedGatewayErr{c.gatewayIP, remoteIP}
 		}
+		if accept != nil {
+			if err := accept(d); err != nil {
+				return err
+			}
+		}
 		result = d
-		return err
+		return nil
 	})
-	if err != nil {
-		return err
-	}
+	return result, stats, err
+}
 
-	expectedSize := int(reflect.Indirect(reflect.ValueOf(resp)).Type().Size())
-	expectedOp := req.opcode() | 0x80
-	err = binary.Read(bytes.NewReader(result), binary.BigEndian, resp)
+// errIgnored is returned by an accept func for a response which belongs to
+// a different request, such as a late answer to an earlier one.
+var errIgnored = errors.New("response ignored")
 
-	switch {
-	case len(result) != expectedSize:
-		return fmt.Errorf("unexpected result size %d, expected %d", len(result), expectedSize)
-	case errors.Is(err, io.EOF):
-		return fmt.Errorf("unexpected result size %d for type %T", len(result), resp)
-	case resp.version() != 0:
-		return fmt.Errorf("unknown protocol version %d", resp.version())
-	case resp.opcode() != expectedOp:
-		return fmt.Errorf("unexpected opcode 0x%X (not 0x%X)", resp.opcode(), expectedOp)
-	case resp.resultCode() != 0:
-		return ResultCodeErr(resp.resultCode())
+// headerSize is the size of the header common to all responses. Gateways
+// may return only the header for a failed request (RFC 6886 section 3.5).
+const headerSize = 8
+
+// checkHeader checks the version, opcode and result code in the common
+// response header. The result code is reported whenever the header is
+// present, even if the rest of the response is missing.
+func checkHeader(result []byte, expectedOp byte) error {
+	if len(result) < headerSize {
+		return nil
+	}
+	switch code := binary.BigEndian.Uint16(result[2:]); {
+	case result[0] != 0:
+		return &VersionErr{Version: int(result[0])}
+	case result[1] != expectedOp:
+		return &OpcodeErr{Got: result[1], Want: expectedOp}
+	case code != 0:
+		return ResultCodeErr(code)
+	}
+	return nil
+}
+
+func checkSize(data []byte, size int) error {
+	if len(data) != size {
+		return &SizeErr{Got: len(data), Want: size}
 	}
 	return nil
 }
 
+func (c *Client) newRetry() retry {
+	return retry{
+		clock:       c.clock,
+		initial:     initialPause,
+		maxAttempts: maxAttempts,
+		timeout:     c.timeout,
+		maxPause:    c.attemptTimeout,
+		retryDelay:  retryTimeoutErrors,
+		retryImmediate: func(err error) bool {
+			// Ignore this packet.
+			// Continue without increasing retransmission timeout or deadline.
+			return errors.Is(err, &mistmatchedGatewayErr{}) || errors.Is(err, errIgnored)
+		},
+	}
+}
+
 func retryTimeoutErrors(err error) bool {
 	var ne net.Error
 	return errors.As(err, &ne) && ne.Timeout()
@@ -104,8 +193,78 @@ func (e *mistmatchedGatewayErr) Error() string {
 	return fmt.Sprintf("error remote address %s does not match specified gateway %s", e.Remote, e.Gateways)
 }
 
+// ResultCodeErr is the non-zero result code returned by the gateway.
+// The codes defined by RFC 6886 are provided as constants, so a failure can
+// be checked with errors.Is(err, natpmp.OutOfResources).
 type ResultCodeErr int
 
+const (
+	UnsupportedVersion ResultCodeErr = 1
+	NotAuthorized      ResultCodeErr = 2
+	NetworkFailure     ResultCodeErr = 3
+	OutOfResources     ResultCodeErr = 4
+	UnsupportedOpcode  ResultCodeErr = 5
+)
+
 func (r ResultCodeErr) Error() string {
-	return fmt.Sprintf("error NAT-PMP non-zero result code:%d", int(r))
+	var reason string
+	switch r {
+	case UnsupportedVersion:
+		reason = ": gateway does not support NAT-PMP v0"
+	case NotAuthorized:
+		reason = ": not authorized / refused"
+	case NetworkFailure:
+		reason = ": network failure"
+	case OutOfResources:
+		reason = ": out of resources"
+	case UnsupportedOpcode:
+		reason = ": unsupported opcode"
+	}
+	return fmt.Sprintf("error NAT-PMP non-zero result code %d%s", int(r), reason)
+}
+
+// VersionErr is returned when the gateway responds with a protocol version
+// other than the one requested: typically version 2 from a PCP-only gateway
+// in reply to NAT-PMP v0, or version 0 from a NAT-PMP-only gateway in reply
+// to PCP. It matches UnsupportedVersion using errors.Is.
+type VersionErr struct {
+	Version int
+	// Want is the version which was requested, 0 for NAT-PMP.
+	Want int
+}
+
+func (e *VersionErr) Is(err error) bool { return err == UnsupportedVersion }
+
+func (e *VersionErr) Error() string {
+	switch {
+	case e.Want == pcpVersion && e.Version == 0:
+		return fmt.Sprintf("unknown protocol version %d: gateway only supports NAT-PMP v0, not PCP", e.Version)
+	case e.Want == pcpVersion:
+		return fmt.Sprintf("unknown protocol version %d: gateway does not support PCP", e.Version)
+	case e.Version == pcpVersion:
+		return fmt.Sprintf("unknown protocol version %d: gateway only supports PCP, not NAT-PMP v0", e.Version)
+	}
+	return fmt.Sprintf("unknown protocol version %d: gateway does not support NAT-PMP v0", e.Version)
+}
+
+// pcpVersion is the version used by the Port Control Protocol (RFC 6887),
+// the successor to NAT-PMP.
+const pcpVersion = 2
+
+// OpcodeErr is returned when the opcode of the response does not match the request.
+type OpcodeErr struct {
+	Got, Want byte
+}
+
+func (e *OpcodeErr) Error() string {
+	return fmt.Sprintf("unexpected opcode 0x%X (not 0x%X)", e.Got, e.Want)
+}
+
+// SizeErr is returned when the response is not the size expected for the request.
+type SizeErr struct {
+	Got, Want int
+}
+
+func (e *SizeErr) Error() string {
+	return fmt.Sprintf("unexpected result size %d, expected %d", e.Got, e.Want)
 }
@@ -0,0 +1,60 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	t1 := f.NewTimer(time.Second)
+	t2 := f.NewTimer(3 * time.Second)
+	t3 := f.NewTimer(2 * time.Second)
+	if !t3.Stop() {
+		t.Errorf("Stop() of pending timer returned false")
+	}
+	if got := f.Timers(); got != 2 {
+		t.Errorf("Timers()=%d != 2", got)
+	}
+
+	f.Advance(1500 * time.Millisecond)
+	if got := f.Now(); !got.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Errorf("Now()=%v", got)
+	}
+	select {
+	case when := <-t1.C():
+		if !when.Equal(start.Add(time.Second)) {
+			t.Errorf("t1 fired at %v", when)
+		}
+	default:
+		t.Errorf("t1 did not fire")
+	}
+	select {
+	case <-t2.C():
+		t.Errorf("t2 fired early")
+	default:
+	}
+
+	if !t2.Reset(time.Second) {
+		t.Errorf("Reset() of pending timer returned false")
+	}
+	f.AdvanceTo(start)
+	if got := f.Now(); !got.Equal(start.Add(1500 * time.Millisecond)) {
+		t.Errorf("clock moved backwards to %v", got)
+	}
+	f.Advance(time.Second)
+	select {
+	case <-t2.C():
+	default:
+		t.Errorf("t2 did not fire after Reset")
+	}
+	select {
+	case <-t3.C():
+		t.Errorf("stopped timer fired")
+	default:
+	}
+	if got := f.Timers(); got != 0 {
+		t.Errorf("Timers()=%d != 0", got)
+	}
+}
@@ -0,0 +1,23 @@
+// Package clocktest provides helpers for tests driven by a clock.Fake.
+package clocktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+)
+
+// WaitTimers waits until n timers are pending on the fake clock, which is
+// how a test knows the goroutines under test are blocked on it. It fails
+// the test after 5 seconds.
+func WaitTimers(t testing.TB, fake *clock.Fake, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.Timers() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiting for %d timers, have %d", n, fake.Timers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
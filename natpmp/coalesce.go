@@ -0,0 +1,81 @@
+package natpmp
+
+import (
+	"sync"
+
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+// flightKey is a NAT-PMP request, as a comparable value so that looking it
+// up does not allocate.
+type flightKey struct {
+	n   int
+	req [wire.MappingRequestSize]byte
+}
+
+// flight is a request on its way to the gateway, whose response is shared
+// by the callers which sent the same request meanwhile. Flights are pooled
+// so that an exchange does not allocate.
+type flight struct {
+	wg sync.WaitGroup
+	// refs counts the callers using the flight, guarded by flightsMu.
+	refs   int
+	n      int
+	result [wire.MappingResponseSize]byte
+	info   rpcInfo
+	err    error
+}
+
+var flightPool = sync.Pool{New: func() any { return new(flight) }}
+
+// coalesced sends the request with send, unless the same request is
+// already in flight, in which case it waits for that response and copies
+// it into resp.
+func (c *Client) coalesced(req, resp []byte, send func() ([]byte, rpcInfo, error)) ([]byte, rpcInfo, error) {
+	if len(req) > wire.MappingRequestSize {
+		return send()
+	}
+	key := flightKey{n: len(req)}
+	copy(key.req[:], req)
+	c.flightsMu.Lock()
+	if f, ok := c.flights[key]; ok {
+		f.refs++
+		c.flightsMu.Unlock()
+		f.wg.Wait()
+		defer c.releaseFlight(f)
+		if f.err != nil {
+			return nil, f.info, f.err
+		}
+		return resp[:copy(resp, f.result[:f.n])], f.info, nil
+	}
+	f := flightPool.Get().(*flight)
+	f.refs = 1
+	f.wg.Add(1)
+	if c.flights == nil {
+		c.flights = make(map[flightKey]*flight)
+	}
+	c.flights[key] = f
+	c.flightsMu.Unlock()
+
+	result, info, err := send()
+	f.n = copy(f.result[:], result)
+	f.info, f.err = info, err
+	c.flightsMu.Lock()
+	delete(c.flights, key)
+	c.flightsMu.Unlock()
+	f.wg.Done()
+	c.releaseFlight(f)
+	return result, info, err
+}
+
+// releaseFlight returns the flight to the pool once no caller is using it.
+func (c *Client) releaseFlight(f *flight) {
+	c.flightsMu.Lock()
+	f.refs--
+	done := f.refs == 0
+	c.flightsMu.Unlock()
+	if done {
+		f.n, f.info, f.err = 0, rpcInfo{}, nil
+		flightPool.Put(f)
+	}
+}
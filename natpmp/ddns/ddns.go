@@ -0,0 +1,341 @@
+// Package ddns publishes the gateway's external address in DNS with
+// RFC 2136 dynamic updates, signed with TSIG (RFC 8945). It replaces the A
+// (or AAAA) record for a name, and optionally SRV records for mapped ports,
+// whenever the external address changes.
+//
+// Usage:
+//
+//	u := ddns.NewUpdater("ns1.example.com:53", "example.com", "home.example.com",
+//		ddns.WithTSIG(ddns.TSIGKey{Name: "home-key", Secret: secret}))
+//	events := natpmp.WatchExternalAddress(ctx, client, 5*time.Minute)
+//	err := u.Run(ctx, events, nil)
+package ddns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+)
+
+// RcodeErr is the response code of a failed update (RFC 2136 section 2.2).
+type RcodeErr int
+
+const (
+	FormErr  RcodeErr = 1
+	ServFail RcodeErr = 2
+	NXDomain RcodeErr = 3
+	NotImp   RcodeErr = 4
+	Refused  RcodeErr = 5
+	YXDomain RcodeErr = 6
+	YXRRSet  RcodeErr = 7
+	NXRRSet  RcodeErr = 8
+	NotAuth  RcodeErr = 9
+	NotZone  RcodeErr = 10
+)
+
+func (e RcodeErr) Error() string {
+	names := map[RcodeErr]string{
+		FormErr: "FORMERR", ServFail: "SERVFAIL", NXDomain: "NXDOMAIN", NotImp: "NOTIMP",
+		Refused: "REFUSED", YXDomain: "YXDOMAIN", YXRRSet: "YXRRSET", NXRRSet: "NXRRSET",
+		NotAuth: "NOTAUTH", NotZone: "NOTZONE",
+	}
+	if name, ok := names[e]; ok {
+		return "DNS update failed: " + name
+	}
+	return fmt.Sprintf("DNS update failed: rcode %d", int(e))
+}
+
+// SRV is an SRV record published for a mapped port, with the Updater's
+// name as its target.
+type SRV struct {
+	// Service is the service and protocol labels, such as "_http._tcp".
+	Service  string
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+}
+
+// MappingSRV returns an SRV record for the external port of the mapping.
+func MappingSRV(service string, m *natpmp.PortMapping) SRV {
+	return SRV{Service: service, Port: m.MappedExternalPort}
+}
+
+const (
+	defaultTTL           = 60 * time.Second
+	defaultTimeout       = 5 * time.Second
+	defaultRetryInterval = time.Minute
+	maxMessageSize       = 4096
+)
+
+// Option is the type for configuring the Updater.
+type Option func(*Updater)
+
+// TTL returns an option which sets the TTL of the published records. The
+// default is 60 seconds, so a change is seen quickly.
+func TTL(ttl time.Duration) Option {
+	return func(u *Updater) {
+		u.ttl = ttl
+	}
+}
+
+// WithTSIG returns an option which signs updates with the key and checks
+// the signature on responses. Servers accepting updates from the Internet
+// should require it.
+func WithTSIG(key TSIGKey) Option {
+	return func(u *Updater) {
+		u.key = &key
+	}
+}
+
+// WithSRV returns an option which publishes the SRV records with each
+// update.
+func WithSRV(records ...SRV) Option {
+	return func(u *Updater) {
+		u.srv = append([]SRV(nil), records...)
+	}
+}
+
+// Timeout returns an option which sets how long to wait for the server to
+// answer an update.
+func Timeout(timeout time.Duration) Option {
+	return func(u *Updater) {
+		if timeout > 0 {
+			u.timeout = timeout
+		}
+	}
+}
+
+// RetryInterval returns an option which sets how long Run waits before
+// retrying a failed update.
+func RetryInterval(d time.Duration) Option {
+	return func(u *Updater) {
+		if d > 0 {
+			u.retryInterval = d
+		}
+	}
+}
+
+// WithClock returns an option which uses the specified Clock for
+// signatures and retries. Primarily for testing with a clock.Fake.
+func WithClock(c clock.Clock) Option {
+	return func(u *Updater) {
+		u.clock = c
+	}
+}
+
+// Updater publishes an address in DNS. It is safe for concurrent use.
+type Updater struct {
+	server        string
+	zone          string
+	name          string
+	ttl           time.Duration
+	key           *TSIGKey
+	timeout       time.Duration
+	retryInterval time.Duration
+	clock         clock.Clock
+
+	mu  sync.Mutex
+	srv []SRV
+}
+
+// NewUpdater returns an Updater which sends updates for the name, in the
+// zone, to the DNS server at server (host:port).
+func NewUpdater(server, zone, name string, opts ...Option) *Updater {
+	u := &Updater{
+		server:        server,
+		zone:          fqdn(zone),
+		name:          fqdn(name),
+		ttl:           defaultTTL,
+		timeout:       defaultTimeout,
+		retryInterval: defaultRetryInterval,
+		clock:         clock.Real(),
+	}
+	for _, opt := range opts {
+		opt(u)
+	}
+	return u
+}
+
+// SetSRV replaces the SRV records published with the next update, such as
+// after a mapping is granted a different external port.
+func (u *Updater) SetSRV(records ...SRV) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.srv = append([]SRV(nil), records...)
+}
+
+// Update replaces the name's address records with addr, an A record for an
+// IPv4 address or AAAA for IPv6, and its SRV records with those set.
+func (u *Updater) Update(ctx context.Context, addr netip.Addr) error {
+	msg, err := u.message(addr)
+	if err != nil {
+		return err
+	}
+	if err := u.exchange(ctx, msg); err != nil {
+		return fmt.Errorf("DNS update of %s to %s: %w", u.name, addr, err)
+	}
+	return nil
+}
+
+// Run updates the address from the events until ctx is done or events is
+// closed, retrying a failed update after the retry interval. Lost
+// addresses leave the records in place. updated, if not nil, is called
+// with the result of each update.
+func (u *Updater) Run(ctx context.Context, events <-chan natpmp.AddressEvent, updated func(addr netip.Addr, err error)) error {
+	var pending netip.Addr
+	// retry runs only after a failed update.
+	retry := u.clock.NewTimer(u.retryInterval)
+	retry.Stop()
+	defer retry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if e.Kind == natpmp.AddressLost || !e.Addr.IsValid() {
+				continue
+			}
+			pending = e.Addr
+		case <-retry.C():
+		}
+		err := u.Update(ctx, pending)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if updated != nil {
+			updated(pending, err)
+		}
+		retry.Stop()
+		if err != nil {
+			retry.Reset(u.retryInterval)
+		}
+	}
+}
+
+// message returns the UPDATE message for the address, signed if there is
+// a key.
+func (u *Updater) message(addr netip.Addr) ([]byte, error) {
+	rrType, data := uint16(typeA), addr.Unmap().AsSlice()
+	if addr.Unmap().Is6() {
+		rrType = typeAAAA
+	}
+	ttl := uint32(u.ttl / time.Second)
+	// Delete the RRset, then add the new record (RFC 2136 section 2.5).
+	updates := []rr{
+		{Name: u.name, Type: rrType, Class: classANY},
+		{Name: u.name, Type: rrType, Class: classIN, TTL: ttl, Data: data},
+	}
+	u.mu.Lock()
+	srv := u.srv
+	u.mu.Unlock()
+	deleted := make(map[string]bool)
+	for _, s := range srv {
+		owner := fqdn(s.Service) + u.name
+		if !deleted[owner] {
+			updates = append(updates, rr{Name: owner, Type: typeSRV, Class: classANY})
+			deleted[owner] = true
+		}
+		data := binary.BigEndian.AppendUint16(nil, s.Priority)
+		data = binary.BigEndian.AppendUint16(data, s.Weight)
+		data = binary.BigEndian.AppendUint16(data, s.Port)
+		data, err := appendName(data, u.name)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, rr{Name: owner, Type: typeSRV, Class: classIN, TTL: ttl, Data: data})
+	}
+
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	h := header{
+		ID:     binary.BigEndian.Uint16(id[:]),
+		Flags:  opcodeUpdate << 11,
+		Counts: [4]uint16{1, 0, uint16(len(updates)), 0},
+	}
+	msg, _ := h.AppendBinary(make([]byte, 0, 512))
+	msg, err := appendName(msg, u.zone)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, typeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, classIN)
+	for _, r := range updates {
+		if msg, err = r.AppendBinary(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// exchange signs and sends the message over UDP and checks the response.
+func (u *Updater) exchange(ctx context.Context, msg []byte) error {
+	id := binary.BigEndian.Uint16(msg)
+	var requestMAC []byte
+	if u.key != nil {
+		var err error
+		if msg, requestMAC, err = u.key.sign(msg, nil, u.clock.Now(), 0); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		var resp message
+		if err := resp.UnmarshalBinary(buf[:n]); err != nil || resp.ID != id || resp.Flags&flagQR == 0 {
+			// Not a response to this update.
+			continue
+		}
+		if resp.opcode() != opcodeUpdate {
+			return fmt.Errorf("response has opcode %d, expected UPDATE", resp.opcode())
+		}
+		if u.key != nil {
+			if _, err := u.key.verify(buf[:n], &resp, requestMAC, u.clock.Now()); err != nil {
+				// An unsigned error response means the server could not
+				// check the request's signature.
+				if errors.Is(err, errUnsigned) && resp.rcode() != 0 {
+					return RcodeErr(resp.rcode())
+				}
+				return err
+			}
+		}
+		if resp.rcode() != 0 {
+			return RcodeErr(resp.rcode())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,311 @@
+package ddns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/clock/clocktest"
+)
+
+var testKey = TSIGKey{Name: "home-key.", Secret: []byte("0123456789abcdef0123456789abcdef")}
+
+// dnsServer is an in-process authoritative server for one zone which
+// applies RFC 2136 updates.
+type dnsServer struct {
+	conn *net.UDPConn
+	zone string
+	// key, when set, is required on updates.
+	key *TSIGKey
+	// rcode, when non-zero, refuses updates with this response code.
+	rcode RcodeErr
+
+	mu      sync.Mutex
+	records map[string][]rr
+}
+
+func newDNSServer(t *testing.T, s *dnsServer) *dnsServer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to start UDP listener: %v", err)
+	}
+	s.conn = conn
+	s.records = make(map[string][]rr)
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *dnsServer) addr() string { return s.conn.LocalAddr().String() }
+
+func recordKey(name string, rrType uint16) string {
+	return fmt.Sprintf("%s/%d", strings.ToLower(fqdn(name)), rrType)
+}
+
+// lookup returns the data of the name's records of the type.
+func (s *dnsServer) lookup(name string, rrType uint16) [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data [][]byte
+	for _, r := range s.records[recordKey(name, rrType)] {
+		data = append(data, r.Data)
+	}
+	return data
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.handle(buf[:n]); resp != nil {
+			s.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (s *dnsServer) handle(req []byte) []byte {
+	var m message
+	if err := m.UnmarshalBinary(req); err != nil || m.opcode() != opcodeUpdate {
+		return nil
+	}
+	// respond signs the response unless requestMAC is nil and tsigErr is 0,
+	// for a request which was not signed.
+	respond := func(rcode RcodeErr, requestMAC []byte, tsigErr uint16) []byte {
+		h := header{ID: m.ID, Flags: flagQR | opcodeUpdate<<11 | uint16(rcode), Counts: [4]uint16{1, 0, 0, 0}}
+		b, _ := h.AppendBinary(nil)
+		b, _ = appendName(b, m.Questions[0].Name)
+		b = binary.BigEndian.AppendUint16(b, typeSOA)
+		b = binary.BigEndian.AppendUint16(b, classIN)
+		if s.key != nil && (requestMAC != nil || tsigErr != 0) {
+			b, _, _ = s.key.sign(b, requestMAC, time.Now(), tsigErr)
+		}
+		return b
+	}
+	if len(m.Questions) != 1 {
+		return nil
+	}
+	var requestMAC []byte
+	if s.key != nil {
+		mac, err := s.key.verify(req, &m, nil, time.Now())
+		var tsigErr TSIGErr
+		switch {
+		case errors.As(err, &tsigErr):
+			return respond(NotAuth, nil, uint16(tsigErr))
+		case err != nil:
+			return respond(NotAuth, nil, 0)
+		}
+		requestMAC = mac
+	}
+	if !strings.EqualFold(m.Questions[0].Name, s.zone) {
+		return respond(NotZone, requestMAC, 0)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rcode != 0 {
+		return respond(s.rcode, requestMAC, 0)
+	}
+	for _, r := range m.Sections[1] {
+		key := recordKey(r.Name, r.Type)
+		switch r.Class {
+		case classANY:
+			delete(s.records, key)
+		case classIN:
+			r.Data = append([]byte(nil), r.Data...)
+			s.records[key] = append(s.records[key], r)
+		}
+	}
+	return respond(0, requestMAC, 0)
+}
+
+func TestUpdate(t *testing.T) {
+	s := newDNSServer(t, &dnsServer{zone: "example.com.", key: &testKey})
+	u := NewUpdater(s.addr(), "example.com", "home.example.com", WithTSIG(testKey),
+		WithSRV(SRV{Service: "_http._tcp", Port: 8080}, SRV{Service: "_http._tcp", Port: 8081, Priority: 10}))
+
+	if err := u.Update(context.Background(), netip.MustParseAddr("203.0.113.1")); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	u.SetSRV(MappingSRV("_http._tcp", &natpmp.PortMapping{MappedExternalPort: 9090}))
+	if err := u.Update(context.Background(), netip.MustParseAddr("203.0.113.2")); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	if err := u.Update(context.Background(), netip.MustParseAddr("2001:db8::1")); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+
+	if got := s.lookup("home.example.com", typeA); len(got) != 1 || netip.AddrFrom4([4]byte(got[0])) != netip.MustParseAddr("203.0.113.2") {
+		t.Errorf("A records=%v, want 203.0.113.2", got)
+	}
+	if got := s.lookup("home.example.com", typeAAAA); len(got) != 1 || netip.AddrFrom16([16]byte(got[0])) != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("AAAA records=%v, want 2001:db8::1", got)
+	}
+	srv := s.lookup("_http._tcp.home.example.com", typeSRV)
+	if len(srv) != 1 {
+		t.Fatalf("got %d SRV records, want 1", len(srv))
+	}
+	target, _, err := readName(srv[0], 6)
+	if port := binary.BigEndian.Uint16(srv[0][4:]); port != 9090 || err != nil || target != "home.example.com." {
+		t.Errorf("SRV record port=%d target=%q err=%v", port, target, err)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	wrongKey := testKey
+	wrongKey.Secret = []byte("not the secret")
+	testCases := []struct {
+		name    string
+		server  *dnsServer
+		zone    string
+		key     *TSIGKey
+		wantErr error
+	}{
+		{
+			name:    "refused",
+			server:  &dnsServer{zone: "example.com.", rcode: Refused},
+			zone:    "example.com",
+			wantErr: Refused,
+		},
+		{
+			name:    "not zone",
+			server:  &dnsServer{zone: "example.com."},
+			zone:    "example.org",
+			wantErr: NotZone,
+		},
+		{
+			name:    "bad signature",
+			server:  &dnsServer{zone: "example.com.", key: &testKey},
+			zone:    "example.com",
+			key:     &wrongKey,
+			wantErr: BadSig,
+		},
+		{
+			name:    "unsigned",
+			server:  &dnsServer{zone: "example.com.", key: &testKey},
+			zone:    "example.com",
+			wantErr: NotAuth,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newDNSServer(t, tc.server)
+			opts := []Option{Timeout(2 * time.Second)}
+			if tc.key != nil {
+				opts = append(opts, WithTSIG(*tc.key))
+			}
+			u := NewUpdater(s.addr(), tc.zone, "home."+tc.zone, opts...)
+			err := u.Update(context.Background(), netip.MustParseAddr("203.0.113.1"))
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Update() err=%v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := newDNSServer(t, &dnsServer{zone: "example.com.", key: &testKey})
+	u := NewUpdater(s.addr(), "example.com", "home.example.com", WithTSIG(testKey))
+
+	events := make(chan natpmp.AddressEvent)
+	var updated []netip.Addr
+	done := make(chan error)
+	go func() {
+		done <- u.Run(context.Background(), events, func(addr netip.Addr, err error) {
+			if err != nil {
+				t.Errorf("update of %s failed: %v", addr, err)
+			}
+			updated = append(updated, addr)
+		})
+	}()
+	a := netip.MustParseAddr("203.0.113.1")
+	b := netip.MustParseAddr("203.0.113.2")
+	events <- natpmp.AddressEvent{Kind: natpmp.AddressGained, Addr: a}
+	events <- natpmp.AddressEvent{Kind: natpmp.AddressLost, Previous: a}
+	events <- natpmp.AddressEvent{Kind: natpmp.AddressGained, Addr: b}
+	close(events)
+	if err := <-done; err != nil {
+		t.Fatalf("Run() returned %v", err)
+	}
+	if len(updated) != 2 || updated[0] != a || updated[1] != b {
+		t.Errorf("updated %v, want [%s %s]", updated, a, b)
+	}
+	if got := s.lookup("home.example.com", typeA); len(got) != 1 || netip.AddrFrom4([4]byte(got[0])) != b {
+		t.Errorf("A records=%v, want %s", got, b)
+	}
+}
+
+func TestRunRetry(t *testing.T) {
+	s := newDNSServer(t, &dnsServer{zone: "example.com.", rcode: ServFail})
+	fake := clock.NewFake(time.Now())
+	u := NewUpdater(s.addr(), "example.com", "home.example.com", WithClock(fake), RetryInterval(time.Minute))
+
+	events := make(chan natpmp.AddressEvent)
+	results := make(chan error)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go u.Run(ctx, events, func(addr netip.Addr, err error) { results <- err })
+	a := netip.MustParseAddr("203.0.113.1")
+	events <- natpmp.AddressEvent{Kind: natpmp.AddressGained, Addr: a}
+	if err := <-results; !errors.Is(err, ServFail) {
+		t.Fatalf("first update err=%v, want ServFail", err)
+	}
+
+	s.mu.Lock()
+	s.rcode = 0
+	s.mu.Unlock()
+	// The retry waits for the clock.
+	clocktest.WaitTimers(t, fake, 1)
+	fake.Advance(time.Minute)
+	if err := <-results; err != nil {
+		t.Fatalf("retried update failed: %v", err)
+	}
+	if got := s.lookup("home.example.com", typeA); len(got) != 1 || netip.AddrFrom4([4]byte(got[0])) != a {
+		t.Errorf("A records=%v, want %s", got, a)
+	}
+}
+
+func TestReadName(t *testing.T) {
+	// "a.example." at 0, then "b" with a pointer to "example." at 2.
+	msg := []byte{1, 'a', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 1, 'b', 0xc0, 2}
+	testCases := []struct {
+		name    string
+		off     int
+		want    string
+		wantEnd int
+		wantErr bool
+	}{
+		{name: "uncompressed", off: 0, want: "a.example.", wantEnd: 11},
+		{name: "compressed", off: 11, want: "b.example.", wantEnd: 15},
+		{name: "truncated", off: 13, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := msg
+			if tc.wantErr {
+				b = msg[:14]
+			}
+			got, end, err := readName(b, tc.off)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("readName()=%q, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tc.want || end != tc.wantEnd {
+				t.Errorf("readName()=%q, %d, %v; want %q, %d", got, end, err, tc.want, tc.wantEnd)
+			}
+		})
+	}
+}
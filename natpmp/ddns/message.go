@@ -0,0 +1,219 @@
+package ddns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DNS constants used by UPDATE messages (RFC 1035, RFC 2136).
+const (
+	typeA    = 1
+	typeSOA  = 6
+	typeAAAA = 28
+	typeSRV  = 33
+	typeTSIG = 250
+
+	classIN  = 1
+	classANY = 255
+
+	opcodeUpdate = 5
+
+	headerSize = 12
+	flagQR     = 1 << 15
+)
+
+var errShortMessage = errors.New("short DNS message")
+
+// header is the DNS message header. For UPDATE the four counts are the
+// zone, prerequisite, update and additional sections.
+type header struct {
+	ID     uint16
+	Flags  uint16
+	Counts [4]uint16
+}
+
+func (h header) opcode() int { return int(h.Flags>>11) & 0xf }
+func (h header) rcode() int  { return int(h.Flags & 0xf) }
+
+func (h header) AppendBinary(b []byte) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, h.ID)
+	b = binary.BigEndian.AppendUint16(b, h.Flags)
+	for _, c := range h.Counts {
+		b = binary.BigEndian.AppendUint16(b, c)
+	}
+	return b, nil
+}
+
+func (h *header) UnmarshalBinary(b []byte) error {
+	if len(b) < headerSize {
+		return errShortMessage
+	}
+	h.ID = binary.BigEndian.Uint16(b)
+	h.Flags = binary.BigEndian.Uint16(b[2:])
+	for i := range h.Counts {
+		h.Counts[i] = binary.BigEndian.Uint16(b[4+2*i:])
+	}
+	return nil
+}
+
+// question is an entry in the question section, which UPDATE uses for the
+// zone.
+type question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// rr is a resource record.
+type rr struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+func (r rr) AppendBinary(b []byte) ([]byte, error) {
+	b, err := appendName(b, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, r.Type)
+	b = binary.BigEndian.AppendUint16(b, r.Class)
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+	return append(b, r.Data...), nil
+}
+
+// message is a parsed DNS message.
+type message struct {
+	header
+	Questions []question
+	// Sections holds the answer, authority and additional records, which
+	// for UPDATE are the prerequisite, update and additional sections.
+	Sections [3][]rr
+	// lastRR is the offset of the last additional record, where a TSIG
+	// record starts.
+	lastRR int
+}
+
+func (m *message) UnmarshalBinary(b []byte) error {
+	if err := m.header.UnmarshalBinary(b); err != nil {
+		return err
+	}
+	off := headerSize
+	for range m.Counts[0] {
+		var q question
+		var err error
+		if q.Name, off, err = readName(b, off); err != nil {
+			return err
+		}
+		if len(b) < off+4 {
+			return errShortMessage
+		}
+		q.Type = binary.BigEndian.Uint16(b[off:])
+		q.Class = binary.BigEndian.Uint16(b[off+2:])
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+	for i := range m.Sections {
+		for range m.Counts[i+1] {
+			m.lastRR = off
+			var r rr
+			var err error
+			if r.Name, off, err = readName(b, off); err != nil {
+				return err
+			}
+			if len(b) < off+10 {
+				return errShortMessage
+			}
+			r.Type = binary.BigEndian.Uint16(b[off:])
+			r.Class = binary.BigEndian.Uint16(b[off+2:])
+			r.TTL = binary.BigEndian.Uint32(b[off+4:])
+			n := int(binary.BigEndian.Uint16(b[off+8:]))
+			off += 10
+			if len(b) < off+n {
+				return errShortMessage
+			}
+			r.Data = b[off : off+n]
+			off += n
+			m.Sections[i] = append(m.Sections[i], r)
+		}
+	}
+	if off != len(b) {
+		return fmt.Errorf("%d bytes after DNS message", len(b)-off)
+	}
+	return nil
+}
+
+// fqdn returns the name with a trailing dot.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// appendName appends the name in uncompressed wire format.
+func appendName(b []byte, name string) ([]byte, error) {
+	name = fqdn(name)
+	if name == "." {
+		return append(b, 0), nil
+	}
+	if len(name) > 254 {
+		return nil, fmt.Errorf("name %q is too long", name)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("name %q has a label of length %d", name, len(label))
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+// readName reads the possibly compressed name at off, returning it and the
+// offset after it.
+func readName(b []byte, off int) (string, int, error) {
+	var name strings.Builder
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errShortMessage
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			if name.Len() == 0 {
+				return ".", end, nil
+			}
+			return name.String(), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errShortMessage
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case n > 63:
+			return "", 0, fmt.Errorf("bad DNS label length %d", n)
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errShortMessage
+			}
+			name.Write(b[off+1 : off+1+n])
+			name.WriteByte('.')
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package ddns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// TSIG algorithms (RFC 8945 section 6).
+const (
+	HMACSHA256 = "hmac-sha256."
+	HMACSHA512 = "hmac-sha512."
+)
+
+// fudge is the permitted clock skew between client and server.
+const fudge = 300
+
+// TSIGKey is a shared secret for signing updates (RFC 8945).
+type TSIGKey struct {
+	// Name is the key's name, as configured on the server.
+	Name string
+	// Algorithm is HMACSHA256 (the default if empty) or HMACSHA512.
+	Algorithm string
+	Secret    []byte
+}
+
+func (k *TSIGKey) algorithm() string {
+	if k.Algorithm == "" {
+		return HMACSHA256
+	}
+	return strings.ToLower(fqdn(k.Algorithm))
+}
+
+func (k *TSIGKey) hash() (func() hash.Hash, error) {
+	switch k.algorithm() {
+	case HMACSHA256:
+		return sha256.New, nil
+	case HMACSHA512:
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported TSIG algorithm %q", k.Algorithm)
+}
+
+// tsig holds the fields of a TSIG record's data.
+type tsig struct {
+	Algorithm  string
+	TimeSigned uint64
+	Fudge      uint16
+	MAC        []byte
+	OriginalID uint16
+	Error      uint16
+	Other      []byte
+}
+
+func (t *tsig) AppendBinary(b []byte) ([]byte, error) {
+	b, err := appendName(b, t.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	b = appendUint48(b, t.TimeSigned)
+	b = binary.BigEndian.AppendUint16(b, t.Fudge)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.MAC)))
+	b = append(b, t.MAC...)
+	b = binary.BigEndian.AppendUint16(b, t.OriginalID)
+	b = binary.BigEndian.AppendUint16(b, t.Error)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(t.Other)))
+	return append(b, t.Other...), nil
+}
+
+func (t *tsig) UnmarshalBinary(b []byte) error {
+	var off int
+	var err error
+	if t.Algorithm, off, err = readName(b, 0); err != nil {
+		return err
+	}
+	if len(b) < off+10 {
+		return errShortMessage
+	}
+	t.TimeSigned = uint64(binary.BigEndian.Uint16(b[off:]))<<32 | uint64(binary.BigEndian.Uint32(b[off+2:]))
+	t.Fudge = binary.BigEndian.Uint16(b[off+6:])
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	off += 10
+	if len(b) < off+n+6 {
+		return errShortMessage
+	}
+	t.MAC = b[off : off+n]
+	off += n
+	t.OriginalID = binary.BigEndian.Uint16(b[off:])
+	t.Error = binary.BigEndian.Uint16(b[off+2:])
+	n = int(binary.BigEndian.Uint16(b[off+4:]))
+	off += 6
+	if len(b) != off+n {
+		return errShortMessage
+	}
+	t.Other = b[off:]
+	return nil
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(v>>32))
+	return binary.BigEndian.AppendUint32(b, uint32(v))
+}
+
+// mac returns the MAC of the message (without its TSIG record) and the
+// TSIG variables. A response's MAC also covers the request's MAC.
+func (k *TSIGKey) mac(requestMAC, msg []byte, t *tsig) ([]byte, error) {
+	h, err := k.hash()
+	if err != nil {
+		return nil, err
+	}
+	m := hmac.New(h, k.Secret)
+	if requestMAC != nil {
+		m.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		m.Write(requestMAC)
+	}
+	m.Write(msg)
+	vars, err := appendName(nil, strings.ToLower(k.Name))
+	if err != nil {
+		return nil, err
+	}
+	vars = binary.BigEndian.AppendUint16(vars, classANY)
+	vars = binary.BigEndian.AppendUint32(vars, 0)
+	if vars, err = appendName(vars, k.algorithm()); err != nil {
+		return nil, err
+	}
+	vars = appendUint48(vars, t.TimeSigned)
+	vars = binary.BigEndian.AppendUint16(vars, t.Fudge)
+	vars = binary.BigEndian.AppendUint16(vars, t.Error)
+	vars = binary.BigEndian.AppendUint16(vars, uint16(len(t.Other)))
+	vars = append(vars, t.Other...)
+	m.Write(vars)
+	return m.Sum(nil), nil
+}
+
+// sign appends a TSIG record to the message, incrementing its additional
+// count, and returns the signed message and its MAC. requestMAC is nil
+// when signing a request.
+func (k *TSIGKey) sign(msg, requestMAC []byte, now time.Time, tsigErr uint16) ([]byte, []byte, error) {
+	if len(msg) < headerSize {
+		return nil, nil, errShortMessage
+	}
+	t := tsig{
+		Algorithm:  k.algorithm(),
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      fudge,
+		OriginalID: binary.BigEndian.Uint16(msg),
+		Error:      tsigErr,
+	}
+	mac, err := k.mac(requestMAC, msg, &t)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.MAC = mac
+	data, err := t.AppendBinary(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed, err := rr{Name: k.Name, Type: typeTSIG, Class: classANY, Data: data}.AppendBinary(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+	return signed, mac, nil
+}
+
+// TSIGErr is a TSIG error code (RFC 8945 section 5.3).
+type TSIGErr uint16
+
+const (
+	BadSig  TSIGErr = 16
+	BadKey  TSIGErr = 17
+	BadTime TSIGErr = 18
+)
+
+func (e TSIGErr) Error() string {
+	switch e {
+	case BadSig:
+		return "TSIG error BADSIG"
+	case BadKey:
+		return "TSIG error BADKEY"
+	case BadTime:
+		return "TSIG error BADTIME"
+	}
+	return fmt.Sprintf("TSIG error %d", uint16(e))
+}
+
+// errUnsigned is returned by verify for a message without a TSIG record.
+var errUnsigned = errors.New("DNS message is not signed")
+
+// verify checks the TSIG record which ends the parsed message raw, and
+// returns its MAC.
+func (k *TSIGKey) verify(raw []byte, m *message, requestMAC []byte, now time.Time) ([]byte, error) {
+	additional := m.Sections[2]
+	if len(additional) == 0 || additional[len(additional)-1].Type != typeTSIG {
+		return nil, errUnsigned
+	}
+	r := additional[len(additional)-1]
+	var t tsig
+	if err := t.UnmarshalBinary(r.Data); err != nil {
+		return nil, fmt.Errorf("bad TSIG record: %w", err)
+	}
+	if !strings.EqualFold(fqdn(r.Name), fqdn(k.Name)) || !strings.EqualFold(t.Algorithm, k.algorithm()) {
+		return nil, BadKey
+	}
+	if t.Error != 0 {
+		return nil, TSIGErr(t.Error)
+	}
+	unsigned := append([]byte(nil), raw[:m.lastRR]...)
+	binary.BigEndian.PutUint16(unsigned, t.OriginalID)
+	binary.BigEndian.PutUint16(unsigned[10:], m.Counts[3]-1)
+	want, err := k.mac(requestMAC, unsigned, &t)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(t.MAC, want) {
+		return nil, BadSig
+	}
+	if skew := now.Unix() - int64(t.TimeSigned); skew > int64(t.Fudge) || -skew > int64(t.Fudge) {
+		return nil, BadTime
+	}
+	return t.MAC, nil
+}
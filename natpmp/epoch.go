@@ -0,0 +1,20 @@
+package natpmp
+
+import "time"
+
+// epochRegressed reports whether the gateway's epoch has gone backwards
+// since it was last observed, meaning the gateway rebooted or lost its
+// mappings (RFC 6886 section 3.6). prev is the epoch observed at
+// prevObserved; the epoch is expected to advance at least 7/8 as fast as
+// the local clock, less two seconds of slack.
+func epochRegressed(prev time.Duration, prevObserved time.Time, epoch time.Duration, now time.Time) bool {
+	if prevObserved.IsZero() {
+		return false
+	}
+	elapsed := now.Sub(prevObserved)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	expected := prev + elapsed*7/8 - 2*time.Second
+	return epoch < expected
+}
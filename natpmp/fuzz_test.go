@@ -0,0 +1,121 @@
+package natpmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+// Seed responses, taken from the tests in client_test.go.
+var (
+	seedExtAddrResps = [][]byte{
+		{},
+		{0x0, 0x80, 0x0, 0x0, 0x0, 0x13, 0xf2, 0x4f, 0x49, 0x8c, 0x36, 0x9a},
+		{0x0, 0x80, 0x0, 0x5, 0x0, 0x0, 0x0, 0x10},
+	}
+	seedMappingResps = [][]byte{
+		{},
+		{0x0},
+		{0x0, 0x81, 0x0, 0x0, 0x0, 0x13, 0xfe, 0xff, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+		{0x0, 0x82, 0x0, 0x0, 0x0, 0x14, 0x3, 0x21, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+		{0x1, 0x82, 0x0, 0x0, 0x0, 0x14, 0x4, 0x96, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+		{0x0, 0x88, 0x0, 0x0, 0x0, 0x14, 0x4, 0x96, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+		{0x0, 0x82, 0x0, 0x11, 0x0, 0x14, 0x4, 0x96, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+	}
+)
+
+func FuzzGetExternalAddress(f *testing.F) {
+	for _, seed := range seedExtAddrResps {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, resp []byte) {
+		c := newFuzzClient([]byte{0x0, 0x0}, resp)
+		addr, _, err := c.GetExternalAddress()
+		checkRPCErr(t, err, resp, wire.ExternalAddressResponseSize, 0x80)
+		if err != nil {
+			return
+		}
+		parsed, perr := wire.ParseResponse(resp)
+		if perr != nil {
+			t.Fatalf("client accepted %v which wire.ParseResponse rejects: %v", resp, perr)
+		}
+		if got := parsed.(*wire.ExternalAddressResponse).Addr(); got != addr {
+			t.Errorf("addr=%v != wire %v", addr, got)
+		}
+	})
+}
+
+func FuzzAddPortMapping(f *testing.F) {
+	for _, seed := range seedMappingResps {
+		f.Add(seed)
+	}
+	req := []byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0}
+	f.Fuzz(func(t *testing.T, resp []byte) {
+		c := newFuzzClient(req, resp)
+		mapping, err := c.AddPortMapping("tcp", 123, 456, 1200*time.Second)
+		checkRPCErr(t, err, resp, wire.MappingResponseSize, 0x82)
+		if err != nil {
+			if mapping != nil {
+				t.Errorf("got mapping %+v with error", mapping)
+			}
+			return
+		}
+		parsed, perr := wire.ParseResponse(resp)
+		if perr != nil {
+			t.Fatalf("client accepted %v which wire.ParseResponse rejects: %v", resp, perr)
+		}
+		m := parsed.(*wire.MappingResponse)
+		if m.InternalPort != mapping.InternalPort || m.MappedExternalPort != mapping.MappedExternalPort {
+			t.Errorf("mapping=%+v != wire %+v", mapping, m)
+		}
+	})
+}
+
+func newFuzzClient(req, resp []byte) *Client {
+	return NewClient(net.ParseIP("10.0.0.1"), WithTransport(&testTransport{
+		testCall: testCall{req: req, resp: resp},
+	}))
+}
+
+// checkRPCErr checks that err is the error expected for the response, so
+// that every malformed response is reported the same way.
+func checkRPCErr(t *testing.T, err error, resp []byte, size int, op byte) {
+	t.Helper()
+	if len(resp) > maxResponseSize {
+		// The transport only reads as much as the largest response.
+		resp = resp[:maxResponseSize]
+	}
+	var (
+		rc     ResultCodeErr
+		sizeE  *SizeErr
+		opE    *OpcodeErr
+		versnE *VersionErr
+	)
+	// The common header is checked before the size, so a short failure
+	// response reports its result code.
+	hasHeader := len(resp) >= headerSize
+	switch {
+	case hasHeader && resp[0] != 0:
+		if !errors.As(err, &versnE) || versnE.Version != int(resp[0]) || !errors.Is(err, UnsupportedVersion) {
+			t.Errorf("%v: err=%v, want VersionErr", resp, err)
+		}
+	case hasHeader && resp[1] != op:
+		if !errors.As(err, &opE) || opE.Got != resp[1] {
+			t.Errorf("%v: err=%v, want OpcodeErr", resp, err)
+		}
+	case hasHeader && binary.BigEndian.Uint16(resp[2:]) != 0:
+		if !errors.As(err, &rc) || int(rc) != int(binary.BigEndian.Uint16(resp[2:])) {
+			t.Errorf("%v: err=%v, want ResultCodeErr", resp, err)
+		}
+	case len(resp) != size:
+		if !errors.As(err, &sizeE) || sizeE.Got != len(resp) || sizeE.Want != size {
+			t.Errorf("%v: err=%v, want SizeErr", resp, err)
+		}
+	case err != nil:
+		t.Errorf("%v: got err: %v", resp, err)
+	}
+}
@@ -0,0 +1,337 @@
+package natpmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const renewRetryInterval = 30 * time.Second
+
+// defaultCloseTimeout is how long Close waits for the gateway to delete
+// the mapping. A mapping which is not deleted expires with its lifetime.
+const defaultCloseTimeout = 5 * time.Second
+
+// ListenOption is the type for configuring the mapping created by
+// Listen and ListenPacket.
+type ListenOption func(*listenConfig)
+
+type listenConfig struct {
+	policy       PortPolicy
+	lifetime     time.Duration
+	closeTimeout time.Duration
+}
+
+// ExternalPort returns a ListenOption which requests a specific external port
+// on the gateway, accepting a different port if the gateway grants one.
+// By default the internal port is requested.
+func ExternalPort(port int) ListenOption {
+	return func(c *listenConfig) {
+		c.policy = AnyPort(port)
+	}
+}
+
+// WithPortPolicy returns a ListenOption which uses the PortPolicy to choose
+// the external port on the gateway.
+func WithPortPolicy(policy PortPolicy) ListenOption {
+	return func(c *listenConfig) {
+		c.policy = policy
+	}
+}
+
+// Lifetime returns a ListenOption which sets the lifetime requested for the
+// mapping, DefaultLifetime if not set. The mapping is renewed when half of
+// the granted lifetime has passed.
+func Lifetime(lifetime time.Duration) ListenOption {
+	return func(c *listenConfig) {
+		if lifetime > 0 {
+			c.lifetime = lifetime
+		}
+	}
+}
+
+// CloseTimeout returns a ListenOption which sets how long Close waits for
+// the gateway to delete the mapping, 5 seconds by default.
+func CloseTimeout(timeout time.Duration) ListenOption {
+	return func(c *listenConfig) {
+		if timeout > 0 {
+			c.closeTimeout = timeout
+		}
+	}
+}
+
+// Listener is a net.Listener whose port is mapped on the NAT-PMP gateway,
+// or has a PCP pinhole opened when the gateway's address is IPv6.
+// The mapping is renewed in the background until the Listener is closed.
+type Listener struct {
+	net.Listener
+	mapping *mappedPort
+}
+
+// Listen announces on the local network address and maps the listening
+// port on the gateway. The network must be "tcp", "tcp4" or "tcp6".
+// The context is only used while the listener and mapping are being
+// created, and cancelling it abandons the requests to the gateway; the
+// mapping is kept alive until Close is called.
+func Listen(ctx context.Context, client *Client, network, address string, opts ...ListenOption) (*Listener, error) {
+	if proto, err := mappingProtocol(network); err != nil || proto != "tcp" {
+		return nil, fmt.Errorf("natpmp.Listen: unsupported network %q", network)
+	}
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMappedPort(ctx, client, "tcp", l.Addr().(*net.TCPAddr).Port, opts)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &Listener{Listener: l, mapping: m}, nil
+}
+
+// ExternalAddr returns the address and port on the gateway which is
+// forwarded to the listener.
+func (l *Listener) ExternalAddr() netip.AddrPort { return l.mapping.externalAddr() }
+
+// RenewErr returns the error from the last renewal of the mapping, or nil
+// if it succeeded. A failed renewal is retried every 30 seconds.
+func (l *Listener) RenewErr() error { return l.mapping.renewErr() }
+
+// Close closes the listener, then deletes the mapping on the gateway,
+// giving up after the CloseTimeout.
+func (l *Listener) Close() error {
+	err := l.Listener.Close()
+	return errors.Join(err, l.mapping.close())
+}
+
+// PacketConn is a net.PacketConn whose port is mapped on the NAT-PMP gateway,
+// or has a PCP pinhole opened when the gateway's address is IPv6.
+// The mapping is renewed in the background until the PacketConn is closed.
+type PacketConn struct {
+	net.PacketConn
+	mapping *mappedPort
+}
+
+// ListenPacket announces on the local network address and maps the port on
+// the gateway. The network must be "udp", "udp4" or "udp6".
+// The context is only used while the connection and mapping are being
+// created, and cancelling it abandons the requests to the gateway; the
+// mapping is kept alive until Close is called.
+func ListenPacket(ctx context.Context, client *Client, network, address string, opts ...ListenOption) (*PacketConn, error) {
+	if proto, err := mappingProtocol(network); err != nil || proto != "udp" {
+		return nil, fmt.Errorf("natpmp.ListenPacket: unsupported network %q", network)
+	}
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMappedPort(ctx, client, "udp", pc.LocalAddr().(*net.UDPAddr).Port, opts)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return &PacketConn{PacketConn: pc, mapping: m}, nil
+}
+
+// ExternalAddr returns the address and port on the gateway which is
+// forwarded to the connection.
+func (c *PacketConn) ExternalAddr() netip.AddrPort { return c.mapping.externalAddr() }
+
+// RenewErr returns the error from the last renewal of the mapping, or nil
+// if it succeeded. A failed renewal is retried every 30 seconds.
+func (c *PacketConn) RenewErr() error { return c.mapping.renewErr() }
+
+// Close closes the connection, then deletes the mapping on the gateway,
+// giving up after the CloseTimeout.
+func (c *PacketConn) Close() error {
+	err := c.PacketConn.Close()
+	return errors.Join(err, c.mapping.close())
+}
+
+func mappingProtocol(network string) (string, error) {
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		return "tcp", nil
+	case strings.HasPrefix(network, "udp"):
+		return "udp", nil
+	}
+	return "", fmt.Errorf("unknown network %q", network)
+}
+
+// mappedPort keeps a single port mapping, or on an IPv6 gateway a PCP
+// pinhole, alive on the gateway.
+type mappedPort struct {
+	client *Client
+	cfg    listenConfig
+	// renewMapping renews the mapping, returning the external address and
+	// the lifetime granted. Cancelling ctx abandons the renewal.
+	renewMapping func(ctx context.Context) (netip.AddrPort, time.Duration, error)
+	// deleteMapping deletes the mapping. Cancelling ctx abandons the
+	// request.
+	deleteMapping func(ctx context.Context) error
+
+	mu       sync.Mutex
+	external netip.AddrPort
+	// err is the error from the last renewal.
+	err error
+
+	// stop cancels the renewals when the mapping is closed.
+	stop      context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMappedPort(ctx context.Context, client *Client, protocol string, internalPort int, opts []ListenOption) (*mappedPort, error) {
+	cfg := listenConfig{
+		lifetime:     DefaultLifetime,
+		closeTimeout: defaultCloseTimeout,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m := &mappedPort{
+		client: client,
+		cfg:    cfg,
+		done:   make(chan struct{}),
+	}
+	var lifetime time.Duration
+	var err error
+	if client.gatewayIP.To4() == nil {
+		lifetime, err = m.addPinhole(ctx, protocol, internalPort)
+	} else {
+		lifetime, err = m.addPortMapping(ctx, protocol, internalPort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	renewCtx, stop := context.WithCancel(context.Background())
+	m.stop = stop
+	go m.renew(renewCtx, m.renewInterval(lifetime))
+	return m, nil
+}
+
+// addPortMapping maps the port with NAT-PMP.
+func (m *mappedPort) addPortMapping(ctx context.Context, protocol string, internalPort int) (time.Duration, error) {
+	extIP, _, err := m.client.externalAddress(ctx)
+	if err != nil {
+		return 0, err
+	}
+	mapping, err := m.client.addPortMappingWithPolicy(ctx, protocol, internalPort, m.cfg.policy, m.cfg.lifetime)
+	if err != nil {
+		return 0, err
+	}
+	m.external = netip.AddrPortFrom(extIP, mapping.MappedExternalPort)
+	m.renewMapping = func(ctx context.Context) (netip.AddrPort, time.Duration, error) {
+		// The gateway's external address may have changed since.
+		extIP, _, err := m.client.externalAddress(ctx)
+		if err != nil {
+			return netip.AddrPort{}, 0, err
+		}
+		// Ask for the port we were given, so the mapping stays the same. A
+		// gateway which lost the mapping may grant another port, which the
+		// policy may not allow.
+		policy := m.cfg.policy.renewal(int(m.externalAddr().Port()))
+		mapping, err := m.client.addPortMappingWithPolicy(ctx, protocol, internalPort, policy, m.cfg.lifetime)
+		if err != nil {
+			return netip.AddrPort{}, 0, err
+		}
+		return netip.AddrPortFrom(extIP, mapping.MappedExternalPort), mapping.Lifetime, nil
+	}
+	m.deleteMapping = func(ctx context.Context) error {
+		_, err := m.client.addPortMappingContext(ctx, protocol, internalPort, 0, 0)
+		return err
+	}
+	return mapping.Lifetime, nil
+}
+
+// addPinhole opens a PCP pinhole for the port on an IPv6 gateway.
+func (m *mappedPort) addPinhole(ctx context.Context, protocol string, internalPort int) (time.Duration, error) {
+	pinhole, err := m.client.addPinhole(ctx, protocol, internalPort, m.cfg.lifetime, nil)
+	if err != nil {
+		return 0, err
+	}
+	m.external = pinhole.External
+	m.renewMapping = func(ctx context.Context) (netip.AddrPort, time.Duration, error) {
+		renewed, err := m.client.renewPinhole(ctx, pinhole, m.cfg.lifetime)
+		if err != nil {
+			return netip.AddrPort{}, 0, err
+		}
+		pinhole = renewed
+		return pinhole.External, pinhole.Lifetime, nil
+	}
+	m.deleteMapping = func(ctx context.Context) error {
+		return m.client.deletePinhole(ctx, pinhole)
+	}
+	return pinhole.Lifetime, nil
+}
+
+func (m *mappedPort) externalAddr() netip.AddrPort {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.external
+}
+
+func (m *mappedPort) renewErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *mappedPort) renew(ctx context.Context, next time.Duration) {
+	defer close(m.done)
+	timer := m.client.clock.NewTimer(next)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+		}
+		external, lifetime, err := m.renewMapping(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		m.mu.Lock()
+		m.err = err
+		if err == nil {
+			m.external = external
+		}
+		m.mu.Unlock()
+		if err != nil {
+			timer.Reset(renewRetryInterval)
+			continue
+		}
+		timer.Reset(m.renewInterval(lifetime))
+	}
+}
+
+// renewInterval returns the time until the next renewal, half of the
+// granted lifetime, falling back on the requested lifetime.
+func (m *mappedPort) renewInterval(granted time.Duration) time.Duration {
+	if granted <= 0 {
+		granted = m.cfg.lifetime
+	}
+	return granted / 2
+}
+
+func (m *mappedPort) close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		m.stop()
+		<-m.done
+		ctx, cancel := context.WithTimeout(context.Background(), m.cfg.closeTimeout)
+		defer cancel()
+		err = m.deleteMapping(ctx)
+	})
+	return err
+}
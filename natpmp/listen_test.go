@@ -0,0 +1,231 @@
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+func TestListen(t *testing.T) {
+	gw := &fakeGateway{extAddr: [4]byte{203, 0, 113, 7}}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw))
+
+	l, err := Listen(context.Background(), c, "tcp", "127.0.0.1:0", Lifetime(time.Hour))
+	if err != nil {
+		t.Fatalf("Listen() got err: %v", err)
+	}
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	want := netip.AddrPortFrom(netip.MustParseAddr("203.0.113.7"), port)
+	if got := l.ExternalAddr(); got != want {
+		t.Errorf("ExternalAddr()=%v != %v", got, want)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() got err: %v", err)
+	}
+
+	reqs := gw.mappingRequests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d mapping requests, want 2: %+v", len(reqs), reqs)
+	}
+	if add := reqs[0]; add.Opcode != 2 || add.InternalPort != port || add.LifetimeSecs != 3600 {
+		t.Errorf("add request=%+v", add)
+	}
+	if del := reqs[1]; del.Opcode != 2 || del.InternalPort != port || del.SuggestedExternalPort != 0 || del.LifetimeSecs != 0 {
+		t.Errorf("delete request=%+v", del)
+	}
+}
+
+func TestListenCloseOrder(t *testing.T) {
+	var (
+		addr        string
+		closedFirst atomic.Bool
+		deleteAsked atomic.Bool
+	)
+	st := &scriptTransport{respond: func(req []byte) []byte {
+		if req[1] == 0 {
+			return []byte{0, 0x80, 0, 0, 0, 0, 0, 1, 203, 0, 113, 7}
+		}
+		if lifetime := binary.BigEndian.Uint32(req[8:]); lifetime == 0 {
+			// The gateway does not answer the delete.
+			deleteAsked.Store(true)
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Close()
+			} else {
+				closedFirst.Store(true)
+			}
+			return nil
+		}
+		return append([]byte{0, req[1] | 0x80, 0, 0, 0, 0, 0, 1}, req[4:12]...)
+	}}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(st))
+	l, err := Listen(context.Background(), c, "tcp", "127.0.0.1:0", CloseTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Listen() got err: %v", err)
+	}
+	addr = l.Addr().String()
+
+	start := time.Now()
+	if err := l.Close(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close() err=%v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Close() took %s", elapsed)
+	}
+	if !deleteAsked.Load() || !closedFirst.Load() {
+		t.Errorf("delete asked=%t, listener closed first=%t; want both", deleteAsked.Load(), closedFirst.Load())
+	}
+}
+
+func TestListenPacketRenews(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	// Granting a one second lifetime causes a renewal every 500ms.
+	gw := &fakeGateway{extAddr: [4]byte{203, 0, 113, 7}, grantLifetime: 1, clock: fake}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw), WithClock(fake))
+
+	pc, err := ListenPacket(context.Background(), c, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() got err: %v", err)
+	}
+	defer pc.Close()
+
+	for want := 2; want <= 3; want++ {
+		waitFor(t, func() bool { return fake.Timers() == 1 })
+		fake.Advance(500 * time.Millisecond)
+		waitFor(t, func() bool { return len(gw.mappingRequests()) == want })
+	}
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	for _, r := range gw.mappingRequests() {
+		if r.Opcode != 1 || r.InternalPort != port || r.SuggestedExternalPort != port {
+			t.Errorf("request=%+v", r)
+		}
+	}
+}
+
+func TestListenPacketRenewsExactPort(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	// After the first renewal the gateway reboots, and grants another port.
+	var rebooted atomic.Bool
+	gw := &fakeGateway{extAddr: [4]byte{203, 0, 113, 7}, grantLifetime: 1, clock: fake,
+		grantPort: func(requested uint16) uint16 {
+			if rebooted.Load() {
+				return requested + 1
+			}
+			return requested
+		},
+	}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw), WithClock(fake))
+
+	pc, err := ListenPacket(context.Background(), c, "udp", "127.0.0.1:0", WithPortPolicy(ExactPort(9000)))
+	if err != nil {
+		t.Fatalf("ListenPacket() got err: %v", err)
+	}
+	defer pc.Close()
+	want := netip.MustParseAddrPort("203.0.113.7:9000")
+
+	waitFor(t, func() bool { return fake.Timers() == 1 })
+	fake.Advance(500 * time.Millisecond)
+	waitFor(t, func() bool { return len(gw.mappingRequests()) == 2 })
+	rebooted.Store(true)
+	waitFor(t, func() bool { return fake.Timers() == 1 })
+	fake.Advance(500 * time.Millisecond)
+	// The port granted instead is not kept.
+	waitFor(t, func() bool { return len(gw.mappingRequests()) == 4 })
+	if got := pc.ExternalAddr(); got != want {
+		t.Errorf("ExternalAddr()=%v, want %v", got, want)
+	}
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	for i, r := range gw.mappingRequests() {
+		wantPort, wantLifetime := uint16(9000), uint32(DefaultLifetime/time.Second)
+		if i == 3 {
+			wantPort, wantLifetime = 0, 0
+		}
+		if r.InternalPort != port || r.SuggestedExternalPort != wantPort || r.LifetimeSecs != wantLifetime {
+			t.Errorf("request %d=%+v", i, r)
+		}
+	}
+}
+
+func TestListenPacketRenewErr(t *testing.T) {
+	fake := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var failing atomic.Bool
+	gw := &fakeGateway{extAddr: [4]byte{203, 0, 113, 7}, grantLifetime: 1, clock: fake,
+		unsupported: func(wire.MappingRequest) bool { return failing.Load() },
+	}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw), WithClock(fake))
+
+	pc, err := ListenPacket(context.Background(), c, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() got err: %v", err)
+	}
+	defer pc.Close()
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+
+	failing.Store(true)
+	waitFor(t, func() bool { return fake.Timers() == 1 })
+	fake.Advance(500 * time.Millisecond)
+	waitFor(t, func() bool { return pc.RenewErr() != nil })
+	if err := pc.RenewErr(); !errors.Is(err, UnsupportedOpcode) {
+		t.Errorf("RenewErr()=%v, want %v", err, UnsupportedOpcode)
+	}
+
+	// The gateway's address changed meanwhile.
+	failing.Store(false)
+	gw.mu.Lock()
+	gw.extAddr = [4]byte{198, 51, 100, 9}
+	gw.mu.Unlock()
+	waitFor(t, func() bool { return fake.Timers() == 1 })
+	fake.Advance(renewRetryInterval)
+	waitFor(t, func() bool { return pc.RenewErr() == nil })
+	if got, want := pc.ExternalAddr(), netip.AddrPortFrom(netip.MustParseAddr("198.51.100.9"), port); got != want {
+		t.Errorf("ExternalAddr()=%v, want %v", got, want)
+	}
+}
+
+func TestListenCancel(t *testing.T) {
+	st := &scriptTransport{respond: func([]byte) []byte { return nil }}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(st))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for st.count() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	start := time.Now()
+	if _, err := Listen(ctx, c, "tcp", "127.0.0.1:0"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Listen() err=%v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Listen() took %s after being cancelled", elapsed)
+	}
+}
+
+// waitFor waits for a background goroutine to make cond true.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestListenUnsupportedNetwork(t *testing.T) {
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(&fakeGateway{}))
+	if _, err := Listen(context.Background(), c, "udp", ":0"); err == nil {
+		t.Errorf("Listen(udp) expected error")
+	}
+	if _, err := ListenPacket(context.Background(), c, "tcp", ":0"); err == nil {
+		t.Errorf("ListenPacket(tcp) expected error")
+	}
+}
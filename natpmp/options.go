@@ -1,20 +1,32 @@
 package natpmp
 
 import (
+	"net/netip"
 	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
 )
 
 // Option is the type for modifying the Client
 type Option func(*Client)
 
-// Timeout returns an option which sets the default timeout
-// for the client.
+// Timeout returns an option which sets an overall deadline for each request,
+// ending the retransmission schedule early. Zero (the default) uses the full
+// schedule of 9 attempts, around 128 seconds.
 func Timeout(timeout time.Duration) Option {
 	return func(client *Client) {
 		client.timeout = timeout
 	}
 }
 
+// AttemptTimeout returns an option which caps how long the client waits
+// for a response before retransmitting, so the wait stops doubling at d.
+func AttemptTimeout(d time.Duration) Option {
+	return func(client *Client) {
+		client.attemptTimeout = d
+	}
+}
+
 // Port returns an option which sets the port to use on the Gateway for NAT-PMP.
 func Port(port int) Option {
 	return func(client *Client) {
@@ -31,3 +43,100 @@ func WithTransport(transport Transport) Option {
 		client.transport = transport
 	}
 }
+
+// MaxInFlight returns an option which sets how many requests
+// AddPortMappings sends to the gateway before waiting for responses.
+func MaxInFlight(n int) Option {
+	return func(client *Client) {
+		if n > 0 {
+			client.maxInFlight = n
+		}
+	}
+}
+
+// WithClock returns an option which uses the specified Clock for the
+// retransmission and renewal schedules. Primarily for testing with a
+// clock.Fake, together with a Transport which honours the same clock.
+func WithClock(c clock.Clock) Option {
+	return func(client *Client) {
+		client.clock = c
+	}
+}
+
+// WithStateStore returns an option which records the mappings made by
+// AddPortMapping in store, so that Reconcile can clean up after a restart.
+// If the store cannot be updated, AddPortMapping returns the mapping
+// together with the error.
+func WithStateStore(store StateStore) Option {
+	return func(client *Client) {
+		client.store = store
+	}
+}
+
+// WithRegistry returns an option which claims each mapping in the Registry
+// before asking the gateway for it, so that two processes on this host do
+// not share a mapping without knowing. AddPortMapping returns an *OwnedErr
+// when another process holds the claim.
+func WithRegistry(r *Registry) Option {
+	return func(client *Client) {
+		client.registry = r
+	}
+}
+
+// RateLimit returns an option which paces the requests sent to the gateway
+// to burst at once, then one every interval. Clients for the same gateway
+// share a Limiter using WithLimiter instead. By default requests are not
+// paced.
+func RateLimit(every time.Duration, burst int) Option {
+	return WithLimiter(NewLimiter(every, burst))
+}
+
+// WithLimiter returns an option which paces the requests sent to the
+// gateway with the Limiter, which may be shared with other Clients.
+func WithLimiter(l *Limiter) Option {
+	return func(client *Client) {
+		client.limiter = l
+	}
+}
+
+// Coalesce returns an option which sets whether concurrent callers making
+// the same request share one exchange with the gateway, such as several
+// goroutines calling GetExternalAddress at once. It is enabled by default.
+func Coalesce(enabled bool) Option {
+	return func(client *Client) {
+		client.coalesce = enabled
+	}
+}
+
+// CacheExternalAddress returns an option which keeps the answer to
+// GetExternalAddress for ttl, returning it without asking the gateway, with
+// the epoch advanced by the time since. The cached address is dropped when
+// a response shows the gateway's epoch went backwards, fails with Network
+// Failure, or is a PCP mapping with a different external address, and is
+// replaced by announcements seen by WatchExternalAddress. See Cached and
+// Refresh. By default the address is not cached.
+func CacheExternalAddress(ttl time.Duration) Option {
+	return func(client *Client) {
+		client.addrTTL = ttl
+	}
+}
+
+// SourceAddr returns an option which sends requests from the local
+// address, so that the gateway maps ports to it on a host with several
+// addresses. It applies to the default Transport.
+func SourceAddr(addr netip.Addr) Option {
+	return func(client *Client) {
+		client.source = addr
+	}
+}
+
+// BindInterface returns an option which sends requests through the named
+// network interface, for a host with several interfaces or with policy
+// routing. On Linux the socket is bound with SO_BINDTODEVICE, which may
+// need CAP_NET_RAW; elsewhere requests are sent from the interface's
+// address unless SourceAddr is set. It applies to the default Transport.
+func BindInterface(name string) Option {
+	return func(client *Client) {
+		client.device = name
+	}
+}
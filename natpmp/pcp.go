@@ -0,0 +1,528 @@
+package natpmp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// PCP (RFC 6887) opcodes.
+const (
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+	pcpOpPeer     = 2
+)
+
+// Sizes of the PCP messages on the wire, before any options.
+const (
+	pcpHeaderSize  = 24
+	pcpMapSize     = 36
+	pcpMapMsgSize  = pcpHeaderSize + pcpMapSize
+	pcpPeerSize    = pcpMapSize + 20
+	pcpPeerMsgSize = pcpHeaderSize + pcpPeerSize
+)
+
+// IANA protocol numbers used in PCP requests.
+const (
+	ianaTCP = 6
+	ianaUDP = 17
+)
+
+// PCPResultCodeErr is the non-zero result code returned by a PCP gateway
+// (RFC 6887 section 7.4), so a failure can be checked with
+// errors.Is(err, natpmp.PCPNoResources).
+type PCPResultCodeErr int
+
+const (
+	PCPUnsupportedVersion    PCPResultCodeErr = 1
+	PCPNotAuthorized         PCPResultCodeErr = 2
+	PCPMalformedRequest      PCPResultCodeErr = 3
+	PCPUnsupportedOpcode     PCPResultCodeErr = 4
+	PCPUnsupportedOption     PCPResultCodeErr = 5
+	PCPMalformedOption       PCPResultCodeErr = 6
+	PCPNetworkFailure        PCPResultCodeErr = 7
+	PCPNoResources           PCPResultCodeErr = 8
+	PCPUnsupportedProtocol   PCPResultCodeErr = 9
+	PCPUserExceededQuota     PCPResultCodeErr = 10
+	PCPCannotProvideExternal PCPResultCodeErr = 11
+	PCPAddressMismatch       PCPResultCodeErr = 12
+	PCPExcessiveRemotePeers  PCPResultCodeErr = 13
+)
+
+var pcpResultReasons = map[PCPResultCodeErr]string{
+	PCPUnsupportedVersion:    "unsupported version",
+	PCPNotAuthorized:         "not authorized",
+	PCPMalformedRequest:      "malformed request",
+	PCPUnsupportedOpcode:     "unsupported opcode",
+	PCPUnsupportedOption:     "unsupported option",
+	PCPMalformedOption:       "malformed option",
+	PCPNetworkFailure:        "network failure",
+	PCPNoResources:           "no resources",
+	PCPUnsupportedProtocol:   "unsupported protocol",
+	PCPUserExceededQuota:     "user exceeded quota",
+	PCPCannotProvideExternal: "cannot provide external address or port",
+	PCPAddressMismatch:       "address mismatch",
+	PCPExcessiveRemotePeers:  "excessive remote peers",
+}
+
+func (r PCPResultCodeErr) Error() string {
+	var reason string
+	if s, ok := pcpResultReasons[r]; ok {
+		reason = ": " + s
+	}
+	return fmt.Sprintf("error PCP non-zero result code %d%s", int(r), reason)
+}
+
+// Pinhole is an inbound firewall pinhole (or, on an IPv4 gateway, a port
+// mapping) opened with a PCP MAP request. On an IPv6 firewall the
+// external address and port are normally the same as the internal ones.
+type Pinhole struct {
+	Protocol string
+	// Internal is this host's address, as seen by the gateway, and port.
+	Internal netip.AddrPort
+	// External is the address and port which reach Internal.
+	External netip.AddrPort
+	// Lifetime is the lifetime granted by the gateway.
+	Lifetime time.Duration
+	// RequestedLifetime is the lifetime sent to the gateway, after rounding.
+	RequestedLifetime time.Duration
+	// EpochDuration is the gateway's epoch time.
+	EpochDuration time.Duration
+	// RetryStats describes the attempts made before the gateway responded.
+	RetryStats RetryStats
+	// Options holds the options returned by the gateway, and Unprocessed
+	// the options sent which the gateway did not return, typically because
+	// it does not support them.
+	Options     []PCPOption
+	Unprocessed []PCPOption
+
+	// nonce and opts identify the mapping to the gateway for renewal and
+	// deletion.
+	nonce [12]byte
+	opts  []PCPOption
+}
+
+// AddPinhole asks the PCP gateway to let inbound traffic reach the internal
+// port on this host, using a MAP request with an all-zeros suggested
+// external address (RFC 6887 section 11.2), so an IPv6 firewall opens a
+// pinhole without translating. The gateway must be a PCP server; the
+// client's address is the local address used to reach it, unless a
+// ThirdPartyOption names another host. The options are sent again when
+// the pinhole is renewed.
+// Note that this call can take up to 128 seconds to return.
+func (c *Client) AddPinhole(protocol string, internalPort int, lifetime time.Duration, opts ...PCPOption) (*Pinhole, error) {
+	return c.addPinhole(context.Background(), protocol, internalPort, lifetime, opts)
+}
+
+// addPinhole is AddPinhole. Cancelling ctx abandons the request.
+func (c *Client) addPinhole(ctx context.Context, protocol string, internalPort int, lifetime time.Duration, opts []PCPOption) (*Pinhole, error) {
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return c.pcpMap(ctx, protocol, nonce, uint16(internalPort), netip.AddrPort{}, lifetime, opts)
+}
+
+// RenewPinhole renews the pinhole, asking for the same external address
+// and port, and returns the pinhole as granted.
+// Note that this call can take up to 128 seconds to return.
+func (c *Client) RenewPinhole(p *Pinhole, lifetime time.Duration) (*Pinhole, error) {
+	return c.renewPinhole(context.Background(), p, lifetime)
+}
+
+// renewPinhole is RenewPinhole. Cancelling ctx abandons the request.
+func (c *Client) renewPinhole(ctx context.Context, p *Pinhole, lifetime time.Duration) (*Pinhole, error) {
+	return c.pcpMap(ctx, p.Protocol, p.nonce, p.Internal.Port(), p.External, lifetime, p.opts)
+}
+
+// DeletePinhole closes the pinhole.
+// Note that this call can take up to 128 seconds to return.
+func (c *Client) DeletePinhole(p *Pinhole) error {
+	return c.deletePinhole(context.Background(), p)
+}
+
+// deletePinhole is DeletePinhole. Cancelling ctx abandons the request.
+func (c *Client) deletePinhole(ctx context.Context, p *Pinhole) error {
+	// Only THIRD_PARTY identifies the mapping; the others are about
+	// granting it.
+	var opts []PCPOption
+	for _, o := range p.opts {
+		if o, ok := o.(ThirdPartyOption); ok {
+			opts = append(opts, o)
+		}
+	}
+	_, err := c.pcpMap(ctx, p.Protocol, p.nonce, p.Internal.Port(), netip.AddrPort{}, 0, opts)
+	return err
+}
+
+// pcpMap sends a MAP request. Cancelling ctx abandons the request.
+func (c *Client) pcpMap(ctx context.Context, protocol string, nonce [12]byte, internalPort uint16, suggested netip.AddrPort, lifetime time.Duration, opts []PCPOption) (*Pinhole, error) {
+	proto, err := ianaProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPCPOptions(pcpOpMap, opts); err != nil {
+		return nil, err
+	}
+	secs, err := lifetimeSecs(lifetime)
+	if err != nil {
+		return nil, err
+	}
+	req := pcpMapReq{
+		pcpReqHeader: pcpReqHeader{Opcode: pcpOpMap, Lifetime: secs},
+		pcpMap: pcpMap{
+			Nonce:        nonce,
+			Protocol:     proto,
+			InternalPort: internalPort,
+			ExternalPort: suggested.Port(),
+		},
+		Options: opts,
+	}
+	if suggested.IsValid() {
+		req.ExternalAddr = suggested.Addr().As16()
+	}
+	if suggested.Port() == 0 {
+		req.ExternalPort = internalPort
+	}
+
+	var resp pcpMapResp
+	client, stats, err := c.pcpRPC(ctx, &req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("PCP MAP Failed: %w", err)
+	}
+	c.observe(time.Duration(resp.EpochSecs)*time.Second, netip.AddrFrom16(resp.ExternalAddr).Unmap())
+	return &Pinhole{
+		Protocol:          protocol,
+		Internal:          netip.AddrPortFrom(thirdParty(opts, client), resp.InternalPort),
+		External:          netip.AddrPortFrom(netip.AddrFrom16(resp.ExternalAddr).Unmap(), resp.ExternalPort),
+		Lifetime:          time.Duration(resp.Lifetime) * time.Second,
+		RequestedLifetime: time.Duration(secs) * time.Second,
+		EpochDuration:     time.Duration(resp.EpochSecs) * time.Second,
+		RetryStats:        stats,
+		Options:           resp.Options,
+		Unprocessed:       unprocessedOptions(opts, resp.Options),
+		nonce:             nonce,
+		opts:              opts,
+	}, nil
+}
+
+func ianaProtocol(protocol string) (byte, error) {
+	switch protocol {
+	case "udp":
+		return ianaUDP, nil
+	case "tcp":
+		return ianaTCP, nil
+	}
+	return 0, fmt.Errorf("unknown protocol %v", protocol)
+}
+
+// pcpRequest is a PCP request, completed with the client's address once
+// the transport to the gateway is open.
+type pcpRequest interface {
+	AppendBinary(b []byte) ([]byte, error)
+	setClient(local netip.Addr)
+	// echoed reports whether the response echoes the fields which identify
+	// the request. A response too short to hold them can only be an error,
+	// and is taken to be for the request.
+	echoed(result []byte) bool
+}
+
+// pcpRPC sends the PCP request from the local address used to reach the
+// gateway, following the retransmission schedule until a response to it
+// arrives, and decodes the response into resp. Responses to other requests
+// are ignored. Cancelling ctx abandons the request.
+func (c *Client) pcpRPC(ctx context.Context, req pcpRequest, resp encoding.BinaryUnmarshaler) (netip.Addr, RetryStats, error) {
+	if err := c.limiter.wait(ctx, c.clock); err != nil {
+		return netip.Addr{}, RetryStats{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return netip.Addr{}, RetryStats{}, err
+	}
+	if err := c.transport.Open(c.gatewayIP, c.port); err != nil {
+		return netip.Addr{}, RetryStats{}, fmt.Errorf("error net.DialUDP(): %w", err)
+	}
+	defer c.transport.Close()
+
+	lt, ok := c.transport.(localAddrTransport)
+	if !ok {
+		return netip.Addr{}, RetryStats{}, errors.New("PCP requires a Transport which reports its LocalAddr")
+	}
+	local, err := localAddr(lt.LocalAddr())
+	if err != nil {
+		return netip.Addr{}, RetryStats{}, err
+	}
+	req.setClient(local)
+	reqBytes, _ := req.AppendBinary(make([]byte, 0, pcpPeerMsgSize))
+
+	// Closing the transport ends a Read waiting for its deadline.
+	defer c.closeOnCancel(ctx)()
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	_, stats, err := c.exchange(reqBytes, buf.resp[:], func(result []byte) error {
+		if !req.echoed(result) {
+			return errIgnored
+		}
+		if err := checkPCPHeader(result, reqBytes[1]|0x80); err != nil {
+			return err
+		}
+		return resp.UnmarshalBinary(result)
+	})
+	if ctx.Err() != nil {
+		return netip.Addr{}, stats, ctx.Err()
+	}
+	return local, stats, err
+}
+
+// checkPCPHeader checks the version, opcode and result code in the common
+// PCP response header.
+func checkPCPHeader(result []byte, expectedOp byte) error {
+	if len(result) >= 1 && result[0] != pcpVersion {
+		return &VersionErr{Version: int(result[0]), Want: pcpVersion}
+	}
+	if len(result) < pcpHeaderSize {
+		return &SizeErr{Got: len(result), Want: pcpHeaderSize}
+	}
+	switch {
+	case result[1] != expectedOp:
+		return &OpcodeErr{Got: result[1], Want: expectedOp}
+	case result[3] != 0:
+		return PCPResultCodeErr(result[3])
+	}
+	return nil
+}
+
+// localAddrTransport is implemented by a Transport which can report the
+// local address it uses to reach the gateway, which PCP requests carry.
+type localAddrTransport interface {
+	LocalAddr() net.Addr
+}
+
+func localAddr(addr net.Addr) (netip.Addr, error) {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		if a, ok := netip.AddrFromSlice(ua.IP); ok {
+			return a.Unmap(), nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("unexpected local address %v", addr)
+}
+
+type pcpReqHeader struct {
+	Opcode     byte
+	Lifetime   uint32
+	ClientAddr [16]byte
+}
+
+type pcpRespHeader struct {
+	Opcode     byte
+	ResultCode byte
+	Lifetime   uint32
+	EpochSecs  uint32
+}
+
+// checkPCPSize checks that a PCP message holds at least size bytes, with
+// any options after them padded to a multiple of 4 (RFC 6887 section 7).
+func checkPCPSize(data []byte, size int) error {
+	if len(data) < size || len(data)%4 != 0 {
+		return &SizeErr{Got: len(data), Want: size}
+	}
+	return nil
+}
+
+// AppendBinary appends the wire format of the request header to b.
+func (h pcpReqHeader) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, pcpVersion, h.Opcode, 0, 0)
+	b = binary.BigEndian.AppendUint32(b, h.Lifetime)
+	return append(b, h.ClientAddr[:]...), nil
+}
+
+// UnmarshalBinary decodes the request header from its wire format.
+func (h *pcpReqHeader) UnmarshalBinary(data []byte) error {
+	if err := checkPCPSize(data, pcpHeaderSize); err != nil {
+		return err
+	}
+	h.Opcode = data[1]
+	h.Lifetime = binary.BigEndian.Uint32(data[4:])
+	h.ClientAddr = [16]byte(data[8:])
+	return nil
+}
+
+// AppendBinary appends the wire format of the response header to b.
+func (h pcpRespHeader) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, pcpVersion, h.Opcode, 0, h.ResultCode)
+	b = binary.BigEndian.AppendUint32(b, h.Lifetime)
+	b = binary.BigEndian.AppendUint32(b, h.EpochSecs)
+	return append(b, make([]byte, 12)...), nil
+}
+
+// UnmarshalBinary decodes the response header from its wire format.
+func (h *pcpRespHeader) UnmarshalBinary(data []byte) error {
+	if err := checkPCPSize(data, pcpHeaderSize); err != nil {
+		return err
+	}
+	h.Opcode, h.ResultCode = data[1], data[3]
+	h.Lifetime = binary.BigEndian.Uint32(data[4:])
+	h.EpochSecs = binary.BigEndian.Uint32(data[8:])
+	return nil
+}
+
+// pcpAnnounceReq is an ANNOUNCE request, which has no payload.
+type pcpAnnounceReq struct {
+	pcpReqHeader
+}
+
+func (r *pcpAnnounceReq) setClient(local netip.Addr) { r.ClientAddr = local.As16() }
+
+func (r *pcpAnnounceReq) echoed([]byte) bool { return true }
+
+// pcpAnnounce sends an ANNOUNCE request (RFC 6887 section 14.1), which the
+// gateway answers with its epoch without changing any of its state.
+// Cancelling ctx abandons the request.
+func (c *Client) pcpAnnounce(ctx context.Context) (time.Duration, error) {
+	req := pcpAnnounceReq{pcpReqHeader{Opcode: pcpOpAnnounce}}
+	var resp pcpRespHeader
+	if _, _, err := c.pcpRPC(ctx, &req, &resp); err != nil {
+		return 0, fmt.Errorf("PCP ANNOUNCE Failed: %w", err)
+	}
+	epoch := time.Duration(resp.EpochSecs) * time.Second
+	c.observe(epoch, netip.Addr{})
+	return epoch, nil
+}
+
+// pcpMap is the MAP opcode payload, the same in requests and responses.
+type pcpMap struct {
+	Nonce        [12]byte
+	Protocol     byte
+	InternalPort uint16
+	ExternalPort uint16
+	ExternalAddr [16]byte
+}
+
+type pcpMapReq struct {
+	pcpReqHeader
+	pcpMap
+	Options []PCPOption
+}
+
+type pcpMapResp struct {
+	pcpRespHeader
+	pcpMap
+	Options []PCPOption
+}
+
+// AppendBinary appends the wire format of the MAP payload to b.
+func (m pcpMap) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, m.Nonce[:]...)
+	b = append(b, m.Protocol, 0, 0, 0)
+	b = binary.BigEndian.AppendUint16(b, m.InternalPort)
+	b = binary.BigEndian.AppendUint16(b, m.ExternalPort)
+	return append(b, m.ExternalAddr[:]...), nil
+}
+
+// UnmarshalBinary decodes the MAP payload from its wire format.
+func (m *pcpMap) UnmarshalBinary(data []byte) error {
+	if err := checkPCPSize(data, pcpMapSize); err != nil {
+		return err
+	}
+	m.Nonce = [12]byte(data)
+	m.Protocol = data[12]
+	m.InternalPort = binary.BigEndian.Uint16(data[16:])
+	m.ExternalPort = binary.BigEndian.Uint16(data[18:])
+	m.ExternalAddr = [16]byte(data[20:])
+	return nil
+}
+
+// AppendBinary appends the wire format of the request to b.
+func (r pcpMapReq) AppendBinary(b []byte) ([]byte, error) {
+	b, _ = r.pcpReqHeader.AppendBinary(b)
+	b, _ = r.pcpMap.AppendBinary(b)
+	return appendPCPOptions(b, r.Options), nil
+}
+
+// MarshalBinary returns the wire format of the request.
+func (r pcpMapReq) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, pcpMapMsgSize))
+}
+
+// UnmarshalBinary decodes the request from its wire format.
+func (r *pcpMapReq) UnmarshalBinary(data []byte) error {
+	if err := checkPCPSize(data, pcpMapMsgSize); err != nil {
+		return err
+	}
+	if err := r.pcpReqHeader.UnmarshalBinary(data[:pcpHeaderSize]); err != nil {
+		return err
+	}
+	if err := r.pcpMap.UnmarshalBinary(data[pcpHeaderSize:pcpMapMsgSize]); err != nil {
+		return err
+	}
+	var err error
+	r.Options, err = parsePCPOptions(data[pcpMapMsgSize:])
+	return err
+}
+
+// AppendBinary appends the wire format of the response to b.
+func (r pcpMapResp) AppendBinary(b []byte) ([]byte, error) {
+	b, _ = r.pcpRespHeader.AppendBinary(b)
+	b, _ = r.pcpMap.AppendBinary(b)
+	return appendPCPOptions(b, r.Options), nil
+}
+
+// MarshalBinary returns the wire format of the response.
+func (r pcpMapResp) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, pcpMapMsgSize))
+}
+
+// UnmarshalBinary decodes the response from its wire format.
+func (r *pcpMapResp) UnmarshalBinary(data []byte) error {
+	if err := checkPCPSize(data, pcpMapMsgSize); err != nil {
+		return err
+	}
+	if err := r.pcpRespHeader.UnmarshalBinary(data[:pcpHeaderSize]); err != nil {
+		return err
+	}
+	if err := r.pcpMap.UnmarshalBinary(data[pcpHeaderSize:pcpMapMsgSize]); err != nil {
+		return err
+	}
+	var err error
+	r.Options, err = parsePCPOptions(data[pcpMapMsgSize:])
+	return err
+}
+
+func (r *pcpMapReq) setClient(local netip.Addr) {
+	r.ClientAddr = local.As16()
+	if r.ExternalAddr == ([16]byte{}) && thirdParty(r.Options, local).Is4() {
+		// The all-zeros IPv4 address is sent IPv4-mapped.
+		r.ExternalAddr = netip.AddrFrom4([4]byte{}).As16()
+	}
+}
+
+func (r *pcpMapReq) echoed(result []byte) bool {
+	var m pcpMap
+	if m.UnmarshalBinary(pcpPayload(result, pcpMapSize)) != nil {
+		return true
+	}
+	return r.pcpMap.identifies(m)
+}
+
+// identifies reports whether the MAP or PEER payload m is for the same
+// mapping as r (RFC 6887 sections 11.3 and 12.3).
+func (r pcpMap) identifies(m pcpMap) bool {
+	return m.Nonce == r.Nonce && m.Protocol == r.Protocol && m.InternalPort == r.InternalPort
+}
+
+// pcpPayload returns the size bytes of opcode payload in a PCP message,
+// or nil if the message is too short to hold them.
+func pcpPayload(msg []byte, size int) []byte {
+	if len(msg) < pcpHeaderSize+size {
+		return nil
+	}
+	return msg[pcpHeaderSize : pcpHeaderSize+size]
+}
@@ -0,0 +1,507 @@
+package natpmp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+)
+
+// pcpServer is a local stand-in for a PCP server on an IPv6 firewall.
+type pcpServer struct {
+	conn *net.UDPConn
+	// grantLifetime overrides the lifetime in responses when non-zero.
+	grantLifetime uint32
+	// busyPort is an external port which is already in use.
+	busyPort uint16
+	// ignoreOption is an option code the server leaves out of responses,
+	// as if it did not support it.
+	ignoreOption byte
+	// respond and respondPeer, when set, replace the responses to MAP and
+	// PEER requests.
+	respond     func(req pcpMapReq) [][]byte
+	respondPeer func(req pcpPeerReq) [][]byte
+
+	mu       sync.Mutex
+	requests []pcpMapReq
+	peers    []pcpPeerReq
+}
+
+// newPCPServer starts s, which holds the server's configuration, on the
+// IPv6 loopback address.
+func newPCPServer(t *testing.T, s *pcpServer) *pcpServer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	s.conn = conn
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *pcpServer) client(opts ...Option) *Client {
+	opts = append([]Option{Port(s.conn.LocalAddr().(*net.UDPAddr).Port), Timeout(5 * time.Second)}, opts...)
+	return NewClient(net.IPv6loopback, opts...)
+}
+
+func (s *pcpServer) serve() {
+	buf := make([]byte, maxResponseSize)
+	for {
+		n, from, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		var resps [][]byte
+		switch buf[1] {
+		case pcpOpAnnounce:
+			b, _ := pcpRespHeader{Opcode: pcpOpAnnounce | 0x80, EpochSecs: 1000}.AppendBinary(nil)
+			resps = [][]byte{b}
+		case pcpOpMap:
+			var req pcpMapReq
+			if err := req.UnmarshalBinary(buf[:n]); err != nil {
+				continue
+			}
+			s.mu.Lock()
+			s.requests = append(s.requests, req)
+			s.mu.Unlock()
+			if s.respond != nil {
+				resps = s.respond(req)
+			} else {
+				resps = [][]byte{s.grant(req, from.Addr())}
+			}
+		case pcpOpPeer:
+			var req pcpPeerReq
+			if err := req.UnmarshalBinary(buf[:n]); err != nil {
+				continue
+			}
+			s.mu.Lock()
+			s.peers = append(s.peers, req)
+			s.mu.Unlock()
+			if s.respondPeer != nil {
+				resps = s.respondPeer(req)
+			} else {
+				resps = [][]byte{s.grantPeer(req)}
+			}
+		}
+		for _, r := range resps {
+			s.conn.WriteToUDPAddrPort(r, from)
+		}
+	}
+}
+
+// grant answers the request as an IPv6 firewall: the external address and
+// port are the internal ones.
+func (s *pcpServer) grant(req pcpMapReq, from netip.Addr) []byte {
+	resp := pcpMapResp{
+		pcpRespHeader: pcpRespHeader{Opcode: req.Opcode | 0x80, Lifetime: req.Lifetime, EpochSecs: 1000},
+		pcpMap:        req.pcpMap,
+	}
+	internal := req.ClientAddr
+	preferFailure := false
+	for _, o := range req.Options {
+		switch o := o.(type) {
+		case ThirdPartyOption:
+			internal = o.Internal.As16()
+		case PreferFailureOption:
+			preferFailure = true
+		}
+		if o.OptionCode() != s.ignoreOption {
+			resp.Options = append(resp.Options, o)
+		}
+	}
+	resp.ExternalAddr = internal
+	resp.ExternalPort = req.ExternalPort
+	switch {
+	case netip.AddrFrom16(req.ClientAddr) != from:
+		resp.ResultCode = byte(PCPAddressMismatch)
+	case req.ExternalPort == s.busyPort && preferFailure:
+		resp.ResultCode = byte(PCPCannotProvideExternal)
+	case req.ExternalPort == s.busyPort:
+		resp.ExternalPort++
+	}
+	if s.grantLifetime != 0 && req.Lifetime != 0 {
+		resp.Lifetime = s.grantLifetime
+	}
+	b, _ := resp.MarshalBinary()
+	return b
+}
+
+// grantPeer answers the request as an IPv6 firewall.
+func (s *pcpServer) grantPeer(req pcpPeerReq) []byte {
+	resp := pcpPeerResp{
+		pcpRespHeader: pcpRespHeader{Opcode: req.Opcode | 0x80, Lifetime: req.Lifetime, EpochSecs: 1000},
+		pcpPeer:       req.pcpPeer,
+	}
+	if s.grantLifetime != 0 && req.Lifetime != 0 {
+		resp.Lifetime = s.grantLifetime
+	}
+	resp.ExternalAddr = req.ClientAddr
+	resp.ExternalPort = req.InternalPort
+	b, _ := resp.MarshalBinary()
+	return b
+}
+
+func (s *pcpServer) peerRequests() []pcpPeerReq {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]pcpPeerReq(nil), s.peers...)
+}
+
+func (s *pcpServer) mapRequests() []pcpMapReq {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]pcpMapReq(nil), s.requests...)
+}
+
+func TestPinhole(t *testing.T) {
+	s := newPCPServer(t, &pcpServer{})
+	c := s.client()
+
+	p, err := c.AddPinhole("tcp", 8080, time.Hour)
+	if err != nil {
+		t.Fatalf("AddPinhole() got err: %v", err)
+	}
+	want := netip.MustParseAddrPort("[::1]:8080")
+	if p.Internal != want || p.External != want || p.Lifetime != time.Hour || p.EpochDuration != 1000*time.Second {
+		t.Errorf("AddPinhole()=%+v", p)
+	}
+	if _, err := c.RenewPinhole(p, time.Hour); err != nil {
+		t.Fatalf("RenewPinhole() got err: %v", err)
+	}
+	if err := c.DeletePinhole(p); err != nil {
+		t.Fatalf("DeletePinhole() got err: %v", err)
+	}
+
+	reqs := s.mapRequests()
+	if len(reqs) != 3 {
+		t.Fatalf("got %d requests, want 3", len(reqs))
+	}
+	add := reqs[0]
+	if add.Opcode != pcpOpMap || add.Protocol != ianaTCP || add.InternalPort != 8080 || add.Lifetime != 3600 {
+		t.Errorf("add request=%+v", add)
+	}
+	if add.ExternalAddr != ([16]byte{}) {
+		t.Errorf("suggested external address %v, want all zeros", add.ExternalAddr)
+	}
+	if renew := reqs[1]; renew.Nonce != add.Nonce || netip.AddrFrom16(renew.ExternalAddr) != want.Addr() {
+		t.Errorf("renew request=%+v", renew)
+	}
+	if del := reqs[2]; del.Nonce != add.Nonce || del.Lifetime != 0 {
+		t.Errorf("delete request=%+v", del)
+	}
+}
+
+func TestPCPMapper(t *testing.T) {
+	s := newPCPServer(t, &pcpServer{busyPort: 9090})
+	// The fake clock starts now, since the transport's deadlines are real.
+	fake := clock.NewFake(time.Now())
+	m := NewPCPMapper(s.client(WithClock(fake)))
+
+	if epoch, err := m.Probe(context.Background()); err != nil || epoch != 1000*time.Second {
+		t.Errorf("Probe()=%s, %v", epoch, err)
+	}
+	getExternalAddress := func(wantEpoch time.Duration) {
+		t.Helper()
+		addr, epoch, err := m.GetExternalAddress()
+		if err != nil {
+			t.Fatalf("GetExternalAddress() got err: %v", err)
+		}
+		if addr != netip.IPv6Loopback() || epoch != wantEpoch {
+			t.Errorf("GetExternalAddress()=%v, %s; want epoch %s", addr, epoch, wantEpoch)
+		}
+	}
+	getExternalAddress(1000 * time.Second)
+	mapping, err := m.AddPortMapping("tcp", 8080, 9090, time.Hour)
+	if err != nil {
+		t.Fatalf("AddPortMapping() got err: %v", err)
+	}
+	if mapping.InternalPort != 8080 || mapping.MappedExternalPort != 9091 || mapping.Lifetime != time.Hour {
+		t.Errorf("AddPortMapping()=%+v", mapping)
+	}
+	// Answered from the mapping, with the epoch advanced.
+	fake.Advance(time.Minute)
+	getExternalAddress(1060 * time.Second)
+	if _, err := m.AddPortMapping("tcp", 8080, 9090, time.Hour); err != nil {
+		t.Fatalf("AddPortMapping() renew got err: %v", err)
+	}
+	// The mapping has expired, so a port is mapped again.
+	fake.Advance(time.Hour)
+	getExternalAddress(1000 * time.Second)
+	if err := m.DeletePortMapping("tcp", 8080); err != nil {
+		t.Fatalf("DeletePortMapping() got err: %v", err)
+	}
+	if err := m.DeletePortMapping("tcp", 8080); err == nil {
+		t.Errorf("DeletePortMapping() of a deleted mapping got no error")
+	}
+
+	reqs := s.mapRequests()
+	if len(reqs) != 7 {
+		t.Fatalf("got %d requests, want 7", len(reqs))
+	}
+	for _, i := range []int{0, 4} {
+		if probe, del := reqs[i], reqs[i+1]; probe.InternalPort != discardPort || probe.Lifetime != uint32(discardLifetime/time.Second) || del.Nonce != probe.Nonce || del.Lifetime != 0 {
+			t.Errorf("probe requests=%+v, %+v", probe, del)
+		}
+	}
+	add, renew, del := reqs[2], reqs[3], reqs[6]
+	if add.ExternalPort != 9090 || renew.Nonce != add.Nonce || del.Nonce != add.Nonce || del.Lifetime != 0 {
+		t.Errorf("requests=%+v, %+v, %+v", add, renew, del)
+	}
+}
+
+func TestPinholeErrors(t *testing.T) {
+	header := func(version, result byte) []byte {
+		return []byte{version, pcpOpMap | 0x80, 0, result, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	}
+	testCases := []struct {
+		name    string
+		respond func(req pcpMapReq) [][]byte
+		wantErr error
+	}{
+		{
+			name: "result code",
+			respond: func(pcpMapReq) [][]byte {
+				return [][]byte{header(pcpVersion, byte(PCPNotAuthorized))}
+			},
+			wantErr: PCPNotAuthorized,
+		},
+		{
+			name: "NAT-PMP only gateway",
+			respond: func(pcpMapReq) [][]byte {
+				return [][]byte{{0, 0x80, 0, byte(UnsupportedVersion), 0, 0, 0, 0}}
+			},
+			wantErr: UnsupportedVersion,
+		},
+		{
+			name: "other nonce ignored",
+			respond: func(req pcpMapReq) [][]byte {
+				other := pcpMapResp{
+					pcpRespHeader: pcpRespHeader{Opcode: pcpOpMap | 0x80, ResultCode: byte(PCPNoResources)},
+				}
+				stale, _ := other.MarshalBinary()
+				resp := pcpMapResp{
+					pcpRespHeader: pcpRespHeader{Opcode: pcpOpMap | 0x80, Lifetime: req.Lifetime},
+					pcpMap:        req.pcpMap,
+				}
+				ok, _ := resp.MarshalBinary()
+				return [][]byte{stale, ok}
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newPCPServer(t, &pcpServer{respond: tc.respond})
+			_, err := s.client().AddPinhole("udp", 5000, time.Hour)
+			switch {
+			case tc.wantErr == nil && err != nil:
+				t.Errorf("AddPinhole() got err: %v", err)
+			case tc.wantErr != nil && !errors.Is(err, tc.wantErr):
+				t.Errorf("AddPinhole() got err=%v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestListenPacketPinhole(t *testing.T) {
+	// Granting a one second lifetime causes a renewal every 500ms.
+	s := newPCPServer(t, &pcpServer{grantLifetime: 1})
+	c := s.client()
+
+	pc, err := ListenPacket(context.Background(), c, "udp6", "[::1]:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() got err: %v", err)
+	}
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+	if got, want := pc.ExternalAddr(), netip.AddrPortFrom(netip.IPv6Loopback(), port); got != want {
+		t.Errorf("ExternalAddr()=%v != %v", got, want)
+	}
+	waitFor(t, func() bool { return len(s.mapRequests()) >= 2 })
+	if err := pc.Close(); err != nil {
+		t.Fatalf("Close() got err: %v", err)
+	}
+
+	reqs := s.mapRequests()
+	if del := reqs[len(reqs)-1]; del.Lifetime != 0 || del.Nonce != reqs[0].Nonce {
+		t.Errorf("last request=%+v, want delete", del)
+	}
+}
+
+func TestPinholeOptions(t *testing.T) {
+	appliance := netip.MustParseAddr("2001:db8::5")
+	filter := FilterOption{Remote: netip.MustParsePrefix("192.0.2.0/24"), Port: 443}
+	testCases := []struct {
+		name   string
+		server *pcpServer
+		opts   []PCPOption
+		// wantReq is the options the server received.
+		wantReq         []PCPOption
+		wantInternal    netip.AddrPort
+		wantExternal    netip.AddrPort
+		wantUnprocessed []PCPOption
+		wantErr         error
+	}{
+		{
+			name:         "third party",
+			opts:         []PCPOption{ThirdPartyOption{Internal: appliance}},
+			wantReq:      []PCPOption{ThirdPartyOption{Internal: appliance}},
+			wantInternal: netip.AddrPortFrom(appliance, 80),
+			wantExternal: netip.AddrPortFrom(appliance, 80),
+		},
+		{
+			name:         "port taken",
+			server:       &pcpServer{busyPort: 80},
+			wantInternal: netip.MustParseAddrPort("[::1]:80"),
+			wantExternal: netip.MustParseAddrPort("[::1]:81"),
+		},
+		{
+			name:    "prefer failure",
+			server:  &pcpServer{busyPort: 80},
+			opts:    []PCPOption{PreferFailureOption{}},
+			wantReq: []PCPOption{PreferFailureOption{}},
+			wantErr: PCPCannotProvideExternal,
+		},
+		{
+			name:         "filter",
+			opts:         []PCPOption{filter},
+			wantReq:      []PCPOption{filter},
+			wantInternal: netip.MustParseAddrPort("[::1]:80"),
+			wantExternal: netip.MustParseAddrPort("[::1]:80"),
+		},
+		{
+			name:         "remove all filters",
+			opts:         []PCPOption{FilterOption{}},
+			wantReq:      []PCPOption{FilterOption{}},
+			wantInternal: netip.MustParseAddrPort("[::1]:80"),
+			wantExternal: netip.MustParseAddrPort("[::1]:80"),
+		},
+		{
+			name:            "unprocessed",
+			server:          &pcpServer{ignoreOption: pcpOptFilter},
+			opts:            []PCPOption{filter, PreferFailureOption{}},
+			wantReq:         []PCPOption{filter, PreferFailureOption{}},
+			wantInternal:    netip.MustParseAddrPort("[::1]:80"),
+			wantExternal:    netip.MustParseAddrPort("[::1]:80"),
+			wantUnprocessed: []PCPOption{filter},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.server == nil {
+				tc.server = &pcpServer{}
+			}
+			s := newPCPServer(t, tc.server)
+			p, err := s.client().AddPinhole("tcp", 80, time.Hour, tc.opts...)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("AddPinhole() got err=%v, want %v", err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("AddPinhole() got err: %v", err)
+			} else {
+				if p.Internal != tc.wantInternal || p.External != tc.wantExternal {
+					t.Errorf("AddPinhole() internal %v external %v, want %v %v", p.Internal, p.External, tc.wantInternal, tc.wantExternal)
+				}
+				if !reflect.DeepEqual(p.Unprocessed, tc.wantUnprocessed) {
+					t.Errorf("Unprocessed=%v, want %v", p.Unprocessed, tc.wantUnprocessed)
+				}
+				if _, err := s.client().RenewPinhole(p, time.Hour); err != nil {
+					t.Fatalf("RenewPinhole() got err: %v", err)
+				}
+			}
+			for _, req := range s.mapRequests() {
+				if !reflect.DeepEqual(req.Options, tc.wantReq) {
+					t.Errorf("request options=%v, want %v", req.Options, tc.wantReq)
+				}
+			}
+		})
+	}
+}
+
+func TestPCPOptionEncoding(t *testing.T) {
+	opts := []PCPOption{
+		ThirdPartyOption{Internal: netip.MustParseAddr("192.168.1.20")},
+		PreferFailureOption{},
+		FilterOption{Remote: netip.MustParsePrefix("2001:db8::/32")},
+		FilterOption{Remote: netip.MustParsePrefix("198.51.100.7/32"), Port: 22},
+		UnknownOption{Code: 0x80, Data: []byte{1, 2, 3}},
+	}
+	b := appendPCPOptions(nil, opts)
+	if len(b)%4 != 0 {
+		t.Errorf("encoded %d bytes, not padded to a multiple of 4", len(b))
+	}
+	got, err := parsePCPOptions(b)
+	if err != nil {
+		t.Fatalf("parsePCPOptions() got err: %v", err)
+	}
+	if !reflect.DeepEqual(got, opts) {
+		t.Errorf("parsePCPOptions()=%v, want %v", got, opts)
+	}
+
+	for name, data := range map[string][]byte{
+		"short header":        {pcpOptThirdParty, 0},
+		"length past end":     {pcpOptFilter, 0, 0, 20, 0, 0, 0, 0},
+		"wrong length":        {pcpOptThirdParty, 0, 0, 4, 0, 0, 0, 0},
+		"invalid prefix bits": append([]byte{pcpOptFilter, 0, 0, 20, 0, 200, 0, 0}, make([]byte, 16)...),
+	} {
+		if _, err := parsePCPOptions(data); err == nil {
+			t.Errorf("%s: parsePCPOptions() expected error", name)
+		}
+	}
+}
+
+func TestFilterOptionEncoding(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter FilterOption
+		want   []byte
+	}{
+		{
+			name:   "remove all",
+			filter: FilterOption{},
+			want:   append([]byte{pcpOptFilter, 0, 0, 20, 0, 0, 0, 0}, make([]byte, 16)...),
+		},
+		{
+			name:   "any ipv4 peer",
+			filter: FilterOption{Remote: netip.MustParsePrefix("0.0.0.0/0")},
+			want:   append([]byte{pcpOptFilter, 0, 0, 20, 0, 96, 0, 0}, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 0, 0),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := appendPCPOptions(nil, []PCPOption{tc.filter})
+			if !bytes.Equal(b, tc.want) {
+				t.Errorf("appendPCPOptions()=%v, want %v", b, tc.want)
+			}
+			got, err := parsePCPOptions(b)
+			if err != nil {
+				t.Fatalf("parsePCPOptions() got err: %v", err)
+			}
+			if !reflect.DeepEqual(got, []PCPOption{tc.filter}) {
+				t.Errorf("parsePCPOptions()=%v, want %v", got, tc.filter)
+			}
+		})
+	}
+}
+
+func TestPCPOptionOpcodes(t *testing.T) {
+	c := NewClient(net.IPv6loopback, WithTransport(&fakeGateway{}))
+	remote := netip.MustParseAddrPort("192.0.2.1:443")
+	for _, opt := range []PCPOption{PreferFailureOption{}, FilterOption{Remote: netip.MustParsePrefix("192.0.2.0/24")}} {
+		if _, err := c.Peer(context.Background(), "tcp", 443, remote, time.Hour, opt); err == nil {
+			t.Errorf("Peer() with %T expected error", opt)
+		}
+	}
+	malformed := FilterOption{Remote: netip.PrefixFrom(netip.MustParseAddr("192.0.2.0"), 33)}
+	if _, err := c.AddPinhole("tcp", 443, time.Hour, malformed); !errContains(err, "invalid FILTER prefix") {
+		t.Errorf("AddPinhole() with a malformed prefix err=%v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package natpmp
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// discardPort is the port mapped, then deleted, to learn the external
+// address from a PCP gateway, since PCP has no request just for that.
+const discardPort = 9
+
+// discardLifetime is the lifetime of the discardPort mapping, so that it
+// expires soon if it cannot be deleted.
+const discardLifetime = 10 * time.Second
+
+// PCPMapper maps ports with PCP MAP requests, for a gateway which supports
+// PCP but not NAT-PMP. It has the same methods as Client, so either can be
+// used as a portmap.PortMapper.
+// Unlike Client, its GetExternalAddress may create a short-lived mapping;
+// see that method.
+type PCPMapper struct {
+	client *Client
+
+	mu       sync.Mutex
+	pinholes map[claimKey]grantedPinhole
+}
+
+// grantedPinhole is a mapping made by a PCPMapper, and when it was granted.
+type grantedPinhole struct {
+	*Pinhole
+	granted time.Time
+}
+
+// NewPCPMapper returns a PCPMapper which sends its requests with the client.
+func NewPCPMapper(client *Client) *PCPMapper {
+	return &PCPMapper{client: client, pinholes: make(map[claimKey]grantedPinhole)}
+}
+
+// Probe checks that the gateway answers PCP, with an ANNOUNCE request which
+// does not change its state, and returns the gateway's epoch.
+// Note that this call can take up to 128 seconds to return, unless ctx is
+// cancelled.
+func (m *PCPMapper) Probe(ctx context.Context) (time.Duration, error) {
+	return m.client.pcpAnnounce(ctx)
+}
+
+// GetExternalAddress returns the external address of the gateway, from the
+// most recently granted of its mappings which has not expired.
+//
+// PCP has no request which only asks for the external address, so if this
+// PCPMapper has no such mapping, GetExternalAddress changes the gateway's
+// state: it maps UDP port 9 (discard) of this host for 10 seconds, reads the
+// address from the response, and deletes the mapping again. While it exists
+// the mapping forwards packets for some external port to port 9, and if the
+// delete fails it stays until its lifetime expires. If this host already has
+// a PCP mapping for UDP port 9 made by another program, the gateway refuses
+// the request and an error is returned.
+// Note that this call can take up to 128 seconds to return.
+func (m *PCPMapper) GetExternalAddress() (netip.Addr, time.Duration, error) {
+	now := m.client.clock.Now()
+	m.mu.Lock()
+	var recent grantedPinhole
+	for _, p := range m.pinholes {
+		if now.Before(p.granted.Add(p.Lifetime)) && p.granted.After(recent.granted) {
+			recent = p
+		}
+	}
+	m.mu.Unlock()
+	if recent.Pinhole != nil {
+		return recent.External.Addr(), recent.EpochDuration + now.Sub(recent.granted).Truncate(time.Second), nil
+	}
+
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return netip.Addr{}, 0, err
+	}
+	p, err := m.client.pcpMap(context.Background(), "udp", nonce, discardPort, netip.AddrPort{}, discardLifetime, nil)
+	if err != nil {
+		return netip.Addr{}, 0, err
+	}
+	if err := m.client.DeletePinhole(p); err != nil {
+		return netip.Addr{}, 0, err
+	}
+	return p.External.Addr(), p.EpochDuration, nil
+}
+
+// AddPortMapping adds, renews or (with a lifetime of 0) deletes a mapping,
+// like Client.AddPortMapping.
+// Note that this call can take up to 128 seconds to return.
+func (m *PCPMapper) AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (*PortMapping, error) {
+	key := claimKey{protocol, uint16(internalPort)}
+	if lifetime == 0 {
+		return &PortMapping{InternalPort: uint16(internalPort)}, m.DeletePortMapping(protocol, internalPort)
+	}
+	m.mu.Lock()
+	prev := m.pinholes[key]
+	m.mu.Unlock()
+
+	var nonce [12]byte
+	if prev.Pinhole != nil {
+		nonce = prev.nonce
+	} else if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	suggested := netip.AddrPortFrom(netip.Addr{}, uint16(requestedExternalPort))
+	p, err := m.client.pcpMap(context.Background(), protocol, nonce, uint16(internalPort), suggested, lifetime, nil)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.pinholes[key] = grantedPinhole{p, m.client.clock.Now()}
+	m.mu.Unlock()
+	return &PortMapping{
+		EpochDuration:      p.EpochDuration,
+		InternalPort:       p.Internal.Port(),
+		MappedExternalPort: p.External.Port(),
+		Lifetime:           p.Lifetime,
+		RequestedLifetime:  p.RequestedLifetime,
+		RetryStats:         p.RetryStats,
+		InternalAddr:       p.Internal.Addr(),
+	}, nil
+}
+
+// DeletePortMapping deletes the mapping for the internal port made by this
+// PCPMapper.
+// Note that this call can take up to 128 seconds to return.
+func (m *PCPMapper) DeletePortMapping(protocol string, internalPort int) error {
+	key := claimKey{protocol, uint16(internalPort)}
+	m.mu.Lock()
+	p, ok := m.pinholes[key]
+	m.mu.Unlock()
+	if !ok {
+		// PCP identifies a mapping by its nonce, which only its creator knows.
+		return errors.New("DeletePortMapping: no PCP mapping for this port")
+	}
+	if err := m.client.DeletePinhole(p.Pinhole); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.pinholes, key)
+	m.mu.Unlock()
+	return nil
+}
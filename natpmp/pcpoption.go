@@ -0,0 +1,222 @@
+package natpmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// PCP option codes (RFC 6887 section 13).
+const (
+	pcpOptThirdParty    = 1
+	pcpOptPreferFailure = 2
+	pcpOptFilter        = 3
+)
+
+const (
+	pcpOptHeaderSize  = 4
+	pcpThirdPartySize = 16
+	pcpFilterSize     = 20
+)
+
+// PCPOption is an option sent with, or returned in, a PCP MAP or PEER
+// request. The options defined by RFC 6887 are ThirdPartyOption,
+// PreferFailureOption and FilterOption; other options in a response are
+// returned as UnknownOption.
+type PCPOption interface {
+	// OptionCode returns the option code.
+	OptionCode() byte
+	appendData(b []byte) []byte
+}
+
+// ThirdPartyOption makes the mapping on behalf of another host, such as an
+// appliance which cannot run a PCP client. Internal is the host's address.
+type ThirdPartyOption struct {
+	Internal netip.Addr
+}
+
+func (ThirdPartyOption) OptionCode() byte { return pcpOptThirdParty }
+
+func (o ThirdPartyOption) appendData(b []byte) []byte {
+	a := o.Internal.As16()
+	return append(b, a[:]...)
+}
+
+// PreferFailureOption asks the gateway to fail a MAP request rather than
+// grant an external port other than the one suggested, with result code
+// PCPCannotProvideExternal. It is not valid with PEER requests.
+type PreferFailureOption struct{}
+
+func (PreferFailureOption) OptionCode() byte { return pcpOptPreferFailure }
+
+func (PreferFailureOption) appendData(b []byte) []byte { return b }
+
+// FilterOption only lets remote peers in Remote, and on Port unless it is
+// 0, use a MAP mapping. Each option adds one filter; the zero Prefix with
+// port 0 removes all filters (RFC 6887 section 13.3). An IPv4 prefix is
+// sent IPv4-mapped, so 0.0.0.0/0 admits every IPv4 peer rather than
+// removing the filters. It is not valid with PEER requests.
+type FilterOption struct {
+	Remote netip.Prefix
+	Port   uint16
+}
+
+func (FilterOption) OptionCode() byte { return pcpOptFilter }
+
+func (o FilterOption) appendData(b []byte) []byte {
+	if !o.Remote.IsValid() {
+		// Prefix length 0 and the all-zeros address.
+		b = append(b, 0, 0)
+		b = binary.BigEndian.AppendUint16(b, o.Port)
+		return append(b, make([]byte, 16)...)
+	}
+	bits := o.Remote.Bits()
+	if o.Remote.Addr().Is4() {
+		bits += 96 // IPv4-mapped
+	}
+	b = append(b, 0, byte(bits))
+	b = binary.BigEndian.AppendUint16(b, o.Port)
+	a := o.Remote.Addr().As16()
+	return append(b, a[:]...)
+}
+
+// UnknownOption is an option in a response which this package does not
+// decode.
+type UnknownOption struct {
+	Code byte
+	Data []byte
+}
+
+func (o UnknownOption) OptionCode() byte { return o.Code }
+
+func (o UnknownOption) appendData(b []byte) []byte { return append(b, o.Data...) }
+
+// appendPCPOptions appends the options to b, each padded to a multiple of
+// 4 bytes.
+func appendPCPOptions(b []byte, opts []PCPOption) []byte {
+	for _, o := range opts {
+		start := len(b)
+		b = append(b, o.OptionCode(), 0, 0, 0)
+		b = o.appendData(b)
+		binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start-pcpOptHeaderSize))
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+// parsePCPOptions decodes the options at the end of a PCP message.
+func parsePCPOptions(data []byte) ([]PCPOption, error) {
+	var opts []PCPOption
+	for len(data) > 0 {
+		if len(data) < pcpOptHeaderSize {
+			return nil, fmt.Errorf("malformed PCP option: %d bytes left", len(data))
+		}
+		code, n := data[0], int(binary.BigEndian.Uint16(data[2:]))
+		padded := (n + 3) &^ 3
+		if len(data) < pcpOptHeaderSize+padded {
+			return nil, fmt.Errorf("malformed PCP option %d: length %d exceeds message", code, n)
+		}
+		opt, err := parsePCPOption(code, data[pcpOptHeaderSize:pcpOptHeaderSize+n])
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+		data = data[pcpOptHeaderSize+padded:]
+	}
+	return opts, nil
+}
+
+func parsePCPOption(code byte, data []byte) (PCPOption, error) {
+	want := -1
+	switch code {
+	case pcpOptThirdParty:
+		want = pcpThirdPartySize
+	case pcpOptPreferFailure:
+		want = 0
+	case pcpOptFilter:
+		want = pcpFilterSize
+	}
+	if want >= 0 && len(data) != want {
+		return nil, fmt.Errorf("malformed PCP option %d: length %d, expected %d", code, len(data), want)
+	}
+	switch code {
+	case pcpOptThirdParty:
+		return ThirdPartyOption{Internal: netip.AddrFrom16([16]byte(data)).Unmap()}, nil
+	case pcpOptPreferFailure:
+		return PreferFailureOption{}, nil
+	case pcpOptFilter:
+		addr := netip.AddrFrom16([16]byte(data[4:]))
+		bits := int(data[1])
+		port := binary.BigEndian.Uint16(data[2:])
+		if bits == 0 && addr.IsUnspecified() {
+			return FilterOption{Port: port}, nil
+		}
+		if addr.Is4In6() {
+			addr, bits = addr.Unmap(), bits-96
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return nil, fmt.Errorf("malformed PCP FILTER option: %w", err)
+		}
+		return FilterOption{Remote: prefix, Port: port}, nil
+	}
+	return UnknownOption{Code: code, Data: append([]byte(nil), data...)}, nil
+}
+
+// unprocessedOptions returns the options which were sent but are not in
+// the response; the gateway leaves out the optional ones it does not
+// support or did not act on.
+func unprocessedOptions(sent, got []PCPOption) []PCPOption {
+	var unprocessed []PCPOption
+	for _, o := range sent {
+		found := false
+		for _, g := range got {
+			if g.OptionCode() == o.OptionCode() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unprocessed = append(unprocessed, o)
+		}
+	}
+	return unprocessed
+}
+
+// checkPCPOptions checks that the options are valid for the opcode.
+func checkPCPOptions(opcode byte, opts []PCPOption) error {
+	for _, o := range opts {
+		switch o := o.(type) {
+		case ThirdPartyOption:
+			if !o.Internal.IsValid() {
+				return fmt.Errorf("invalid THIRD_PARTY address %v", o.Internal)
+			}
+		case FilterOption:
+			if opcode != pcpOpMap {
+				return fmt.Errorf("FILTER option is only valid with MAP requests")
+			}
+			if o.Remote != (netip.Prefix{}) && !o.Remote.IsValid() {
+				// The zero Prefix removes all filters.
+				return fmt.Errorf("invalid FILTER prefix %v", o.Remote)
+			}
+		case PreferFailureOption:
+			if opcode != pcpOpMap {
+				return fmt.Errorf("PREFER_FAILURE option is only valid with MAP requests")
+			}
+		}
+	}
+	return nil
+}
+
+// thirdParty returns the internal address from a THIRD_PARTY option, or
+// def if there is none.
+func thirdParty(opts []PCPOption, def netip.Addr) netip.Addr {
+	for _, o := range opts {
+		if tp, ok := o.(ThirdPartyOption); ok {
+			return tp.Internal
+		}
+	}
+	return def
+}
@@ -0,0 +1,260 @@
+package natpmp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// PeerMapping is the NAT binding for an outbound flow from an internal port
+// to a remote peer, whose lifetime is set with a PCP PEER request.
+type PeerMapping struct {
+	Protocol string
+	// Internal is this host's address, as seen by the gateway, and port.
+	Internal netip.AddrPort
+	// External is the address and port the remote peer sees.
+	External netip.AddrPort
+	Remote   netip.AddrPort
+	// Lifetime is the lifetime granted by the gateway.
+	Lifetime time.Duration
+	// RequestedLifetime is the lifetime sent to the gateway, after rounding.
+	RequestedLifetime time.Duration
+	// EpochDuration is the gateway's epoch time.
+	EpochDuration time.Duration
+	// RetryStats describes the attempts made before the gateway responded.
+	RetryStats RetryStats
+	// Options holds the options returned by the gateway, and Unprocessed
+	// the options sent which the gateway did not return.
+	Options     []PCPOption
+	Unprocessed []PCPOption
+
+	// nonce and opts identify the mapping to the gateway for renewal.
+	nonce [12]byte
+	opts  []PCPOption
+}
+
+// Peer asks the PCP gateway to keep the binding for the outbound flow from
+// the internal port to the remote peer for the lifetime, creating it if
+// needed, so a long-lived flow such as a VPN tunnel needs no keepalive
+// traffic. The binding can be renewed with RenewPeer or KeepPeer, which
+// send the options again; only ThirdPartyOption is valid with PEER.
+// Note that this call can take up to 128 seconds to return, unless ctx is
+// done first.
+func (c *Client) Peer(ctx context.Context, protocol string, internalPort int, remote netip.AddrPort, lifetime time.Duration, opts ...PCPOption) (*PeerMapping, error) {
+	var nonce [12]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return c.pcpPeer(ctx, protocol, nonce, uint16(internalPort), netip.AddrPort{}, remote, lifetime, opts)
+}
+
+// RenewPeer renews the binding, asking for the same external address and
+// port, and returns the binding as granted.
+func (c *Client) RenewPeer(ctx context.Context, p *PeerMapping, lifetime time.Duration) (*PeerMapping, error) {
+	return c.pcpPeer(ctx, p.Protocol, p.nonce, p.Internal.Port(), p.External, p.Remote, lifetime, p.opts)
+}
+
+// KeepPeer renews the binding when half of its granted lifetime has passed,
+// until ctx is done, and returns ctx.Err(). A failed renewal is retried
+// after 30 seconds; if renewed is not nil it is called with the binding
+// after each successful renewal.
+func (c *Client) KeepPeer(ctx context.Context, p *PeerMapping, lifetime time.Duration, renewed func(*PeerMapping)) error {
+	timer := c.clock.NewTimer(peerRenewInterval(p, lifetime))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C():
+		}
+		next, err := c.RenewPeer(ctx, p, lifetime)
+		if err != nil {
+			timer.Reset(renewRetryInterval)
+			continue
+		}
+		p = next
+		if renewed != nil {
+			renewed(p)
+		}
+		timer.Reset(peerRenewInterval(p, lifetime))
+	}
+}
+
+// peerRenewInterval returns half of the granted lifetime, falling back on
+// the requested lifetime.
+func peerRenewInterval(p *PeerMapping, lifetime time.Duration) time.Duration {
+	if p.Lifetime > 0 {
+		return p.Lifetime / 2
+	}
+	return lifetime / 2
+}
+
+func (c *Client) pcpPeer(ctx context.Context, protocol string, nonce [12]byte, internalPort uint16, suggested, remote netip.AddrPort, lifetime time.Duration, opts []PCPOption) (*PeerMapping, error) {
+	proto, err := ianaProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPCPOptions(pcpOpPeer, opts); err != nil {
+		return nil, err
+	}
+	secs, err := lifetimeSecs(lifetime)
+	if err != nil {
+		return nil, err
+	}
+	if !remote.IsValid() {
+		return nil, fmt.Errorf("invalid remote peer %v", remote)
+	}
+	req := pcpPeerReq{
+		pcpReqHeader: pcpReqHeader{Opcode: pcpOpPeer, Lifetime: secs},
+		pcpPeer: pcpPeer{
+			pcpMap: pcpMap{
+				Nonce:        nonce,
+				Protocol:     proto,
+				InternalPort: internalPort,
+				ExternalPort: suggested.Port(),
+			},
+			RemotePort: remote.Port(),
+			RemoteAddr: remote.Addr().As16(),
+		},
+		Options: opts,
+	}
+	if suggested.IsValid() {
+		req.ExternalAddr = suggested.Addr().As16()
+	}
+
+	var resp pcpPeerResp
+	client, stats, err := c.pcpRPC(ctx, &req, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("PCP PEER Failed: %w", err)
+	}
+	return &PeerMapping{
+		Protocol:          protocol,
+		Internal:          netip.AddrPortFrom(thirdParty(opts, client), resp.InternalPort),
+		External:          netip.AddrPortFrom(netip.AddrFrom16(resp.ExternalAddr).Unmap(), resp.ExternalPort),
+		Remote:            netip.AddrPortFrom(netip.AddrFrom16(resp.RemoteAddr).Unmap(), resp.RemotePort),
+		Lifetime:          time.Duration(resp.Lifetime) * time.Second,
+		RequestedLifetime: time.Duration(secs) * time.Second,
+		EpochDuration:     time.Duration(resp.EpochSecs) * time.Second,
+		RetryStats:        stats,
+		Options:           resp.Options,
+		Unprocessed:       unprocessedOptions(opts, resp.Options),
+		nonce:             nonce,
+		opts:              opts,
+	}, nil
+}
+
+// pcpPeer is the PEER opcode payload, the same in requests and responses:
+// the MAP payload followed by the remote peer.
+type pcpPeer struct {
+	pcpMap
+	RemotePort uint16
+	RemoteAddr [16]byte
+}
+
+type pcpPeerReq struct {
+	pcpReqHeader
+	pcpPeer
+	Options []PCPOption
+}
+
+type pcpPeerResp struct {
+	pcpRespHeader
+	pcpPeer
+	Options []PCPOption
+}
+
+// AppendBinary appends the wire format of the PEER payload to b.
+func (p pcpPeer) AppendBinary(b []byte) ([]byte, error) {
+	b, _ = p.pcpMap.AppendBinary(b)
+	b = binary.BigEndian.AppendUint16(b, p.RemotePort)
+	b = append(b, 0, 0)
+	return append(b, p.RemoteAddr[:]...), nil
+}
+
+// UnmarshalBinary decodes the PEER payload from its wire format.
+func (p *pcpPeer) UnmarshalBinary(data []byte) error {
+	if err := checkPCPSize(data, pcpPeerSize); err != nil {
+		return err
+	}
+	if err := p.pcpMap.UnmarshalBinary(data[:pcpMapSize]); err != nil {
+		return err
+	}
+	p.RemotePort = binary.BigEndian.Uint16(data[pcpMapSize:])
+	p.RemoteAddr = [16]byte(data[pcpMapSize+4:])
+	return nil
+}
+
+// AppendBinary appends the wire format of the request to b.
+func (r pcpPeerReq) AppendBinary(b []byte) ([]byte, error) {
+	b, _ = r.pcpReqHeader.AppendBinary(b)
+	b, _ = r.pcpPeer.AppendBinary(b)
+	return appendPCPOptions(b, r.Options), nil
+}
+
+// MarshalBinary returns the wire format of the request.
+func (r pcpPeerReq) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, pcpPeerMsgSize))
+}
+
+// UnmarshalBinary decodes the request from its wire format.
+func (r *pcpPeerReq) UnmarshalBinary(data []byte) error {
+	if err := checkPCPSize(data, pcpPeerMsgSize); err != nil {
+		return err
+	}
+	if err := r.pcpReqHeader.UnmarshalBinary(data[:pcpHeaderSize]); err != nil {
+		return err
+	}
+	if err := r.pcpPeer.UnmarshalBinary(data[pcpHeaderSize:pcpPeerMsgSize]); err != nil {
+		return err
+	}
+	var err error
+	r.Options, err = parsePCPOptions(data[pcpPeerMsgSize:])
+	return err
+}
+
+// AppendBinary appends the wire format of the response to b.
+func (r pcpPeerResp) AppendBinary(b []byte) ([]byte, error) {
+	b, _ = r.pcpRespHeader.AppendBinary(b)
+	b, _ = r.pcpPeer.AppendBinary(b)
+	return appendPCPOptions(b, r.Options), nil
+}
+
+// MarshalBinary returns the wire format of the response.
+func (r pcpPeerResp) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, pcpPeerMsgSize))
+}
+
+// UnmarshalBinary decodes the response from its wire format.
+func (r *pcpPeerResp) UnmarshalBinary(data []byte) error {
+	if err := checkPCPSize(data, pcpPeerMsgSize); err != nil {
+		return err
+	}
+	if err := r.pcpRespHeader.UnmarshalBinary(data[:pcpHeaderSize]); err != nil {
+		return err
+	}
+	if err := r.pcpPeer.UnmarshalBinary(data[pcpHeaderSize:pcpPeerMsgSize]); err != nil {
+		return err
+	}
+	var err error
+	r.Options, err = parsePCPOptions(data[pcpPeerMsgSize:])
+	return err
+}
+
+func (r *pcpPeerReq) setClient(local netip.Addr) {
+	r.ClientAddr = local.As16()
+	if r.ExternalAddr == ([16]byte{}) && thirdParty(r.Options, local).Is4() {
+		// The all-zeros IPv4 address is sent IPv4-mapped.
+		r.ExternalAddr = netip.AddrFrom4([4]byte{}).As16()
+	}
+}
+
+func (r *pcpPeerReq) echoed(result []byte) bool {
+	var p pcpPeer
+	if p.UnmarshalBinary(pcpPayload(result, pcpPeerSize)) != nil {
+		return true
+	}
+	return r.pcpMap.identifies(p.pcpMap) && p.RemotePort == r.RemotePort && p.RemoteAddr == r.RemoteAddr
+}
@@ -0,0 +1,121 @@
+package natpmp
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeer(t *testing.T) {
+	s := newPCPServer(t, &pcpServer{})
+	c := s.client()
+	remote := netip.MustParseAddrPort("[2001:db8::1]:51820")
+
+	p, err := c.Peer(context.Background(), "udp", 51820, remote, time.Hour)
+	if err != nil {
+		t.Fatalf("Peer() got err: %v", err)
+	}
+	want := netip.MustParseAddrPort("[::1]:51820")
+	if p.Internal != want || p.External != want || p.Remote != remote || p.Lifetime != time.Hour {
+		t.Errorf("Peer()=%+v", p)
+	}
+	if _, err := c.RenewPeer(context.Background(), p, 2*time.Hour); err != nil {
+		t.Fatalf("RenewPeer() got err: %v", err)
+	}
+
+	reqs := s.peerRequests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(reqs))
+	}
+	first, renew := reqs[0], reqs[1]
+	if first.Opcode != pcpOpPeer || first.Protocol != ianaUDP || first.InternalPort != 51820 || first.Lifetime != 3600 {
+		t.Errorf("request=%+v", first)
+	}
+	if got := netip.AddrPortFrom(netip.AddrFrom16(first.RemoteAddr), first.RemotePort); got != remote {
+		t.Errorf("request remote peer=%v, want %v", got, remote)
+	}
+	if renew.Nonce != first.Nonce || renew.Lifetime != 7200 || renew.ExternalPort != 51820 {
+		t.Errorf("renew request=%+v", renew)
+	}
+}
+
+func TestPeerIgnoresOtherFlows(t *testing.T) {
+	remote := netip.MustParseAddrPort("192.0.2.1:5060")
+	s := newPCPServer(t, &pcpServer{
+		respondPeer: func(req pcpPeerReq) [][]byte {
+			// A response for a flow to another peer, with the same nonce,
+			// comes before the one for this request.
+			other := pcpPeerResp{
+				pcpRespHeader: pcpRespHeader{Opcode: req.Opcode | 0x80, ResultCode: byte(PCPNoResources)},
+				pcpPeer:       req.pcpPeer,
+			}
+			other.RemotePort++
+			wrong, _ := other.MarshalBinary()
+			resp := pcpPeerResp{
+				pcpRespHeader: pcpRespHeader{Opcode: req.Opcode | 0x80, Lifetime: req.Lifetime},
+				pcpPeer:       req.pcpPeer,
+			}
+			ok, _ := resp.MarshalBinary()
+			return [][]byte{wrong, ok}
+		},
+	})
+	p, err := s.client().Peer(context.Background(), "udp", 5060, remote, time.Hour)
+	if err != nil {
+		t.Fatalf("Peer() got err: %v", err)
+	}
+	if p.Remote != remote {
+		t.Errorf("Remote=%v, want %v", p.Remote, remote)
+	}
+}
+
+func TestPeerContext(t *testing.T) {
+	// The gateway never answers.
+	s := newPCPServer(t, &pcpServer{respondPeer: func(pcpPeerReq) [][]byte { return nil }})
+	c := s.client(Timeout(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Peer(ctx, "udp", 5060, netip.MustParseAddrPort("192.0.2.1:5060"), time.Hour)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Peer() got err=%v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Peer() took %s after the context was done", elapsed)
+	}
+}
+
+func TestKeepPeer(t *testing.T) {
+	// Granting a one second lifetime causes a renewal every 500ms.
+	s := newPCPServer(t, &pcpServer{grantLifetime: 1})
+	c := s.client()
+	p, err := c.Peer(context.Background(), "tcp", 443, netip.MustParseAddrPort("[2001:db8::2]:443"), time.Hour)
+	if err != nil {
+		t.Fatalf("Peer() got err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var renewals atomic.Int32
+	done := make(chan error)
+	go func() {
+		done <- c.KeepPeer(ctx, p, time.Hour, func(*PeerMapping) {
+			if renewals.Add(1) == 2 {
+				cancel()
+			}
+		})
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("KeepPeer() got err=%v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("KeepPeer() did not return")
+	}
+	if n := len(s.peerRequests()); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
@@ -0,0 +1,123 @@
+package natpmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PortPolicy decides which external ports are requested for a mapping and
+// whether a different port granted by the gateway is acceptable.
+// The zero value accepts any port, preferring the internal port.
+type PortPolicy struct {
+	ports     []int
+	acceptAny bool
+}
+
+// ExactPort returns a PortPolicy which only accepts the given external port.
+func ExactPort(port int) PortPolicy {
+	return PortPolicy{ports: []int{port}}
+}
+
+// AnyPort returns a PortPolicy which requests the given external port but
+// accepts whichever port the gateway grants.
+func AnyPort(preferred int) PortPolicy {
+	return PortPolicy{ports: []int{preferred}, acceptAny: true}
+}
+
+// PreferredPorts returns a PortPolicy which tries each of the ports in order
+// and only accepts a mapping to one of them.
+func PreferredPorts(ports ...int) PortPolicy {
+	return PortPolicy{ports: ports}
+}
+
+// PortRange returns a PortPolicy which tries each port from first to last
+// (inclusive) in order and only accepts a mapping to one of them.
+func PortRange(first, last int) PortPolicy {
+	var ports []int
+	for p := first; p <= last; p++ {
+		ports = append(ports, p)
+	}
+	return PortPolicy{ports: ports}
+}
+
+func (p PortPolicy) candidates(internalPort int) []int {
+	if len(p.ports) == 0 {
+		return []int{internalPort}
+	}
+	return p.ports
+}
+
+// renewal returns the policy for renewing a mapping to the port: it asks
+// for that port first, and allows the same ports as p.
+func (p PortPolicy) renewal(port int) PortPolicy {
+	if p.acceptAny || len(p.ports) == 0 {
+		return AnyPort(port)
+	}
+	ports := []int{port}
+	for _, q := range p.ports {
+		if q != port {
+			ports = append(ports, q)
+		}
+	}
+	return PortPolicy{ports: ports}
+}
+
+func (p PortPolicy) String() string {
+	switch {
+	case len(p.ports) == 0:
+		return "any port"
+	case p.acceptAny:
+		return fmt.Sprintf("any port (prefer %d)", p.ports[0])
+	case len(p.ports) == 1:
+		return fmt.Sprintf("exact port %d", p.ports[0])
+	}
+	return fmt.Sprintf("one of ports %v", p.ports)
+}
+
+// ErrPortUnavailable is matched (using errors.Is) by the error returned when
+// none of the ports allowed by a PortPolicy could be mapped.
+var ErrPortUnavailable = errors.New("requested external port unavailable")
+
+// PortUnavailableErr is returned by AddPortMappingWithPolicy when the gateway
+// did not grant any of the ports allowed by the PortPolicy.
+type PortUnavailableErr struct {
+	Policy PortPolicy
+	// Granted is the last port the gateway offered instead.
+	Granted uint16
+}
+
+func (e *PortUnavailableErr) Is(err error) bool { return err == ErrPortUnavailable }
+
+func (e *PortUnavailableErr) Error() string {
+	return fmt.Sprintf("error gateway did not grant %s (offered %d)", e.Policy, e.Granted)
+}
+
+// AddPortMappingWithPolicy adds a port mapping for the internal port using
+// the external ports allowed by the policy. When the gateway grants a port
+// the policy does not allow, that mapping is deleted before the next port
+// is tried, since the gateway keeps one mapping per internal port.
+func (c *Client) AddPortMappingWithPolicy(protocol string, internalPort int, policy PortPolicy, lifetime time.Duration) (*PortMapping, error) {
+	return c.addPortMappingWithPolicy(context.Background(), protocol, internalPort, policy, lifetime)
+}
+
+// addPortMappingWithPolicy is AddPortMappingWithPolicy. Cancelling ctx
+// abandons the requests.
+func (c *Client) addPortMappingWithPolicy(ctx context.Context, protocol string, internalPort int, policy PortPolicy, lifetime time.Duration) (*PortMapping, error) {
+	var granted uint16
+	for _, port := range policy.candidates(internalPort) {
+		mapping, err := c.addPortMappingContext(ctx, protocol, internalPort, port, lifetime)
+		if err != nil {
+			return nil, err
+		}
+		if policy.acceptAny || len(policy.ports) == 0 || int(mapping.MappedExternalPort) == port {
+			return mapping, nil
+		}
+		granted = mapping.MappedExternalPort
+		if _, err := c.addPortMappingContext(ctx, protocol, internalPort, 0, 0); err != nil {
+			return nil, fmt.Errorf("error deleting unwanted mapping to port %d: %w", granted, err)
+		}
+	}
+	return nil, &PortUnavailableErr{Policy: policy, Granted: granted}
+}
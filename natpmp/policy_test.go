@@ -0,0 +1,89 @@
+package natpmp
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAddPortMappingWithPolicy(t *testing.T) {
+	// The gateway only grants ports 2000 and above.
+	grantPort := func(requested uint16) uint16 {
+		if requested < 2000 {
+			return 2000 + requested
+		}
+		return requested
+	}
+	testCases := []struct {
+		name      string
+		policy    PortPolicy
+		wantPort  uint16
+		wantErr   error
+		wantPorts []uint16
+	}{
+		{
+			name:      "exact granted",
+			policy:    ExactPort(2001),
+			wantPort:  2001,
+			wantPorts: []uint16{2001},
+		},
+		{
+			name:      "exact refused",
+			policy:    ExactPort(1001),
+			wantErr:   ErrPortUnavailable,
+			wantPorts: []uint16{1001, 0},
+		},
+		{
+			name:      "any",
+			policy:    AnyPort(1001),
+			wantPort:  3001,
+			wantPorts: []uint16{1001},
+		},
+		{
+			name:      "zero value uses internal port",
+			policy:    PortPolicy{},
+			wantPort:  2080,
+			wantPorts: []uint16{80},
+		},
+		{
+			name:      "preferred fallback",
+			policy:    PreferredPorts(1001, 1002, 2003),
+			wantPort:  2003,
+			wantPorts: []uint16{1001, 0, 1002, 0, 2003},
+		},
+		{
+			name:      "range exhausted",
+			policy:    PortRange(1998, 1999),
+			wantErr:   ErrPortUnavailable,
+			wantPorts: []uint16{1998, 0, 1999, 0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := &fakeGateway{grantPort: grantPort}
+			c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw))
+
+			got, err := c.AddPortMappingWithPolicy("tcp", 80, tc.policy, time.Hour)
+			switch {
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("err=%v != %v", err, tc.wantErr)
+				}
+			case err != nil:
+				t.Errorf("got err: %v", err)
+			case got.MappedExternalPort != tc.wantPort:
+				t.Errorf("MappedExternalPort=%d != %d", got.MappedExternalPort, tc.wantPort)
+			}
+
+			var gotPorts []uint16
+			for _, r := range gw.mappingRequests() {
+				gotPorts = append(gotPorts, r.SuggestedExternalPort)
+			}
+			if !slices.Equal(gotPorts, tc.wantPorts) {
+				t.Errorf("requested ports %v != %v", gotPorts, tc.wantPorts)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package natpmp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxRangeAttempts is the number of external bases MapRange tries before
+// giving up on a contiguous block.
+const maxRangeAttempts = 4
+
+// RangeMapping holds the result of calling MapRange.
+type RangeMapping struct {
+	Protocol      string
+	InternalStart uint16
+	ExternalStart uint16
+	Count         int
+	// Mappings holds the mapping for each port in the block, in order.
+	Mappings []*PortMapping
+}
+
+// ErrRangeUnavailable is matched (using errors.Is) by the error returned
+// by MapRange when no contiguous block of external ports could be mapped.
+var ErrRangeUnavailable = errors.New("contiguous external port range unavailable")
+
+// MapRange maps count contiguous internal ports starting at internalStart
+// to a contiguous block of external ports, starting at externalStart if the
+// gateway allows. If the gateway grants ports which are not contiguous, every
+// mapping in the block is deleted and the block is tried again at the base
+// the gateway suggested (or just past the block), a few times, before
+// ErrRangeUnavailable is returned. No partial mappings are left behind when
+// an error is returned.
+func (c *Client) MapRange(protocol string, internalStart, count, externalStart int, lifetime time.Duration) (*RangeMapping, error) {
+	if count <= 0 || internalStart <= 0 || internalStart+count-1 > 0xFFFF {
+		return nil, fmt.Errorf("invalid internal port range %d+%d", internalStart, count)
+	}
+	base := externalStart
+	for attempt := 0; attempt < maxRangeAttempts; attempt++ {
+		if base <= 0 || base+count-1 > 0xFFFF {
+			break
+		}
+		reqs := make([]MappingRequest, count)
+		for i := range reqs {
+			reqs[i] = MappingRequest{protocol, internalStart + i, base + i, lifetime}
+		}
+		results, err := c.AddPortMappings(reqs)
+		if err != nil {
+			return nil, err
+		}
+		mappings, err := rangeMappings(results)
+		if err == nil {
+			next, ok := contiguous(mappings)
+			if ok {
+				return &RangeMapping{
+					Protocol:      protocol,
+					InternalStart: uint16(internalStart),
+					ExternalStart: mappings[0].MappedExternalPort,
+					Count:         count,
+					Mappings:      mappings,
+				}, nil
+			}
+			if next == base {
+				next = base + count
+			}
+			base = next
+		}
+		if rerr := c.rollback(protocol, results); rerr != nil {
+			return nil, errors.Join(err, rerr)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %s %d+%d", ErrRangeUnavailable, protocol, internalStart, count)
+}
+
+// DeleteRange deletes every mapping in the block.
+func (c *Client) DeleteRange(r *RangeMapping) error {
+	reqs := make([]MappingRequest, r.Count)
+	for i := range reqs {
+		reqs[i] = MappingRequest{Protocol: r.Protocol, InternalPort: int(r.InternalStart) + i}
+	}
+	results, err := c.AddPortMappings(reqs)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, res := range results {
+		errs = append(errs, res.Err)
+	}
+	return errors.Join(errs...)
+}
+
+func rangeMappings(results []MappingResult) ([]*PortMapping, error) {
+	mappings := make([]*PortMapping, len(results))
+	for i, r := range results {
+		if r.Err != nil {
+			return nil, fmt.Errorf("error mapping port %d: %w", r.Request.InternalPort, r.Err)
+		}
+		mappings[i] = r.Mapping
+	}
+	return mappings, nil
+}
+
+// contiguous reports whether the mapped external ports are contiguous.
+// If they are not, it returns the base to try next: the first granted
+// port, which is where the gateway is willing to start.
+func contiguous(mappings []*PortMapping) (next int, ok bool) {
+	first := int(mappings[0].MappedExternalPort)
+	for i, m := range mappings {
+		if int(m.MappedExternalPort) != first+i {
+			return first, false
+		}
+	}
+	return 0, true
+}
+
+// rollback deletes every mapping which was created in the results.
+func (c *Client) rollback(protocol string, results []MappingResult) error {
+	var reqs []MappingRequest
+	for _, r := range results {
+		if r.Err == nil {
+			reqs = append(reqs, MappingRequest{Protocol: protocol, InternalPort: r.Request.InternalPort})
+		}
+	}
+	if len(reqs) == 0 {
+		return nil
+	}
+	deleted, err := c.AddPortMappings(reqs)
+	if err != nil {
+		return fmt.Errorf("error rolling back port range: %w", err)
+	}
+	var errs []error
+	for _, r := range deleted {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("error rolling back port %d: %w", r.Request.InternalPort, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
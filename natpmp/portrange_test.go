@@ -0,0 +1,94 @@
+package natpmp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+func TestMapRange(t *testing.T) {
+	testCases := []struct {
+		name      string
+		grantPort func(requested uint16) uint16
+		wantStart uint16
+		wantErr   error
+	}{
+		{
+			name:      "granted as requested",
+			wantStart: 20000,
+		},
+		{
+			name: "retry at suggested base",
+			// The gateway only grants ports from 30000.
+			grantPort: func(requested uint16) uint16 {
+				if requested < 30000 {
+					return requested + 10000
+				}
+				return requested
+			},
+			wantStart: 30000,
+		},
+		{
+			name: "rollback",
+			// Every fourth port is in use, so no block of 4 is contiguous.
+			grantPort: func(requested uint16) uint16 {
+				if requested%4 == 2 {
+					return requested + 1000
+				}
+				return requested
+			},
+			wantErr: ErrRangeUnavailable,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := &fakeGateway{grantPort: tc.grantPort}
+			c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw))
+
+			r, err := c.MapRange("udp", 10000, 4, 20000, time.Hour)
+			live := liveMappings(gw.mappingRequests())
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("err=%v != %v", err, tc.wantErr)
+				}
+				if len(live) != 0 {
+					t.Errorf("mappings left after rollback: %v", live)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MapRange() got err: %v", err)
+			}
+			if r.ExternalStart != tc.wantStart || len(r.Mappings) != 4 {
+				t.Errorf("MapRange()=%+v, want start %d", r, tc.wantStart)
+			}
+			if len(live) != 4 {
+				t.Errorf("live mappings %v, want 4", live)
+			}
+
+			if err := c.DeleteRange(r); err != nil {
+				t.Fatalf("DeleteRange() got err: %v", err)
+			}
+			if live := liveMappings(gw.mappingRequests()); len(live) != 0 {
+				t.Errorf("mappings left after DeleteRange: %v", live)
+			}
+		})
+	}
+}
+
+// liveMappings replays the mapping requests and returns the internal ports
+// which are still mapped.
+func liveMappings(reqs []wire.MappingRequest) map[uint16]bool {
+	live := map[uint16]bool{}
+	for _, r := range reqs {
+		if r.LifetimeSecs == 0 {
+			delete(live, r.InternalPort)
+		} else {
+			live[r.InternalPort] = true
+		}
+	}
+	return live
+}
@@ -0,0 +1,86 @@
+package natpmp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+)
+
+// Limiter is a token bucket which paces the requests sent to a gateway, as
+// some gateways fail bursts with Out of Resources. It allows burst requests
+// at once, then one every interval. Clients for the same gateway share a
+// Limiter using WithLimiter. It is safe for concurrent use.
+type Limiter struct {
+	every time.Duration
+	burst int
+
+	mu sync.Mutex
+	// tokens is the number of requests which may be sent at last. It is
+	// negative when requests are waiting for tokens.
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter which allows burst requests at once, then
+// one every interval. A burst less than 1 is taken as 1.
+func NewLimiter(every time.Duration, burst int) *Limiter {
+	burst = max(burst, 1)
+	return &Limiter{every: every, burst: burst, tokens: float64(burst)}
+}
+
+// reserve takes a token, returning how long to wait before it may be used.
+func (l *Limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.every <= 0 {
+		return 0
+	}
+	if !l.last.IsZero() && now.After(l.last) {
+		l.tokens += float64(now.Sub(l.last)) / float64(l.every)
+		l.tokens = min(l.tokens, float64(l.burst))
+	}
+	if l.last.IsZero() || now.After(l.last) {
+		l.last = now
+	}
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens * float64(l.every))
+}
+
+// unreserve gives back a token taken by reserve for a request which was
+// not sent.
+func (l *Limiter) unreserve() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.every > 0 {
+		l.tokens = min(l.tokens+1, float64(l.burst))
+	}
+}
+
+// wait blocks until a request may be sent, or until ctx is done, in which
+// case the request gives back its token.
+func (l *Limiter) wait(ctx context.Context, c clock.Clock) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d := l.reserve(c.Now())
+	if d <= 0 {
+		return nil
+	}
+	timer := c.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		l.unreserve()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,204 @@
+package natpmp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/clock/clocktest"
+)
+
+func TestLimiter(t *testing.T) {
+	start := time.Unix(1e9, 0)
+	testCases := []struct {
+		name  string
+		every time.Duration
+		burst int
+		// at are the times of the requests, relative to start.
+		at   []time.Duration
+		want []time.Duration
+	}{
+		{
+			name:  "burst",
+			every: time.Second,
+			burst: 2,
+			at:    []time.Duration{0, 0, 0, 0},
+			want:  []time.Duration{0, 0, time.Second, 2 * time.Second},
+		},
+		{
+			name:  "refill",
+			every: time.Second,
+			burst: 2,
+			at:    []time.Duration{0, 0, 500 * time.Millisecond, 10 * time.Second, 10 * time.Second, 10 * time.Second},
+			want:  []time.Duration{0, 0, 500 * time.Millisecond, 0, 0, time.Second},
+		},
+		{
+			name:  "unlimited",
+			every: 0,
+			at:    []time.Duration{0, 0, 0},
+			want:  []time.Duration{0, 0, 0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewLimiter(tc.every, tc.burst)
+			for i, at := range tc.at {
+				if got := l.reserve(start.Add(at)); got != tc.want[i] {
+					t.Errorf("request %d at %s waits %s, want %s", i, at, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1e9, 0))
+	g := &fakeGateway{clock: fake}
+	c := NewClient(net.IPv4(192, 168, 1, 1), WithTransport(g), WithClock(fake), RateLimit(time.Second, 1))
+
+	done := make(chan error)
+	go func() {
+		for port := 1000; port < 1003; port++ {
+			if _, err := c.AddPortMapping("udp", port, port, time.Hour); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for range 2 {
+		clocktest.WaitTimers(t, fake, 1)
+		fake.Advance(time.Second)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("AddPortMapping() failed: %v", err)
+	}
+	sent := g.sendTimes()
+	if len(sent) != 3 {
+		t.Fatalf("sent %d requests, want 3", len(sent))
+	}
+	for i := 1; i < len(sent); i++ {
+		if gap := sent[i].Sub(sent[i-1]); gap != time.Second {
+			t.Errorf("request %d sent %s after the previous, want 1s", i, gap)
+		}
+	}
+}
+
+func TestRateLimitCancel(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1e9, 0))
+	g := &fakeGateway{clock: fake}
+	c := NewClient(net.IPv4(192, 168, 1, 1), WithTransport(g), WithClock(fake), RateLimit(time.Hour, 1), CacheExternalAddress(time.Minute))
+	if _, _, err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() failed: %v", err)
+	}
+
+	// The next request waits an hour for the Limiter.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := c.Refresh(ctx)
+		done <- err
+	}()
+	clocktest.WaitTimers(t, fake, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Refresh() err=%v, want context.Canceled", err)
+	}
+	// The abandoned request gave back its token.
+	fake.Advance(time.Hour)
+	if d := c.limiter.reserve(fake.Now()); d != 0 {
+		t.Errorf("next request waits %s, want 0", d)
+	}
+}
+
+// gatedTransport counts the requests sent, and holds each one until the
+// gate is opened.
+type gatedTransport struct {
+	Transport
+	gate chan struct{}
+
+	mu   sync.Mutex
+	sent int
+}
+
+func (g *gatedTransport) Send(req, resp []byte, deadline time.Time) ([]byte, net.IP, error) {
+	g.mu.Lock()
+	g.sent++
+	g.mu.Unlock()
+	<-g.gate
+	return g.Transport.Send(req, resp, deadline)
+}
+
+func (g *gatedTransport) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.sent
+}
+
+func TestCoalesce(t *testing.T) {
+	const callers = 10
+	testCases := []struct {
+		name     string
+		coalesce bool
+		wantSent int
+	}{
+		{name: "shared", coalesce: true, wantSent: 1},
+		{name: "disabled", coalesce: false, wantSent: callers},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gt := &gatedTransport{Transport: &fakeGateway{extAddr: [4]byte{203, 0, 113, 5}}, gate: make(chan struct{})}
+			c := NewClient(net.IPv4(192, 168, 1, 1), WithTransport(gt), Coalesce(tc.coalesce))
+
+			var wg sync.WaitGroup
+			errs := make(chan error, callers)
+			for range callers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					addr, _, err := c.GetExternalAddress()
+					if err == nil && addr != netip.MustParseAddr("203.0.113.5") {
+						t.Errorf("GetExternalAddress()=%v", addr)
+					}
+					errs <- err
+				}()
+			}
+			// Wait until a request is sent, and with coalescing until every
+			// caller shares it. Without, the Client sends them one by one.
+			deadline := time.Now().Add(5 * time.Second)
+			for gt.count() == 0 || (tc.coalesce && flightRefs(c) < callers) {
+				if time.Now().After(deadline) {
+					t.Fatalf("callers did not start: sent=%d refs=%d", gt.count(), flightRefs(c))
+				}
+				time.Sleep(time.Millisecond)
+			}
+			close(gt.gate)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Errorf("GetExternalAddress() failed: %v", err)
+				}
+			}
+			if got := gt.count(); got != tc.wantSent {
+				t.Errorf("sent %d requests, want %d", got, tc.wantSent)
+			}
+		})
+	}
+}
+
+// flightRefs returns the callers sharing the flights in progress.
+func flightRefs(c *Client) int {
+	c.flightsMu.Lock()
+	defer c.flightsMu.Unlock()
+	n := 0
+	for _, f := range c.flights {
+		n += f.refs
+	}
+	return n
+}
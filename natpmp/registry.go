@@ -0,0 +1,266 @@
+package natpmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrMappingOwned is matched (using errors.Is) by the error returned when
+// another process on this host owns the mapping for an internal port.
+var ErrMappingOwned = errors.New("mapping owned by another process")
+
+// OwnedErr is returned when a Registry claim is held by another process.
+// The gateway keeps one mapping per internal port and protocol, so a second
+// process asking for it would silently renew or take over the first's.
+// Owner.PID is 0 when the owner has not finished writing its claim.
+type OwnedErr struct {
+	Owner Owner
+}
+
+func (e *OwnedErr) Is(err error) bool { return err == ErrMappingOwned }
+
+func (e *OwnedErr) Error() string {
+	if e.Owner.PID == 0 {
+		return fmt.Sprintf("error %s port %d on %s is owned by another process", e.Owner.Protocol, e.Owner.InternalPort, e.Owner.Gateway)
+	}
+	return fmt.Sprintf("error %s port %d on %s is owned by pid %d", e.Owner.Protocol, e.Owner.InternalPort, e.Owner.Gateway, e.Owner.PID)
+}
+
+// Owner describes a mapping claimed in a Registry.
+type Owner struct {
+	PID          int        `json:"pid"`
+	Gateway      netip.Addr `json:"gateway"`
+	Protocol     string     `json:"protocol"`
+	InternalPort uint16     `json:"internal_port"`
+	// ExternalPort is the port granted by the gateway, or 0 before the
+	// mapping is made.
+	ExternalPort uint16    `json:"external_port"`
+	Claimed      time.Time `json:"claimed"`
+	// Stale is set by List when the owning process has exited without
+	// releasing the claim. Its mapping may still be live on the gateway
+	// until the lifetime runs out.
+	Stale bool `json:"-"`
+}
+
+// Registry records which processes on this host own which mappings, since
+// NAT-PMP has no way to list the mappings on a gateway. Each claim is a
+// file in Dir, locked for as long as the owning process holds it, so the
+// claim is freed when the process exits however it exits.
+type Registry struct {
+	Dir string
+}
+
+// DefaultRegistry returns the Registry shared by processes of this user,
+// in $XDG_RUNTIME_DIR/natpmp, or a per-user temporary directory when
+// XDG_RUNTIME_DIR is not set.
+func DefaultRegistry() *Registry {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return &Registry{Dir: filepath.Join(dir, "natpmp")}
+	}
+	return &Registry{Dir: filepath.Join(os.TempDir(), fmt.Sprintf("natpmp-%d", os.Getuid()))}
+}
+
+const claimSuffix = ".claim"
+
+func (r *Registry) path(gateway netip.Addr, protocol string, internalPort uint16) string {
+	return filepath.Join(r.Dir, fmt.Sprintf("%s-%s-%d%s", gateway, protocol, internalPort, claimSuffix))
+}
+
+// Claim is a mapping owned by this process.
+type Claim struct {
+	f     *os.File
+	path  string
+	owner Owner
+}
+
+// Claim takes ownership of the mapping for the internal port on the
+// gateway. It returns an *OwnedErr when another process holds it; a claim
+// left by a process which has exited is taken over.
+func (r *Registry) Claim(gateway netip.Addr, protocol string, internalPort uint16) (*Claim, error) {
+	if err := os.MkdirAll(r.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	path := r.path(gateway, protocol, internalPort)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if !locked {
+			owner, err := readOwner(f)
+			f.Close()
+			if err != nil {
+				// The owner is still writing its claim.
+				owner = Owner{Gateway: gateway, Protocol: protocol, InternalPort: internalPort}
+			}
+			return nil, &OwnedErr{Owner: owner}
+		}
+		// The previous owner may have removed the file between our open
+		// and lock, leaving us holding a lock on an unlinked file.
+		if !samePath(f, path) {
+			f.Close()
+			continue
+		}
+		c := &Claim{f: f, path: path, owner: Owner{
+			PID:          os.Getpid(),
+			Gateway:      gateway,
+			Protocol:     protocol,
+			InternalPort: internalPort,
+			Claimed:      time.Now(),
+		}}
+		if err := c.write(); err != nil {
+			c.Release()
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+func samePath(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	return err == nil && os.SameFile(fi, pi)
+}
+
+// SetExternalPort records the external port granted by the gateway.
+func (c *Claim) SetExternalPort(port uint16) error {
+	if c.owner.ExternalPort == port {
+		return nil
+	}
+	c.owner.ExternalPort = port
+	return c.write()
+}
+
+func (c *Claim) write() error {
+	b, err := json.Marshal(c.owner)
+	if err != nil {
+		return err
+	}
+	if err := c.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = c.f.WriteAt(b, 0)
+	return err
+}
+
+// Release gives up the claim.
+func (c *Claim) Release() error {
+	err := os.Remove(c.path)
+	return errors.Join(err, c.f.Close())
+}
+
+func readOwner(f *os.File) (Owner, error) {
+	var owner Owner
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		return owner, err
+	}
+	if err := json.Unmarshal(b, &owner); err != nil {
+		return owner, fmt.Errorf("error parsing %s: %w", f.Name(), err)
+	}
+	return owner, nil
+}
+
+// List returns the claims in the registry. Claims whose owner has exited
+// are marked Stale.
+func (r *Registry) List() ([]Owner, error) {
+	entries, err := os.ReadDir(r.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var owners []Owner
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), claimSuffix) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(r.Dir, e.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue // released while listing
+		}
+		if err != nil {
+			return nil, err
+		}
+		owner, err := readOwner(f)
+		if err == nil {
+			var locked bool
+			locked, err = tryLock(f)
+			owner.Stale = locked
+		}
+		f.Close()
+		if err != nil {
+			continue // being written, or released while listing
+		}
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+// claim takes ownership of a mapping before it is added or deleted, when the
+// Client has a Registry. A mapping already claimed by this Client is kept;
+// fresh reports whether the claim was made by this call.
+func (c *Client) claim(protocol string, internalPort uint16) (fresh bool, err error) {
+	if c.registry == nil {
+		return false, nil
+	}
+	key := claimKey{protocol, internalPort}
+	c.claimsMu.Lock()
+	defer c.claimsMu.Unlock()
+	if _, ok := c.claims[key]; ok {
+		return false, nil
+	}
+	gw, _ := netip.AddrFromSlice(c.gatewayIP)
+	cl, err := c.registry.Claim(gw.Unmap(), protocol, internalPort)
+	if err != nil {
+		return false, err
+	}
+	if c.claims == nil {
+		c.claims = make(map[claimKey]*Claim)
+	}
+	c.claims[key] = cl
+	return true, nil
+}
+
+// updateClaim records the mapping granted by the gateway, or releases the
+// claim once the mapping is deleted. A fresh claim is also released when
+// the mapping could not be made (m is nil).
+func (c *Client) updateClaim(protocol string, internalPort uint16, fresh bool, m *PortMapping) error {
+	if c.registry == nil {
+		return nil
+	}
+	key := claimKey{protocol, internalPort}
+	c.claimsMu.Lock()
+	defer c.claimsMu.Unlock()
+	cl, ok := c.claims[key]
+	switch {
+	case !ok:
+		return nil
+	case m != nil && m.RequestedLifetime != 0:
+		return cl.SetExternalPort(m.MappedExternalPort)
+	case m == nil && !fresh:
+		return nil
+	}
+	delete(c.claims, key)
+	return cl.Release()
+}
+
+type claimKey struct {
+	protocol     string
+	internalPort uint16
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package natpmp
+
+import "os"
+
+// tryLock always succeeds where file locks are not supported, so a
+// Registry records owners but does not keep processes apart.
+func tryLock(*os.File) (bool, error) { return true, nil }
@@ -0,0 +1,149 @@
+package natpmp
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistryClaim(t *testing.T) {
+	dir := t.TempDir()
+	gw := netip.MustParseAddr("10.0.0.1")
+	// Separate Registry values stand in for separate processes.
+	r1, r2 := &Registry{Dir: dir}, &Registry{Dir: dir}
+
+	c1, err := r1.Claim(gw, "udp", 123)
+	if err != nil {
+		t.Fatalf("Claim() got err: %v", err)
+	}
+	if err := c1.SetExternalPort(456); err != nil {
+		t.Fatalf("SetExternalPort() got err: %v", err)
+	}
+	_, err = r2.Claim(gw, "udp", 123)
+	var owned *OwnedErr
+	if !errors.As(err, &owned) || !errors.Is(err, ErrMappingOwned) {
+		t.Fatalf("second Claim() got err=%v, want OwnedErr", err)
+	}
+	if owned.Owner.PID != os.Getpid() || owned.Owner.ExternalPort != 456 {
+		t.Errorf("owner=%+v", owned.Owner)
+	}
+	if _, err := r2.Claim(gw, "tcp", 123); err != nil {
+		t.Errorf("Claim() of other protocol got err: %v", err)
+	}
+
+	if err := c1.Release(); err != nil {
+		t.Fatalf("Release() got err: %v", err)
+	}
+	if _, err := r2.Claim(gw, "udp", 123); err != nil {
+		t.Errorf("Claim() after Release got err: %v", err)
+	}
+}
+
+func TestRegistryClaimUnwritten(t *testing.T) {
+	dir := t.TempDir()
+	r := &Registry{Dir: dir}
+	// Another process has created and locked its claim, but not yet
+	// written it.
+	f, err := os.Create(filepath.Join(dir, "10.0.0.1-udp-123.claim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if locked, err := tryLock(f); !locked || err != nil {
+		t.Fatalf("tryLock()=%t, %v", locked, err)
+	}
+	if !lockSupported(t, f.Name()) {
+		t.Skip("file locks are not supported")
+	}
+	_, err = r.Claim(netip.MustParseAddr("10.0.0.1"), "udp", 123)
+	var owned *OwnedErr
+	if !errors.As(err, &owned) {
+		t.Fatalf("Claim() got err=%v, want OwnedErr", err)
+	}
+	if owned.Owner.PID != 0 || owned.Owner.InternalPort != 123 {
+		t.Errorf("owner=%+v, want an unknown owner of port 123", owned.Owner)
+	}
+}
+
+// lockSupported reports whether the file, locked by the caller, is kept
+// from being locked again.
+func lockSupported(t *testing.T, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	locked, _ := tryLock(f)
+	return !locked
+}
+
+func TestRegistryList(t *testing.T) {
+	dir := t.TempDir()
+	r := &Registry{Dir: dir}
+	if _, err := r.Claim(netip.MustParseAddr("10.0.0.1"), "tcp", 80); err != nil {
+		t.Fatalf("Claim() got err: %v", err)
+	}
+	// A claim left by a process which exited is unlocked.
+	leaked := `{"pid": 99999, "gateway": "10.0.0.1", "protocol": "udp", "internal_port": 53, "external_port": 5353}`
+	if err := os.WriteFile(filepath.Join(dir, "10.0.0.1-udp-53.claim"), []byte(leaked), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	owners, err := r.List()
+	if err != nil {
+		t.Fatalf("List() got err: %v", err)
+	}
+	if len(owners) != 2 {
+		t.Fatalf("List()=%+v, want 2 owners", owners)
+	}
+	for _, o := range owners {
+		switch o.InternalPort {
+		case 80:
+			if o.Stale || o.PID != os.Getpid() {
+				t.Errorf("live owner=%+v", o)
+			}
+		case 53:
+			if !o.Stale || o.PID != 99999 || o.ExternalPort != 5353 {
+				t.Errorf("leaked owner=%+v", o)
+			}
+		}
+	}
+}
+
+func TestClientRegistry(t *testing.T) {
+	dir := t.TempDir()
+	newClient := func() *Client {
+		return NewClient(net.ParseIP("10.0.0.1"), WithTransport(&fakeGateway{}), WithRegistry(&Registry{Dir: dir}))
+	}
+	c1, c2 := newClient(), newClient()
+
+	if _, err := c1.AddPortMapping("udp", 123, 456, time.Hour); err != nil {
+		t.Fatalf("AddPortMapping() got err: %v", err)
+	}
+	// Renewals by the owner are allowed.
+	if _, err := c1.AddPortMapping("udp", 123, 456, time.Hour); err != nil {
+		t.Fatalf("renewing AddPortMapping() got err: %v", err)
+	}
+	if _, err := c2.AddPortMapping("udp", 123, 789, time.Hour); !errors.Is(err, ErrMappingOwned) {
+		t.Fatalf("AddPortMapping() by second client got err=%v, want ErrMappingOwned", err)
+	}
+	if err := c2.DeletePortMapping("udp", 123); !errors.Is(err, ErrMappingOwned) {
+		t.Fatalf("DeletePortMapping() by second client got err=%v, want ErrMappingOwned", err)
+	}
+
+	owners, _ := (&Registry{Dir: dir}).List()
+	if len(owners) != 1 || owners[0].ExternalPort != 456 {
+		t.Errorf("List()=%+v", owners)
+	}
+
+	if err := c1.DeletePortMapping("udp", 123); err != nil {
+		t.Fatalf("DeletePortMapping() got err: %v", err)
+	}
+	if _, err := c2.AddPortMapping("udp", 123, 789, time.Hour); err != nil {
+		t.Errorf("AddPortMapping() after delete got err: %v", err)
+	}
+}
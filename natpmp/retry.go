@@ -3,38 +3,100 @@ package natpmp
 import (
 	"fmt"
 	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+)
+
+// RFC 6886 section 3.1: the client waits 250ms for the first response and
+// doubles the wait after each retransmission, for 9 attempts in total
+// (about 128 seconds) before giving up.
+const (
+	initialPause = 250 * time.Millisecond
+	maxAttempts  = 9
 )
 
-// retry will retry the
+// RetryStats describes the attempts made to get a response from the gateway.
+type RetryStats struct {
+	// Attempts is the number of times the request was sent, including
+	// the first.
+	Attempts int
+	// Elapsed is the time from the first attempt until the response,
+	// or until giving up.
+	Elapsed time.Duration
+}
+
+// TimeoutErr is returned when the gateway did not respond in time.
+// It is a net.Error whose Timeout method returns true.
+type TimeoutErr struct {
+	RetryStats
+}
+
+func (e *TimeoutErr) Error() string {
+	return fmt.Sprintf("Timed out trying to contact gateway after %d attempts (%s)", e.Attempts, e.Elapsed)
+}
+
+func (e *TimeoutErr) Timeout() bool   { return true }
+func (e *TimeoutErr) Temporary() bool { return true }
+
+// retry runs a request on the RFC 6886 retransmission schedule.
 type retry struct {
-	initial        time.Duration
-	timeout        time.Duration
-	maxRetries     int
+	clock       clock.Clock
+	initial     time.Duration
+	maxAttempts int
+	// timeout, if non-zero, is the overall deadline for all attempts.
+	timeout time.Duration
+	// maxPause, if non-zero, caps the time waited for any one attempt.
+	maxPause time.Duration
+	// retryImmediate reports errors which are ignored: the attempt is
+	// repeated with the same deadline.
 	retryImmediate func(error) bool
-	retryDelay     func(error) bool
+	// retryDelay reports errors which end the attempt: the next attempt
+	// waits twice as long.
+	retryDelay func(error) bool
 }
 
-func (r *retry) run(fn func(deadline time.Time) error) error {
+// pause returns the time to wait for a response to the attempt (0-based).
+func (r *retry) pause(attempt int) time.Duration {
+	p := r.initial << attempt
+	if r.maxPause != 0 && p > r.maxPause {
+		p = r.maxPause
+	}
+	return p
+}
+
+// run calls fn once per attempt with the deadline for the attempt, until it
+// succeeds, returns an error which is not retried, or the attempts or
+// overall timeout are used up.
+func (r *retry) run(fn func(deadline time.Time) error) (RetryStats, error) {
+	start := r.clock.Now()
 	var finalDeadline time.Time
 	if r.timeout != 0 {
-		finalDeadline = time.Now().Add(r.timeout)
+		finalDeadline = start.Add(r.timeout)
 	}
-	nextDeadline := time.Now().Add(initialPause)
-
-	var tries uint
-	for tries = 0; (tries < maxRetries && finalDeadline.IsZero()) || time.Now().Before(finalDeadline); {
-		err := fn(minTime(nextDeadline, finalDeadline))
-		if r.retryImmediate != nil && r.retryImmediate(err) {
-			continue
+	var stats RetryStats
+	for stats.Attempts < r.maxAttempts {
+		now := r.clock.Now()
+		if !finalDeadline.IsZero() && !now.Before(finalDeadline) {
+			break
 		}
-		if r.retryDelay != nil && r.retryDelay(err) {
-			tries++
-			nextDeadline = time.Now().Add(initialPause * 1 << tries)
-			continue
+		deadline := minTime(now.Add(r.pause(stats.Attempts)), finalDeadline)
+		stats.Attempts++
+		for {
+			err := fn(deadline)
+			stats.Elapsed = r.clock.Now().Sub(start)
+			if err == nil {
+				return stats, nil
+			}
+			if r.retryImmediate != nil && r.retryImmediate(err) && r.clock.Now().Before(deadline) {
+				continue
+			}
+			if (r.retryImmediate != nil && r.retryImmediate(err)) || (r.retryDelay != nil && r.retryDelay(err)) {
+				break
+			}
+			return stats, err
 		}
-		return err
 	}
-	return fmt.Errorf("Timed out trying to contact gateway")
+	return stats, &TimeoutErr{stats}
 }
 
 func minTime(a, b time.Time) time.Time {
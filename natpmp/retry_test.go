@@ -0,0 +1,123 @@
+package natpmp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+func TestRetrySchedule(t *testing.T) {
+	ms := time.Millisecond
+	testCases := []struct {
+		name string
+		opts []Option
+		// drops is the number of requests lost before the gateway answers,
+		// -1 for all of them.
+		drops        int
+		wantAttempts []time.Duration
+		wantElapsed  time.Duration
+		wantTimeout  bool
+	}{
+		{
+			name:         "RFC 6886 schedule",
+			drops:        -1,
+			wantAttempts: []time.Duration{0, 250 * ms, 750 * ms, 1750 * ms, 3750 * ms, 7750 * ms, 15750 * ms, 31750 * ms, 63750 * ms},
+			wantElapsed:  127750 * ms,
+			wantTimeout:  true,
+		},
+		{
+			name:         "overall deadline",
+			opts:         []Option{Timeout(10 * time.Second)},
+			drops:        -1,
+			wantAttempts: []time.Duration{0, 250 * ms, 750 * ms, 1750 * ms, 3750 * ms, 7750 * ms},
+			wantElapsed:  10 * time.Second,
+			wantTimeout:  true,
+		},
+		{
+			name:         "attempt cap",
+			opts:         []Option{AttemptTimeout(time.Second)},
+			drops:        -1,
+			wantAttempts: []time.Duration{0, 250 * ms, 750 * ms, 1750 * ms, 2750 * ms, 3750 * ms, 4750 * ms, 5750 * ms, 6750 * ms},
+			wantElapsed:  7750 * ms,
+			wantTimeout:  true,
+		},
+		{
+			name:         "Timeout(0) uses the full schedule",
+			opts:         []Option{Timeout(0)},
+			drops:        -1,
+			wantAttempts: []time.Duration{0, 250 * ms, 750 * ms, 1750 * ms, 3750 * ms, 7750 * ms, 15750 * ms, 31750 * ms, 63750 * ms},
+			wantElapsed:  127750 * ms,
+			wantTimeout:  true,
+		},
+		{
+			name:         "answered on third attempt",
+			drops:        2,
+			wantAttempts: []time.Duration{0, 250 * ms, 750 * ms},
+			wantElapsed:  750 * ms,
+		},
+		{
+			name:         "answered at once",
+			wantAttempts: []time.Duration{0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			fake := clock.NewFake(start)
+			dropped := 0
+			gw := &fakeGateway{
+				clock: fake,
+				drop: func(wire.MappingRequest) bool {
+					if tc.drops >= 0 && dropped >= tc.drops {
+						return false
+					}
+					dropped++
+					return true
+				},
+			}
+			opts := append([]Option{WithTransport(gw), WithClock(fake)}, tc.opts...)
+			c := NewClient(net.ParseIP("10.0.0.1"), opts...)
+
+			realStart := time.Now()
+			mapping, err := c.AddPortMapping("udp", 123, 456, time.Hour)
+			if elapsed := time.Since(realStart); elapsed > time.Second {
+				t.Errorf("took %s of real time", elapsed)
+			}
+
+			var stats RetryStats
+			var timeoutErr *TimeoutErr
+			switch {
+			case tc.wantTimeout:
+				if !errors.As(err, &timeoutErr) {
+					t.Fatalf("err=%v, want TimeoutErr", err)
+				}
+				var ne net.Error
+				if !errors.As(err, &ne) || !ne.Timeout() {
+					t.Errorf("err=%v is not a net.Error timeout", err)
+				}
+				stats = timeoutErr.RetryStats
+			case err != nil:
+				t.Fatalf("got err: %v", err)
+			default:
+				stats = mapping.RetryStats
+			}
+			if stats.Attempts != len(tc.wantAttempts) || stats.Elapsed != tc.wantElapsed {
+				t.Errorf("stats=%+v, want %d attempts in %s", stats, len(tc.wantAttempts), tc.wantElapsed)
+			}
+
+			got := gw.sendTimes()
+			if len(got) != len(tc.wantAttempts) {
+				t.Fatalf("got %d attempts, want %d", len(got), len(tc.wantAttempts))
+			}
+			for i, want := range tc.wantAttempts {
+				if d := got[i].Sub(start); d != want {
+					t.Errorf("attempt %d at %s, want %s", i+1, d, want)
+				}
+			}
+		})
+	}
+}
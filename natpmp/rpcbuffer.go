@@ -0,0 +1,26 @@
+package natpmp
+
+import (
+	"sync"
+
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+// maxResponseSize is the size of the response buffer: the largest PCP
+// message (RFC 6887), so that any response longer than expected is
+// reported rather than silently truncated.
+const maxResponseSize = 1100
+
+// rpcBuffer holds the request and response bytes for a single exchange.
+// They are pooled so a renewal loop does not allocate per request.
+type rpcBuffer struct {
+	req  [wire.MappingRequestSize]byte
+	resp [maxResponseSize]byte
+}
+
+var rpcBuffers = sync.Pool{
+	New: func() any { return new(rpcBuffer) },
+}
+
+func getBuffer() *rpcBuffer  { return rpcBuffers.Get().(*rpcBuffer) }
+func putBuffer(b *rpcBuffer) { rpcBuffers.Put(b) }
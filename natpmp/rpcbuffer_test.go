@@ -0,0 +1,68 @@
+package natpmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRPCAllocs checks that an exchange with the gateway does not allocate,
+// apart from the PortMapping returned by AddPortMapping.
+func TestRPCAllocs(t *testing.T) {
+	extAddr := newBenchClient(testCall{
+		req:  []uint8{0x0, 0x0},
+		resp: []uint8{0x0, 0x80, 0x0, 0x0, 0x0, 0x13, 0xf2, 0x4f, 0x49, 0x8c, 0x36, 0x9a},
+	})
+	if n := testing.AllocsPerRun(100, func() { extAddr.GetExternalAddress() }); n != 0 {
+		t.Errorf("GetExternalAddress() allocs=%v, want 0", n)
+	}
+	mapping := newBenchClient(addUDPCall)
+	if n := testing.AllocsPerRun(100, func() { mapping.AddPortMapping("udp", 123, 456, 1200*time.Second) }); n > 1 {
+		t.Errorf("AddPortMapping() allocs=%v, want 1", n)
+	}
+}
+
+var addUDPCall = testCall{
+	req:  []uint8{0x0, 0x1, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+	resp: []uint8{0x0, 0x81, 0x0, 0x0, 0x0, 0x13, 0xfe, 0xff, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+}
+
+func newBenchClient(call testCall) *Client {
+	return NewClient(net.ParseIP("10.0.0.1"), WithTransport(&testTransport{testCall: call}))
+}
+
+func BenchmarkGetExternalAddress(b *testing.B) {
+	c := newBenchClient(testCall{
+		req:  []uint8{0x0, 0x0},
+		resp: []uint8{0x0, 0x80, 0x0, 0x0, 0x0, 0x13, 0xf2, 0x4f, 0x49, 0x8c, 0x36, 0x9a},
+	})
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, _, err := c.GetExternalAddress(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddPortMapping(b *testing.B) {
+	c := newBenchClient(addUDPCall)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := c.AddPortMapping("udp", 123, 456, 1200*time.Second); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAddPortMappingParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		// One client per goroutine, like many simulated clients.
+		c := newBenchClient(addUDPCall)
+		for pb.Next() {
+			if _, err := c.AddPortMapping("udp", 123, 456, 1200*time.Second); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,14 @@
+package natpmp
+
+import (
+	"errors"
+	"net"
+)
+
+// cannotSendFrom reports whether err means the test host cannot send from
+// the requested source address. Plan 9 has no errno values, so any failure
+// to bind or send counts.
+func cannotSendFrom(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
@@ -0,0 +1,14 @@
+//go:build !plan9
+
+package natpmp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// cannotSendFrom reports whether err means the test host cannot send from
+// the requested source address.
+func cannotSendFrom(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
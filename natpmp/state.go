@@ -0,0 +1,204 @@
+package natpmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MappingRecord is the persisted state of one mapping on a gateway.
+type MappingRecord struct {
+	Gateway      netip.Addr    `json:"gateway"`
+	Protocol     string        `json:"protocol"`
+	InternalPort uint16        `json:"internal_port"`
+	ExternalPort uint16        `json:"external_port"`
+	Lifetime     time.Duration `json:"lifetime"`
+	Expires      time.Time     `json:"expires"`
+	// Epoch is the gateway's epoch when the mapping was last granted,
+	// and EpochObserved the local time it was seen.
+	Epoch         time.Duration `json:"epoch"`
+	EpochObserved time.Time     `json:"epoch_observed"`
+}
+
+func (r MappingRecord) sameMapping(o MappingRecord) bool {
+	return r.Gateway == o.Gateway && r.Protocol == o.Protocol && r.InternalPort == o.InternalPort
+}
+
+// StateStore persists the mappings a Client has created, so they can be
+// reconciled with the gateway after the process restarts.
+type StateStore interface {
+	Load() ([]MappingRecord, error)
+	Save([]MappingRecord) error
+}
+
+// FileStore is a StateStore which keeps the records in a JSON file.
+type FileStore struct {
+	Path string
+}
+
+// NewFileStore returns a FileStore which uses the file at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+type fileState struct {
+	Mappings []MappingRecord `json:"mappings"`
+}
+
+// Load reads the records from the file. A missing file has no records.
+func (s *FileStore) Load() ([]MappingRecord, error) {
+	b, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state fileState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", s.Path, err)
+	}
+	return state.Mappings, nil
+}
+
+// Save replaces the file with the records. The file is written to a
+// temporary file and renamed, so a crash never leaves it half written.
+func (s *FileStore) Save(records []MappingRecord) error {
+	b, err := json.MarshalIndent(fileState{Mappings: records}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// record updates the store after a successful AddPortMapping.
+func (c *Client) record(protocol string, m *PortMapping) error {
+	if c.store == nil {
+		return nil
+	}
+	gw, _ := netip.AddrFromSlice(c.gatewayIP)
+	now := c.clock.Now()
+	rec := MappingRecord{
+		Gateway:       gw.Unmap(),
+		Protocol:      protocol,
+		InternalPort:  m.InternalPort,
+		ExternalPort:  m.MappedExternalPort,
+		Lifetime:      m.RequestedLifetime,
+		Expires:       now.Add(m.Lifetime),
+		Epoch:         m.EpochDuration,
+		EpochObserved: now,
+	}
+	c.storeMu.Lock()
+	defer c.storeMu.Unlock()
+	records, err := c.store.Load()
+	if err != nil {
+		return err
+	}
+	records = removeRecord(records, rec)
+	if m.RequestedLifetime != 0 {
+		records = append(records, rec)
+	}
+	return c.store.Save(records)
+}
+
+func removeRecord(records []MappingRecord, rec MappingRecord) []MappingRecord {
+	var kept []MappingRecord
+	for _, r := range records {
+		if !r.sameMapping(rec) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// Reconcile brings the gateway in line with the mappings recorded in the
+// StateStore, typically when a process starts after a crash. Each recorded
+// mapping on this client's gateway for which want returns true, and which
+// has not expired, is renewed with its recorded external port and lifetime.
+// Every other recorded mapping is deleted from the gateway, so stale
+// mappings do not block the ports, unless the gateway's epoch shows it has
+// rebooted and so already forgotten them. The records are updated to match,
+// and the renewed mappings are returned.
+//
+// A nil want renews every mapping which has not expired.
+func (c *Client) Reconcile(want func(MappingRecord) bool) ([]*PortMapping, error) {
+	if c.store == nil {
+		return nil, errors.New("Reconcile: no StateStore, use WithStateStore")
+	}
+	c.storeMu.Lock()
+	records, err := c.store.Load()
+	c.storeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	gw, _ := netip.AddrFromSlice(c.gatewayIP)
+	now := c.clock.Now()
+
+	var renewed []*PortMapping
+	var stale []MappingRecord
+	var errs []error
+	rebooted := false
+	for _, r := range records {
+		if r.Gateway != gw.Unmap() {
+			continue
+		}
+		if !now.Before(r.Expires) || (want != nil && !want(r)) {
+			stale = append(stale, r)
+			continue
+		}
+		// A mapping the gateway lost in a reboot is recreated the same way.
+		m, err := c.AddPortMapping(r.Protocol, int(r.InternalPort), int(r.ExternalPort), r.Lifetime)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error renewing %s port %d: %w", r.Protocol, r.InternalPort, err))
+			continue
+		}
+		if epochRegressed(r.Epoch, r.EpochObserved, m.EpochDuration, now) {
+			rebooted = true
+		}
+		renewed = append(renewed, m)
+	}
+
+	if rebooted {
+		return renewed, errors.Join(append(errs, c.forget(stale))...)
+	}
+	for _, r := range stale {
+		if err := c.DeletePortMapping(r.Protocol, int(r.InternalPort)); err != nil {
+			errs = append(errs, fmt.Errorf("error deleting %s port %d: %w", r.Protocol, r.InternalPort, err))
+		}
+	}
+	return renewed, errors.Join(errs...)
+}
+
+// forget removes records from the store without contacting the gateway.
+func (c *Client) forget(stale []MappingRecord) error {
+	if len(stale) == 0 {
+		return nil
+	}
+	c.storeMu.Lock()
+	defer c.storeMu.Unlock()
+	records, err := c.store.Load()
+	if err != nil {
+		return err
+	}
+	for _, r := range stale {
+		records = removeRecord(records, r)
+	}
+	return c.store.Save(records)
+}
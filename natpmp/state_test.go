@@ -0,0 +1,159 @@
+package natpmp
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+)
+
+func TestFileStore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if got, err := store.Load(); err != nil || len(got) != 0 {
+		t.Fatalf("Load() of missing file got %v, %v", got, err)
+	}
+	want := []MappingRecord{{
+		Gateway:       netip.MustParseAddr("10.0.0.1"),
+		Protocol:      "tcp",
+		InternalPort:  80,
+		ExternalPort:  8080,
+		Lifetime:      time.Hour,
+		Expires:       time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC),
+		Epoch:         1000 * time.Second,
+		EpochObserved: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}}
+	if err := store.Save(want); err != nil {
+		t.Fatalf("Save() got err: %v", err)
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load() got err: %v", err)
+	}
+	if len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Load()=%+v != %+v", got, want)
+	}
+}
+
+func TestStateStoreRecordsMappings(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	fake := clock.NewFake(start)
+	gw := &fakeGateway{grantLifetime: 1800, clock: fake}
+	c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw), WithClock(fake), WithStateStore(store))
+
+	if _, err := c.AddPortMapping("udp", 123, 456, time.Hour); err != nil {
+		t.Fatalf("AddPortMapping() got err: %v", err)
+	}
+	if _, err := c.AddPortMapping("tcp", 80, 8080, time.Hour); err != nil {
+		t.Fatalf("AddPortMapping() got err: %v", err)
+	}
+	records, _ := store.Load()
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2: %+v", len(records), records)
+	}
+	want := MappingRecord{
+		Gateway:       netip.MustParseAddr("10.0.0.1"),
+		Protocol:      "udp",
+		InternalPort:  123,
+		ExternalPort:  456,
+		Lifetime:      time.Hour,
+		Expires:       start.Add(30 * time.Minute),
+		Epoch:         1000 * time.Second,
+		EpochObserved: start,
+	}
+	if records[0] != want {
+		t.Errorf("record=%+v, want %+v", records[0], want)
+	}
+
+	if err := c.DeletePortMapping("udp", 123); err != nil {
+		t.Fatalf("DeletePortMapping() got err: %v", err)
+	}
+	records, _ = store.Load()
+	if len(records) != 1 || records[0].Protocol != "tcp" {
+		t.Errorf("records after delete=%+v", records)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	gateway := netip.MustParseAddr("10.0.0.1")
+	record := func(port uint16, expires time.Duration) MappingRecord {
+		return MappingRecord{
+			Gateway:       gateway,
+			Protocol:      "udp",
+			InternalPort:  port,
+			ExternalPort:  port + 1000,
+			Lifetime:      time.Hour,
+			Expires:       start.Add(expires),
+			Epoch:         1000 * time.Second,
+			EpochObserved: start.Add(-time.Minute),
+		}
+	}
+	records := []MappingRecord{
+		record(1, time.Hour),    // renewed
+		record(2, -time.Second), // expired
+		record(3, time.Hour),    // no longer wanted
+		{Gateway: netip.MustParseAddr("10.0.0.2"), Protocol: "udp", InternalPort: 4, Expires: start.Add(time.Hour)},
+	}
+	want := func(r MappingRecord) bool { return r.InternalPort != 3 }
+
+	testCases := []struct {
+		name  string
+		epoch uint32
+		// wantDeletes is the internal ports deleted from the gateway.
+		wantDeletes []uint16
+	}{
+		{
+			name:        "deletes stale mappings",
+			epoch:       1060,
+			wantDeletes: []uint16{2, 3},
+		},
+		{
+			name:  "gateway rebooted",
+			epoch: 5,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+			if err := store.Save(records); err != nil {
+				t.Fatalf("Save() got err: %v", err)
+			}
+			fake := clock.NewFake(start)
+			gw := &fakeGateway{epoch: tc.epoch, clock: fake}
+			c := NewClient(net.ParseIP("10.0.0.1"), WithTransport(gw), WithClock(fake), WithStateStore(store))
+
+			renewed, err := c.Reconcile(want)
+			if err != nil {
+				t.Fatalf("Reconcile() got err: %v", err)
+			}
+			if len(renewed) != 1 || renewed[0].InternalPort != 1 || renewed[0].MappedExternalPort != 1001 {
+				t.Errorf("renewed=%+v", renewed)
+			}
+
+			var deletes []uint16
+			for _, r := range gw.mappingRequests()[1:] {
+				if r.LifetimeSecs != 0 {
+					t.Errorf("unexpected request %+v", r)
+				}
+				deletes = append(deletes, r.InternalPort)
+			}
+			if len(deletes) != len(tc.wantDeletes) {
+				t.Fatalf("deleted %v, want %v", deletes, tc.wantDeletes)
+			}
+			for i := range deletes {
+				if deletes[i] != tc.wantDeletes[i] {
+					t.Errorf("deleted %v, want %v", deletes, tc.wantDeletes)
+				}
+			}
+
+			got, _ := store.Load()
+			if len(got) != 2 || got[0].InternalPort != 4 || got[1].InternalPort != 1 {
+				t.Errorf("records after Reconcile=%+v", got)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package natpmp
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"time"
 )
 
@@ -14,6 +15,15 @@ type Transport interface {
 	Send(req, resp []byte, deadline time.Time) (result []byte, remoteIP net.IP, err error)
 }
 
+// PacketTransport is a Transport which can send a request without waiting
+// for the response, so that several requests can be outstanding at once.
+// Send is equivalent to a Write followed by a Read.
+type PacketTransport interface {
+	Transport
+	Write(req []byte, deadline time.Time) error
+	Read(resp []byte, deadline time.Time) (result []byte, remoteIP net.IP, err error)
+}
+
 // DefaultTransport returns the default transport
 // which uses UDP to send / receive bytes from the gateway.
 func DefaultTransport() Transport {
@@ -21,18 +31,40 @@ func DefaultTransport() Transport {
 }
 
 type udpTransport struct {
+	// source and device choose where requests are sent from; see
+	// SourceAddr and BindInterface.
+	source netip.Addr
+	device string
+
 	gatewayAddr *net.UDPAddr
 	conn        *net.UDPConn
 }
 
 func (c *udpTransport) Open(gateway net.IP, port int) error {
-	var err error
 	c.gatewayAddr = &net.UDPAddr{
 		IP:   gateway,
 		Port: port,
 	}
-	c.conn, err = net.DialUDP("udp", nil, c.gatewayAddr)
-	return err
+	var d net.Dialer
+	if c.source.IsValid() {
+		d.LocalAddr = &net.UDPAddr{IP: c.source.AsSlice()}
+	}
+	if c.device != "" {
+		if err := bindInterface(&d, c.device, gateway); err != nil {
+			return err
+		}
+	}
+	if d.LocalAddr == nil && d.Control == nil {
+		var err error
+		c.conn, err = net.DialUDP("udp", nil, c.gatewayAddr)
+		return err
+	}
+	conn, err := d.Dial("udp", c.gatewayAddr.String())
+	if err != nil {
+		return err
+	}
+	c.conn = conn.(*net.UDPConn)
+	return nil
 }
 
 func (c *udpTransport) Close() error {
@@ -43,12 +75,25 @@ func (c *udpTransport) Close() error {
 }
 
 func (c *udpTransport) Send(req, resp []byte, deadline time.Time) ([]byte, net.IP, error) {
-	if err := c.conn.SetDeadline(deadline); err != nil {
-		return nil, nil, fmt.Errorf("SetDeadline(): %w", err)
+	if err := c.Write(req, deadline); err != nil {
+		return nil, nil, err
 	}
-	_, err := c.conn.Write(req)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Write(): %w", err)
+	return c.Read(resp, deadline)
+}
+
+func (c *udpTransport) Write(req []byte, deadline time.Time) error {
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
+		return fmt.Errorf("SetWriteDeadline(): %w", err)
+	}
+	if _, err := c.conn.Write(req); err != nil {
+		return fmt.Errorf("Write(): %w", err)
+	}
+	return nil
+}
+
+func (c *udpTransport) Read(resp []byte, deadline time.Time) ([]byte, net.IP, error) {
+	if err := c.conn.SetReadDeadline(deadline); err != nil {
+		return nil, nil, fmt.Errorf("SetReadDeadline(): %w", err)
 	}
 	n, remoteAddr, err := c.conn.ReadFromUDP(resp)
 	if err != nil {
@@ -60,3 +105,8 @@ func (c *udpTransport) Send(req, resp []byte, deadline time.Time) ([]byte, net.I
 	}
 	return resp, remoteAddr.IP, nil
 }
+
+// LocalAddr returns the local address of the open connection.
+func (c *udpTransport) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
@@ -0,0 +1,25 @@
+package natpmp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// bindInterface binds the socket to the network interface with
+// SO_BINDTODEVICE, so requests leave through it whatever the routes say.
+func bindInterface(d *net.Dialer, name string, gateway net.IP) error {
+	d.Control = func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("error binding to interface %s: %w", name, serr)
+		}
+		return nil
+	}
+	return nil
+}
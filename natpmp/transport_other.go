@@ -0,0 +1,32 @@
+//go:build !linux
+
+package natpmp
+
+import (
+	"fmt"
+	"net"
+)
+
+// bindInterface sends from the interface's address in the gateway's
+// address family, as binding a socket to an interface needs Linux.
+func bindInterface(d *net.Dialer, name string, gateway net.IP) error {
+	if d.LocalAddr != nil {
+		return nil
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if ok && (ipnet.IP.To4() != nil) == (gateway.To4() != nil) {
+			d.LocalAddr = &net.UDPAddr{IP: ipnet.IP}
+			return nil
+		}
+	}
+	return fmt.Errorf("interface %s has no address to reach %s", name, gateway)
+}
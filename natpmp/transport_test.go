@@ -0,0 +1,92 @@
+package natpmp
+
+import (
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSourceAddr(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts []Option
+		want netip.Addr
+	}{
+		{
+			name: "default",
+			want: netip.MustParseAddr("127.0.0.1"),
+		},
+		{
+			// Linux routes all of 127/8 to lo; elsewhere 127.0.0.2 needs a
+			// loopback alias, such as "ifconfig lo0 alias 127.0.0.2".
+			name: "source address",
+			opts: []Option{SourceAddr(netip.MustParseAddr("127.0.0.2"))},
+			want: netip.MustParseAddr("127.0.0.2"),
+		},
+		{
+			name: "interface",
+			opts: []Option{BindInterface(loopbackInterface(t))},
+			want: netip.MustParseAddr("127.0.0.1"),
+		},
+		{
+			name: "interface and source address",
+			opts: []Option{BindInterface(loopbackInterface(t)), SourceAddr(netip.MustParseAddr("127.0.0.2"))},
+			want: netip.MustParseAddr("127.0.0.2"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			gw, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer gw.Close()
+			from := make(chan net.Addr, 1)
+			go func() {
+				buf := make([]byte, 64)
+				_, addr, err := gw.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				from <- addr
+				gw.WriteTo(addUDPCall.resp, addr)
+			}()
+
+			opts := append([]Option{Port(gw.LocalAddr().(*net.UDPAddr).Port), Timeout(5 * time.Second)}, tc.opts...)
+			c := NewClient(net.IPv4(127, 0, 0, 1), opts...)
+			m, err := c.AddPortMapping("udp", 123, 456, 1200*time.Second)
+			if cannotSendFrom(err) {
+				t.Skipf("cannot send from %s: %v", tc.want, err)
+			}
+			if err != nil {
+				t.Fatalf("AddPortMapping() failed: %v", err)
+			}
+			if m.InternalAddr != tc.want {
+				t.Errorf("InternalAddr=%v, want %v", m.InternalAddr, tc.want)
+			}
+			if got := (<-from).(*net.UDPAddr).AddrPort().Addr().Unmap(); got != tc.want {
+				t.Errorf("gateway saw the request from %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// loopbackInterface returns the name of the loopback interface.
+func loopbackInterface(t *testing.T) string {
+	if runtime.GOOS == "linux" {
+		return "lo"
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			return ifi.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
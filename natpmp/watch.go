@@ -0,0 +1,262 @@
+package natpmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+// AddressEventKind is the kind of change reported by WatchExternalAddress.
+type AddressEventKind int
+
+const (
+	// AddressGained is reported for the first address seen, and for an
+	// address seen after AddressLost.
+	AddressGained AddressEventKind = iota + 1
+	// AddressChanged is reported when the gateway's address differs from
+	// the last one seen.
+	AddressChanged
+	// AddressLost is reported when the gateway announces that it has no
+	// external address, or when several polls in a row fail (see
+	// LostAfter).
+	AddressLost
+	// GatewayRebooted is reported when the gateway's epoch goes backwards,
+	// meaning it lost its mappings (RFC 6886 section 3.6).
+	GatewayRebooted
+)
+
+func (k AddressEventKind) String() string {
+	switch k {
+	case AddressGained:
+		return "gained"
+	case AddressChanged:
+		return "changed"
+	case AddressLost:
+		return "lost"
+	case GatewayRebooted:
+		return "gateway rebooted"
+	}
+	return fmt.Sprintf("AddressEventKind(%d)", int(k))
+}
+
+// AddressEvent is a change in the gateway's external address.
+type AddressEvent struct {
+	Kind AddressEventKind
+	// Addr is the external address, invalid for AddressLost.
+	Addr netip.Addr
+	// Previous is the address before the event, invalid if there was none.
+	Previous netip.Addr
+	// Epoch is the gateway's epoch reported with Addr.
+	Epoch time.Duration
+	// Announced reports whether Addr came from a multicast announcement
+	// rather than a GetExternalAddress request.
+	Announced bool
+	// Err is why the address was lost, for AddressLost.
+	Err error
+	// Time is when the event was observed.
+	Time time.Time
+}
+
+// ErrNoExternalAddress is the Err of an AddressLost event for an
+// announcement of the unspecified address.
+var ErrNoExternalAddress = errors.New("gateway has no external address")
+
+// WatchOption is the type for configuring WatchExternalAddress.
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	announcements net.PacketConn
+	lostAfter     int
+}
+
+// defaultLostAfter is the number of failed polls in a row after which the
+// address is reported lost, so that one lost packet is not.
+const defaultLostAfter = 3
+
+// LostAfter returns an option which reports AddressLost only after n polls
+// in a row have failed, rather than the default of 3. An announcement of the
+// unspecified address is reported at once.
+func LostAfter(n int) WatchOption {
+	return func(cfg *watchConfig) {
+		cfg.lostAfter = max(n, 1)
+	}
+}
+
+// AnnouncementConn returns an option which reads announcements from conn
+// instead of joining the NAT-PMP multicast group. The watcher closes conn
+// when it stops. Primarily for testing.
+func AnnouncementConn(conn net.PacketConn) WatchOption {
+	return func(cfg *watchConfig) {
+		cfg.announcements = conn
+	}
+}
+
+// WatchExternalAddress watches the gateway's external address until ctx
+// is done, then closes the returned channel. It calls GetExternalAddress
+// right away and then every interval, and also listens for the gateway's
+// multicast announcements of a new address when the group can be joined.
+// Repeated observations of the same address are reported once.
+//
+// Polls bypass the cache set with CacheExternalAddress, and announcements
+// update it.
+func WatchExternalAddress(ctx context.Context, client *Client, interval time.Duration, opts ...WatchOption) <-chan AddressEvent {
+	cfg := watchConfig{lostAfter: defaultLostAfter}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.announcements == nil {
+		group := net.UDPAddrFromAddrPort(wire.AnnounceAddr)
+		if conn, err := net.ListenMulticastUDP("udp4", nil, group); err == nil {
+			cfg.announcements = conn
+		}
+	}
+
+	observed := make(chan observation)
+	go pollExternalAddress(ctx, client, interval, observed)
+	if cfg.announcements != nil {
+		stop := context.AfterFunc(ctx, func() { cfg.announcements.Close() })
+		go func() {
+			defer stop()
+			readAnnouncements(ctx, cfg.announcements, client.gatewayIP, observed)
+		}()
+	}
+
+	events := make(chan AddressEvent)
+	go func() {
+		defer close(events)
+		w := addressWatcher{lostAfter: cfg.lostAfter}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case o := <-observed:
+				if o.announced {
+					client.cacheAddress(o.addr, o.epoch)
+				}
+				for _, e := range w.observe(o, client.clock.Now()) {
+					select {
+					case events <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// observation is the result of a poll or an announcement.
+type observation struct {
+	addr      netip.Addr
+	epoch     time.Duration
+	announced bool
+	err       error
+}
+
+func pollExternalAddress(ctx context.Context, client *Client, interval time.Duration, observed chan<- observation) {
+	timer := client.clock.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+		}
+		addr, epoch, err := client.Refresh(ctx)
+		timer.Reset(interval)
+		select {
+		case observed <- observation{addr: addr, epoch: epoch, err: err}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func readAnnouncements(ctx context.Context, conn net.PacketConn, gateway net.IP, observed chan<- observation) {
+	buf := make([]byte, 64)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if ua, ok := from.(*net.UDPAddr); !ok || !ua.IP.Equal(gateway) {
+			continue
+		}
+		a, err := wire.ParseAnnouncement(buf[:n])
+		if err != nil {
+			continue
+		}
+		o := observation{addr: a.Addr(), epoch: time.Duration(a.EpochSecs) * time.Second, announced: true}
+		if o.addr.IsUnspecified() {
+			o.err = ErrNoExternalAddress
+		}
+		select {
+		case observed <- o:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// addressWatcher turns observations into events.
+type addressWatcher struct {
+	// lostAfter is the number of failed polls in a row which lose the
+	// address, counted by failures.
+	lostAfter int
+	failures  int
+
+	addr netip.Addr
+	// epoch was seen at epochObserved, for detecting a reboot.
+	epoch         time.Duration
+	epochObserved time.Time
+}
+
+func (w *addressWatcher) observe(o observation, now time.Time) []AddressEvent {
+	var events []AddressEvent
+	event := func(kind AddressEventKind) {
+		events = append(events, AddressEvent{
+			Kind:      kind,
+			Addr:      o.addr,
+			Previous:  w.addr,
+			Epoch:     o.epoch,
+			Announced: o.announced,
+			Err:       o.err,
+			Time:      now,
+		})
+	}
+	if o.err == nil || o.announced {
+		if epochRegressed(w.epoch, w.epochObserved, o.epoch, now) {
+			event(GatewayRebooted)
+		}
+		w.epoch, w.epochObserved = o.epoch, now
+	}
+	if o.err != nil {
+		if !o.announced {
+			w.failures++
+			if w.failures < w.lostAfter {
+				return events
+			}
+		}
+		if w.addr.IsValid() {
+			o.addr = netip.Addr{}
+			event(AddressLost)
+			w.addr = netip.Addr{}
+		}
+		return events
+	}
+	w.failures = 0
+	switch {
+	case !w.addr.IsValid():
+		event(AddressGained)
+	case w.addr != o.addr:
+		event(AddressChanged)
+	}
+	w.addr = o.addr
+	return events
+}
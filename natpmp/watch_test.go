@@ -0,0 +1,203 @@
+package natpmp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+)
+
+// watchGateway is a Transport which answers external address requests with
+// an epoch that follows the clock from its last boot.
+type watchGateway struct {
+	clock *clock.Fake
+
+	mu      sync.Mutex
+	gateway net.IP
+	addr    [4]byte
+	boot    time.Time
+	// down answers with Network Failure, as a gateway with no address does.
+	down bool
+}
+
+func (g *watchGateway) Open(gw net.IP, port int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.gateway = gw
+	return nil
+}
+
+func (g *watchGateway) Close() error { return nil }
+
+func (g *watchGateway) Send(req, resp []byte, deadline time.Time) ([]byte, net.IP, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(req) != 2 || req[1] != 0 {
+		return nil, nil, os.ErrInvalid
+	}
+	epoch := uint32(g.clock.Now().Sub(g.boot) / time.Second)
+	r := &wire.ExternalAddressResponse{ResponseHeader: wire.ResponseHeader{Opcode: 0x80, EpochSecs: epoch}, ExternalAddr: g.addr}
+	if g.down {
+		r = &wire.ExternalAddressResponse{ResponseHeader: wire.ResponseHeader{Opcode: 0x80, ResultCode: wire.NetworkFailure, EpochSecs: epoch}}
+	}
+	return resp[:copy(resp, encodeTestResp(r))], g.gateway, nil
+}
+
+func (g *watchGateway) set(f func(g *watchGateway)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f(g)
+}
+
+func TestWatchExternalAddress(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	gw := &watchGateway{clock: fake, addr: [4]byte{203, 0, 113, 1}, boot: start.Add(-time.Hour)}
+	client := NewClient(net.IPv4(127, 0, 0, 1), WithTransport(gw), WithClock(fake))
+
+	announcements, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP() failed: %v", err)
+	}
+	announcer, err := net.DialUDP("udp4", nil, announcements.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP() failed: %v", err)
+	}
+	defer announcer.Close()
+	announce := func(addr [4]byte) {
+		epoch := uint32(fake.Now().Sub(start.Add(-time.Hour)) / time.Second)
+		b := encodeTestResp(&wire.ExternalAddressResponse{ResponseHeader: wire.ResponseHeader{Opcode: 0x80, EpochSecs: epoch}, ExternalAddr: addr})
+		if _, err := announcer.Write(b); err != nil {
+			t.Fatalf("announce failed: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := WatchExternalAddress(ctx, client, time.Minute, AnnouncementConn(announcements))
+	next := func() AddressEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event")
+			return AddressEvent{}
+		}
+	}
+	poll := func() {
+		t.Helper()
+		for fake.Timers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		fake.Advance(time.Minute)
+	}
+	addr := func(s string) netip.Addr { return netip.MustParseAddr(s) }
+
+	if e := next(); e.Kind != AddressGained || e.Addr != addr("203.0.113.1") || e.Epoch != time.Hour {
+		t.Errorf("first event=%+v", e)
+	}
+
+	// The same address again is not reported.
+	announce([4]byte{203, 0, 113, 1})
+	announce([4]byte{203, 0, 113, 2})
+	if e := next(); e.Kind != AddressChanged || !e.Announced || e.Addr != addr("203.0.113.2") || e.Previous != addr("203.0.113.1") {
+		t.Errorf("announced event=%+v", e)
+	}
+
+	gw.set(func(g *watchGateway) { g.addr = [4]byte{203, 0, 113, 2} })
+	poll()
+	gw.set(func(g *watchGateway) { g.down = true })
+	poll()
+	poll()
+	poll()
+	if e := next(); e.Kind != AddressLost || e.Err == nil || e.Previous != addr("203.0.113.2") {
+		t.Errorf("lost event=%+v", e)
+	}
+	poll()
+	gw.set(func(g *watchGateway) { g.down = false })
+	poll()
+	if e := next(); e.Kind != AddressGained || e.Addr != addr("203.0.113.2") {
+		t.Errorf("regained event=%+v", e)
+	}
+
+	gw.set(func(g *watchGateway) { g.boot = fake.Now(); g.addr = [4]byte{203, 0, 113, 3} })
+	poll()
+	if e := next(); e.Kind != GatewayRebooted || e.Addr != addr("203.0.113.3") {
+		t.Errorf("reboot event=%+v", e)
+	}
+	if e := next(); e.Kind != AddressChanged || e.Addr != addr("203.0.113.3") || e.Announced {
+		t.Errorf("changed event=%+v", e)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestAddressWatcher(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := netip.MustParseAddr("203.0.113.1")
+	b := netip.MustParseAddr("203.0.113.2")
+	testCases := []struct {
+		name string
+		obs  []observation
+		want []AddressEventKind
+	}{
+		{
+			name: "duplicates",
+			obs:  []observation{{addr: a, epoch: 100}, {addr: a, epoch: 100}, {addr: a, epoch: 100, announced: true}},
+			want: []AddressEventKind{AddressGained},
+		},
+		{
+			name: "errors before any address",
+			obs:  []observation{{err: os.ErrDeadlineExceeded}, {addr: a}},
+			want: []AddressEventKind{AddressGained},
+		},
+		{
+			name: "announced unspecified address",
+			obs:  []observation{{addr: a}, {addr: netip.IPv4Unspecified(), announced: true, err: ErrNoExternalAddress}, {addr: b}},
+			want: []AddressEventKind{AddressGained, AddressLost, AddressGained},
+		},
+		{
+			name: "failed polls",
+			obs:  []observation{{addr: a}, {err: os.ErrDeadlineExceeded}, {err: os.ErrDeadlineExceeded}, {err: os.ErrDeadlineExceeded}, {addr: a}},
+			want: []AddressEventKind{AddressGained, AddressLost, AddressGained},
+		},
+		{
+			name: "poll succeeds between failures",
+			obs:  []observation{{addr: a}, {err: os.ErrDeadlineExceeded}, {err: os.ErrDeadlineExceeded}, {addr: a}, {err: os.ErrDeadlineExceeded}, {err: os.ErrDeadlineExceeded}},
+			want: []AddressEventKind{AddressGained},
+		},
+		{
+			name: "reboot with the same address",
+			obs:  []observation{{addr: a, epoch: time.Hour}, {addr: a, epoch: 0}},
+			want: []AddressEventKind{AddressGained, GatewayRebooted},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := addressWatcher{lostAfter: defaultLostAfter}
+			var got []AddressEventKind
+			for _, o := range tc.obs {
+				for _, e := range w.observe(o, now) {
+					got = append(got, e.Kind)
+				}
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("events=%v != %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("events=%v != %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+// Package wire encodes and decodes NAT-PMP messages, for use by clients,
+// servers, proxies and analyzers.
+//
+// See https://tools.ietf.org/rfc/rfc6886.txt
+//
+// Usage:
+//
+//	msg, err := wire.Parse(packet)
+//	switch m := msg.(type) {
+//	case *wire.MappingRequest:
+//		...
+//	}
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// Version is the NAT-PMP protocol version.
+const Version = 0
+
+// Ports used by NAT-PMP.
+const (
+	// ServerPort is the port the gateway listens on for requests.
+	ServerPort = 5351
+	// ClientPort is the port announcements are multicast to.
+	ClientPort = 5350
+)
+
+// AnnounceAddr is the multicast group announcements are sent to.
+var AnnounceAddr = netip.AddrPortFrom(netip.MustParseAddr("224.0.0.1"), ClientPort)
+
+// Sizes of the messages on the wire.
+const (
+	ExternalAddressRequestSize  = 2
+	MappingRequestSize          = 12
+	ErrorResponseSize           = 8
+	ExternalAddressResponseSize = 12
+	MappingResponseSize         = 16
+)
+
+// Opcode identifies the kind of a message. Responses have ResponseBit set.
+type Opcode uint8
+
+const (
+	OpExternalAddress Opcode = 0
+	OpMapUDP          Opcode = 1
+	OpMapTCP          Opcode = 2
+
+	// ResponseBit is set in the opcode of every response.
+	ResponseBit Opcode = 0x80
+)
+
+// IsResponse reports whether the opcode is for a response.
+func (o Opcode) IsResponse() bool { return o&ResponseBit != 0 }
+
+// Request returns the opcode without the ResponseBit.
+func (o Opcode) Request() Opcode { return o &^ ResponseBit }
+
+// Response returns the opcode with the ResponseBit.
+func (o Opcode) Response() Opcode { return o | ResponseBit }
+
+func (o Opcode) String() string {
+	var s string
+	switch o.Request() {
+	case OpExternalAddress:
+		s = "ExternalAddress"
+	case OpMapUDP:
+		s = "MapUDP"
+	case OpMapTCP:
+		s = "MapTCP"
+	default:
+		s = fmt.Sprintf("Opcode(%d)", uint8(o.Request()))
+	}
+	if o.IsResponse() {
+		s += "Response"
+	}
+	return s
+}
+
+// ResultCode is the result of a request, as returned in each response.
+type ResultCode uint16
+
+const (
+	Success            ResultCode = 0
+	UnsupportedVersion ResultCode = 1
+	NotAuthorized      ResultCode = 2
+	NetworkFailure     ResultCode = 3
+	OutOfResources     ResultCode = 4
+	UnsupportedOpcode  ResultCode = 5
+)
+
+func (r ResultCode) String() string {
+	switch r {
+	case Success:
+		return "Success"
+	case UnsupportedVersion:
+		return "Unsupported Version"
+	case NotAuthorized:
+		return "Not Authorized/Refused"
+	case NetworkFailure:
+		return "Network Failure"
+	case OutOfResources:
+		return "Out of resources"
+	case UnsupportedOpcode:
+		return "Unsupported opcode"
+	}
+	return fmt.Sprintf("ResultCode(%d)", uint16(r))
+}
+
+// Errors returned by Parse, matched using errors.Is.
+var (
+	ErrLength             = errors.New("invalid message length")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrUnsupportedOpcode  = errors.New("unsupported opcode")
+	// ErrNotResponse is returned by ParseResponse for a request.
+	ErrNotResponse = errors.New("not a response")
+)
+
+// Message is a NAT-PMP request or response.
+type Message interface {
+	// Op returns the opcode of the message, including the ResponseBit.
+	Op() Opcode
+	// AppendBinary appends the wire format of the message to b.
+	AppendBinary(b []byte) ([]byte, error)
+	// MarshalBinary returns the wire format of the message.
+	MarshalBinary() ([]byte, error)
+}
+
+// Request is a message sent by a client to the gateway.
+type Request interface {
+	Message
+	request()
+}
+
+// Response is a message sent by the gateway, in reply to a Request or as
+// an announcement.
+type Response interface {
+	Message
+	// Result returns the result code in the common response header.
+	Result() ResultCode
+	// Epoch returns the seconds since the start of the gateway's epoch.
+	Epoch() uint32
+}
+
+// ExternalAddressRequest asks the gateway for its external address.
+type ExternalAddressRequest struct{}
+
+// MappingRequest asks the gateway to create, renew or delete a mapping.
+type MappingRequest struct {
+	// Opcode is OpMapUDP or OpMapTCP.
+	Opcode                Opcode
+	InternalPort          uint16
+	SuggestedExternalPort uint16
+	LifetimeSecs          uint32
+}
+
+// ResponseHeader is the header common to all responses.
+type ResponseHeader struct {
+	// Opcode is the opcode of the response, including the ResponseBit.
+	Opcode     Opcode
+	ResultCode ResultCode
+	EpochSecs  uint32
+}
+
+func (h ResponseHeader) Op() Opcode         { return h.Opcode }
+func (h ResponseHeader) Result() ResultCode { return h.ResultCode }
+func (h ResponseHeader) Epoch() uint32      { return h.EpochSecs }
+
+func (h ResponseHeader) appendHeader(b []byte) []byte {
+	b = append(b, Version, byte(h.Opcode))
+	b = binary.BigEndian.AppendUint16(b, uint16(h.ResultCode))
+	return binary.BigEndian.AppendUint32(b, h.EpochSecs)
+}
+
+// ErrorResponse is a response which carries only the common header.
+// Gateways may send it for any request which fails, and always send it
+// for Unsupported Version and Unsupported Opcode.
+type ErrorResponse struct {
+	ResponseHeader
+}
+
+// ExternalAddressResponse holds the gateway's external address.
+// It is also the format of announcements.
+type ExternalAddressResponse struct {
+	ResponseHeader
+	ExternalAddr [4]byte
+}
+
+// Addr returns the external address.
+func (r *ExternalAddressResponse) Addr() netip.Addr { return netip.AddrFrom4(r.ExternalAddr) }
+
+// MappingResponse holds the mapping the gateway created.
+type MappingResponse struct {
+	ResponseHeader
+	InternalPort       uint16
+	MappedExternalPort uint16
+	LifetimeSecs       uint32
+}
+
+func (*ExternalAddressRequest) request() {}
+func (*MappingRequest) request()         {}
+
+func (*ExternalAddressRequest) Op() Opcode { return OpExternalAddress }
+func (r *MappingRequest) Op() Opcode       { return r.Opcode }
+
+func (r *ExternalAddressRequest) AppendBinary(b []byte) ([]byte, error) {
+	return append(b, Version, byte(OpExternalAddress)), nil
+}
+
+func (r *MappingRequest) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, Version, byte(r.Opcode), 0, 0)
+	b = binary.BigEndian.AppendUint16(b, r.InternalPort)
+	b = binary.BigEndian.AppendUint16(b, r.SuggestedExternalPort)
+	return binary.BigEndian.AppendUint32(b, r.LifetimeSecs), nil
+}
+
+func (r *ErrorResponse) AppendBinary(b []byte) ([]byte, error) {
+	return r.appendHeader(b), nil
+}
+
+func (r *ExternalAddressResponse) AppendBinary(b []byte) ([]byte, error) {
+	return append(r.appendHeader(b), r.ExternalAddr[:]...), nil
+}
+
+func (r *MappingResponse) AppendBinary(b []byte) ([]byte, error) {
+	b = r.appendHeader(b)
+	b = binary.BigEndian.AppendUint16(b, r.InternalPort)
+	b = binary.BigEndian.AppendUint16(b, r.MappedExternalPort)
+	return binary.BigEndian.AppendUint32(b, r.LifetimeSecs), nil
+}
+
+func (r *ExternalAddressRequest) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, ExternalAddressRequestSize))
+}
+func (r *MappingRequest) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, MappingRequestSize))
+}
+func (r *ErrorResponse) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, ErrorResponseSize))
+}
+func (r *ExternalAddressResponse) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, ExternalAddressResponseSize))
+}
+func (r *MappingResponse) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, MappingResponseSize))
+}
+
+// Parse decodes a request or response. The version and opcode select the
+// message type, and the length must be exactly that of the type.
+// A response with a non-zero result code may be only the common header,
+// which is returned as an *ErrorResponse.
+//
+// A request with an unknown opcode returns an error matching
+// ErrUnsupportedOpcode; a message with a version other than 0 returns an
+// error matching ErrUnsupportedVersion.
+func Parse(b []byte) (Message, error) {
+	if err := checkVersion(b, 2); err != nil {
+		return nil, err
+	}
+	if op := Opcode(b[1]); op.IsResponse() {
+		return ParseResponse(b)
+	}
+	return ParseRequest(b)
+}
+
+// ParseRequest decodes a request. See Parse.
+func ParseRequest(b []byte) (Request, error) {
+	if err := checkVersion(b, 2); err != nil {
+		return nil, err
+	}
+	switch Opcode(b[1]) {
+	case OpExternalAddress:
+		r := &ExternalAddressRequest{}
+		if err := r.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case OpMapUDP, OpMapTCP:
+		r := &MappingRequest{}
+		if err := r.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedOpcode, Opcode(b[1]))
+}
+
+// ParseResponse decodes a response. See Parse.
+func ParseResponse(b []byte) (Response, error) {
+	var h ResponseHeader
+	if err := h.unmarshal(b); err != nil {
+		return nil, err
+	}
+	if h.ResultCode != Success && len(b) == ErrorResponseSize {
+		return &ErrorResponse{h}, nil
+	}
+	switch h.Opcode.Request() {
+	case OpExternalAddress:
+		r := &ExternalAddressResponse{}
+		if err := r.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case OpMapUDP, OpMapTCP:
+		r := &MappingResponse{}
+		if err := r.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	if h.ResultCode != Success {
+		return nil, fmt.Errorf("%w: %d bytes for %s", ErrLength, len(b), h.Opcode)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedOpcode, h.Opcode)
+}
+
+// UnmarshalBinary decodes the request from its wire format. It returns the
+// errors Parse does, and one matching ErrUnsupportedOpcode for any other
+// kind of message.
+func (r *ExternalAddressRequest) UnmarshalBinary(b []byte) error {
+	if err := checkVersion(b, 2); err != nil {
+		return err
+	}
+	if op := Opcode(b[1]); op != OpExternalAddress {
+		return fmt.Errorf("%w: %s is not an external address request", ErrUnsupportedOpcode, op)
+	}
+	return checkLength(OpExternalAddress, b, ExternalAddressRequestSize)
+}
+
+// UnmarshalBinary decodes the request from its wire format. The reserved
+// field is ignored. See ExternalAddressRequest.UnmarshalBinary for the
+// errors.
+func (r *MappingRequest) UnmarshalBinary(b []byte) error {
+	if err := checkVersion(b, 2); err != nil {
+		return err
+	}
+	op := Opcode(b[1])
+	if op != OpMapUDP && op != OpMapTCP {
+		return fmt.Errorf("%w: %s is not a mapping request", ErrUnsupportedOpcode, op)
+	}
+	if err := checkLength(op, b, MappingRequestSize); err != nil {
+		return err
+	}
+	*r = MappingRequest{
+		Opcode:                op,
+		InternalPort:          binary.BigEndian.Uint16(b[4:]),
+		SuggestedExternalPort: binary.BigEndian.Uint16(b[6:]),
+		LifetimeSecs:          binary.BigEndian.Uint32(b[8:]),
+	}
+	return nil
+}
+
+// UnmarshalBinary decodes the response, which is only the common header,
+// from its wire format. See ExternalAddressRequest.UnmarshalBinary for the
+// errors.
+func (r *ErrorResponse) UnmarshalBinary(b []byte) error {
+	if err := r.unmarshal(b); err != nil {
+		return err
+	}
+	return checkLength(r.Opcode, b, ErrorResponseSize)
+}
+
+// UnmarshalBinary decodes the response from its wire format. See
+// ExternalAddressRequest.UnmarshalBinary for the errors.
+func (r *ExternalAddressResponse) UnmarshalBinary(b []byte) error {
+	if err := r.unmarshal(b); err != nil {
+		return err
+	}
+	if r.Opcode != OpExternalAddress.Response() {
+		return fmt.Errorf("%w: %s is not an external address response", ErrUnsupportedOpcode, r.Opcode)
+	}
+	if err := checkLength(r.Opcode, b, ExternalAddressResponseSize); err != nil {
+		return err
+	}
+	r.ExternalAddr = [4]byte(b[8:])
+	return nil
+}
+
+// UnmarshalBinary decodes the response from its wire format. See
+// ExternalAddressRequest.UnmarshalBinary for the errors.
+func (r *MappingResponse) UnmarshalBinary(b []byte) error {
+	if err := r.unmarshal(b); err != nil {
+		return err
+	}
+	if op := r.Opcode.Request(); op != OpMapUDP && op != OpMapTCP {
+		return fmt.Errorf("%w: %s is not a mapping response", ErrUnsupportedOpcode, r.Opcode)
+	}
+	if err := checkLength(r.Opcode, b, MappingResponseSize); err != nil {
+		return err
+	}
+	r.InternalPort = binary.BigEndian.Uint16(b[8:])
+	r.MappedExternalPort = binary.BigEndian.Uint16(b[10:])
+	r.LifetimeSecs = binary.BigEndian.Uint32(b[12:])
+	return nil
+}
+
+// unmarshal decodes the common response header.
+func (h *ResponseHeader) unmarshal(b []byte) error {
+	if err := checkVersion(b, ErrorResponseSize); err != nil {
+		return err
+	}
+	*h = ResponseHeader{
+		Opcode:     Opcode(b[1]),
+		ResultCode: ResultCode(binary.BigEndian.Uint16(b[2:])),
+		EpochSecs:  binary.BigEndian.Uint32(b[4:]),
+	}
+	if !h.Opcode.IsResponse() {
+		return fmt.Errorf("%w: %s", ErrNotResponse, h.Opcode)
+	}
+	return nil
+}
+
+// ParseAnnouncement decodes an announcement of the gateway's external
+// address, which is a successful ExternalAddressResponse sent unsolicited.
+func ParseAnnouncement(b []byte) (*ExternalAddressResponse, error) {
+	resp, err := ParseResponse(b)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := resp.(*ExternalAddressResponse)
+	if !ok || a.ResultCode != Success {
+		return nil, fmt.Errorf("%s with result %s is not an announcement", resp.Op(), resp.Result())
+	}
+	return a, nil
+}
+
+// checkVersion checks that the message holds at least min bytes and is
+// for this version of the protocol.
+func checkVersion(b []byte, min int) error {
+	if len(b) < min {
+		return fmt.Errorf("%w: %d bytes", ErrLength, len(b))
+	}
+	if b[0] != Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, b[0])
+	}
+	return nil
+}
+
+func checkLength(op Opcode, b []byte, size int) error {
+	if len(b) != size {
+		return fmt.Errorf("%w: %d bytes for %s, expected %d", ErrLength, len(b), op, size)
+	}
+	return nil
+}
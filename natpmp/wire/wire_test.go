@@ -0,0 +1,234 @@
+package wire
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name    string
+		wire    []byte
+		want    Message
+		wantErr error
+	}{
+		{
+			name: "external address request",
+			wire: []byte{0x0, 0x0},
+			want: &ExternalAddressRequest{},
+		},
+		{
+			name: "mapping request",
+			wire: []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+			want: &MappingRequest{Opcode: OpMapUDP, InternalPort: 123, SuggestedExternalPort: 456, LifetimeSecs: 1200},
+		},
+		{
+			name: "external address response",
+			wire: []byte{0x0, 0x80, 0x0, 0x0, 0x0, 0x13, 0xf2, 0x4f, 0x49, 0x8c, 0x36, 0x9a},
+			want: &ExternalAddressResponse{
+				ResponseHeader: ResponseHeader{Opcode: 0x80, EpochSecs: 0x13f24f},
+				ExternalAddr:   [4]byte{73, 140, 54, 154},
+			},
+		},
+		{
+			name: "mapping response",
+			wire: []byte{0x0, 0x82, 0x0, 0x0, 0x0, 0x14, 0x3, 0x21, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+			want: &MappingResponse{
+				ResponseHeader:     ResponseHeader{Opcode: 0x82, EpochSecs: 0x140321},
+				InternalPort:       123,
+				MappedExternalPort: 456,
+				LifetimeSecs:       1200,
+			},
+		},
+		{
+			name: "full length failure",
+			wire: []byte{0x0, 0x82, 0x0, 0x3, 0x0, 0x14, 0x3, 0x21, 0x0, 0x7b, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+			want: &MappingResponse{
+				ResponseHeader: ResponseHeader{Opcode: 0x82, ResultCode: NetworkFailure, EpochSecs: 0x140321},
+				InternalPort:   123,
+			},
+		},
+		{
+			name: "unsupported opcode response",
+			wire: []byte{0x0, 0x83, 0x0, 0x5, 0x0, 0x0, 0x0, 0x10},
+			want: &ErrorResponse{ResponseHeader{Opcode: 0x83, ResultCode: UnsupportedOpcode, EpochSecs: 0x10}},
+		},
+		{
+			name: "unsupported version response",
+			wire: []byte{0x0, 0x80, 0x0, 0x1, 0x0, 0x0, 0x0, 0x10},
+			want: &ErrorResponse{ResponseHeader{Opcode: 0x80, ResultCode: UnsupportedVersion, EpochSecs: 0x10}},
+		},
+		{
+			name:    "empty",
+			wire:    []byte{},
+			wantErr: ErrLength,
+		},
+		{
+			name:    "pcp version",
+			wire:    []byte{0x2, 0x1, 0x0, 0x0},
+			wantErr: ErrUnsupportedVersion,
+		},
+		{
+			name:    "unknown request opcode",
+			wire:    []byte{0x0, 0x3, 0x0, 0x0},
+			wantErr: ErrUnsupportedOpcode,
+		},
+		{
+			name:    "request too long",
+			wire:    []byte{0x0, 0x0, 0x0},
+			wantErr: ErrLength,
+		},
+		{
+			name:    "mapping request too short",
+			wire:    []byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4},
+			wantErr: ErrLength,
+		},
+		{
+			name:    "successful response too short",
+			wire:    []byte{0x0, 0x81, 0x0, 0x0, 0x0, 0x0, 0x0, 0x10},
+			wantErr: ErrLength,
+		},
+		{
+			name:    "response header too short",
+			wire:    []byte{0x0, 0x81, 0x0, 0x5},
+			wantErr: ErrLength,
+		},
+		{
+			name:    "unknown response opcode",
+			wire:    []byte{0x0, 0x83, 0x0, 0x0, 0x0, 0x0, 0x0, 0x10, 0x0, 0x0, 0x0, 0x0},
+			wantErr: ErrUnsupportedOpcode,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Parse(tc.wire)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("Parse() err=%v != %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() got err: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Parse()=%+v != %+v", got, tc.want)
+			}
+			b, err := got.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary() got err: %v", err)
+			}
+			if !bytes.Equal(b, tc.wire) {
+				t.Errorf("MarshalBinary()=%v != %v", b, tc.wire)
+			}
+		})
+	}
+}
+
+func TestUnmarshalBinary(t *testing.T) {
+	extAddrResp := []byte{0x0, 0x80, 0x0, 0x0, 0x0, 0x13, 0xf2, 0x4f, 0x49, 0x8c, 0x36, 0x9a}
+	mappingReq := []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0}
+	testCases := []struct {
+		name    string
+		msg     encoding.BinaryUnmarshaler
+		wire    []byte
+		wantErr error
+	}{
+		{name: "external address response", msg: &ExternalAddressResponse{}, wire: extAddrResp},
+		{name: "mapping request", msg: &MappingRequest{}, wire: mappingReq},
+		{name: "other response", msg: &MappingResponse{}, wire: extAddrResp, wantErr: ErrUnsupportedOpcode},
+		{name: "other request", msg: &ExternalAddressRequest{}, wire: mappingReq, wantErr: ErrUnsupportedOpcode},
+		{name: "request for response", msg: &MappingResponse{}, wire: mappingReq, wantErr: ErrNotResponse},
+		{name: "full response for header", msg: &ErrorResponse{}, wire: extAddrResp, wantErr: ErrLength},
+		{name: "pcp version", msg: &MappingRequest{}, wire: []byte{0x2, 0x1, 0x0, 0x0}, wantErr: ErrUnsupportedVersion},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.msg.UnmarshalBinary(tc.wire)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("UnmarshalBinary() err=%v != %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalBinary() got err: %v", err)
+			}
+			if b, _ := tc.msg.(Message).MarshalBinary(); !bytes.Equal(b, tc.wire) {
+				t.Errorf("MarshalBinary()=%v != %v", b, tc.wire)
+			}
+		})
+	}
+}
+
+func TestParseAnnouncement(t *testing.T) {
+	a, err := ParseAnnouncement([]byte{0x0, 0x80, 0x0, 0x0, 0x0, 0x13, 0xf2, 0x4f, 0x49, 0x8c, 0x36, 0x9a})
+	if err != nil {
+		t.Fatalf("ParseAnnouncement() got err: %v", err)
+	}
+	if got := a.Addr().String(); got != "73.140.54.154" {
+		t.Errorf("Addr()=%s", got)
+	}
+	if _, err := ParseAnnouncement([]byte{0x0, 0x80, 0x0, 0x3, 0x0, 0x0, 0x0, 0x10}); err == nil {
+		t.Errorf("ParseAnnouncement(failure) expected error")
+	}
+	if _, err := ParseAnnouncement([]byte{0x0, 0x0}); err == nil {
+		t.Errorf("ParseAnnouncement(request) expected error")
+	}
+}
+
+func TestOpcodeString(t *testing.T) {
+	for op, want := range map[Opcode]string{
+		OpMapTCP:                 "MapTCP",
+		OpMapUDP.Response():      "MapUDPResponse",
+		Opcode(7).Response():     "Opcode(7)Response",
+		OpExternalAddress | 0x80: "ExternalAddressResponse",
+	} {
+		if got := op.String(); got != want {
+			t.Errorf("%d.String()=%q != %q", uint8(op), got, want)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range [][]byte{
+		{0x0, 0x0},
+		{0x0, 0x1, 0x0, 0x0, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+		{0x0, 0x80, 0x0, 0x0, 0x0, 0x13, 0xf2, 0x4f, 0x49, 0x8c, 0x36, 0x9a},
+		{0x0, 0x82, 0x0, 0x0, 0x0, 0x14, 0x3, 0x21, 0x0, 0x7b, 0x1, 0xc8, 0x0, 0x0, 0x4, 0xb0},
+		{0x0, 0x83, 0x0, 0x5, 0x0, 0x0, 0x0, 0x10},
+		{0x2, 0x1, 0x0, 0x0},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := Parse(b)
+		if err != nil {
+			if msg != nil {
+				t.Errorf("Parse(%v) returned %+v with error", b, msg)
+			}
+			if !errors.Is(err, ErrLength) && !errors.Is(err, ErrUnsupportedVersion) &&
+				!errors.Is(err, ErrUnsupportedOpcode) && !errors.Is(err, ErrNotResponse) {
+				t.Errorf("Parse(%v) unclassified err: %v", b, err)
+			}
+			return
+		}
+		enc, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary() got err: %v", err)
+		}
+		if len(enc) != len(b) {
+			t.Errorf("MarshalBinary()=%v is not the length of %v", enc, b)
+		}
+		again, err := Parse(enc)
+		if err != nil {
+			t.Fatalf("Parse(MarshalBinary()) got err: %v", err)
+		}
+		if !reflect.DeepEqual(again, msg) {
+			t.Errorf("round trip %+v != %+v", again, msg)
+		}
+	})
+}
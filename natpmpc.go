@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/jackpal/gateway"
+	"github.com/nveeser/go-natpmp/agent"
+	"github.com/nveeser/go-natpmp/broker"
 	"github.com/nveeser/go-natpmp/flags"
 	"github.com/nveeser/go-natpmp/natpmp"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -20,12 +27,26 @@ func main() {
 		flag.Usage()
 		return
 	}
+	if cfg.Command == "list" {
+		if err := listOwners(natpmp.DefaultRegistry()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	gwIP, err := findGatewayIP(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	client := natpmp.NewClient(gwIP, natpmp.Port(cfg.Port))
+	// Claiming the mappings in the registry lets "natpmpc list" show them,
+	// and keeps other processes on this host from taking them over.
+	client := natpmp.NewClient(gwIP, natpmp.Port(cfg.Port), natpmp.WithRegistry(natpmp.DefaultRegistry()))
+	if cfg.HTTPAddr != "" || cfg.BrokerPath != "" {
+		if err := serveAgent(client, &cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if cfg.AddSpec.IsSet() {
 		fmt.Printf("Port: %s %+v\n", &cfg.AddSpec, os.Args[1:])
 		spec := cfg.AddSpec
@@ -49,3 +70,74 @@ func findGatewayIP(c *flags.Config) (gwIP net.IP, err error) {
 	}
 	return gateway.DiscoverGateway()
 }
+
+// serveAgent keeps the mapping given with -a, and those added through the
+// API or the broker, renewed until interrupted, then deletes them.
+func serveAgent(client *natpmp.Client, cfg *flags.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	a := agent.New(client)
+	defer a.Close()
+	if spec := cfg.AddSpec; spec.IsSet() {
+		lifetime := spec.Lifetime
+		if lifetime == 0 {
+			lifetime = natpmp.DefaultLifetime
+		}
+		mapping, err := a.Add(spec.Protocol, spec.IntPort, spec.ExtPort, lifetime)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("RemotePort: %d (%s)\n", mapping.ExternalPort, mapping.Lifetime)
+	}
+
+	errc := make(chan error, 2)
+	var srv *http.Server
+	if cfg.HTTPAddr != "" {
+		var opts []agent.HandlerOption
+		if cfg.HTTPRemote {
+			opts = append(opts, agent.AllowRemote())
+		}
+		srv = &http.Server{Addr: cfg.HTTPAddr, Handler: agent.NewHandler(a, opts...)}
+		go func() { errc <- srv.ListenAndServe() }()
+	}
+	if cfg.BrokerPath != "" {
+		// A socket left by a previous run would fail the Listen.
+		os.Remove(cfg.BrokerPath)
+		l, err := net.Listen("unix", cfg.BrokerPath)
+		if err != nil {
+			return err
+		}
+		b := broker.NewServer(a)
+		defer b.Close()
+		go func() { errc <- b.Serve(l) }()
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	if srv != nil {
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			return err
+		}
+	}
+	return a.Close()
+}
+
+// listOwners prints the mappings claimed by processes on this host.
+func listOwners(r *natpmp.Registry) error {
+	owners, err := r.List()
+	if err != nil {
+		return err
+	}
+	for _, o := range owners {
+		status := ""
+		if o.Stale {
+			status = " (stale: process exited)"
+		}
+		fmt.Printf("PID %d: %s %d -> %d on %s%s\n", o.PID, o.Protocol, o.InternalPort, o.ExternalPort, o.Gateway, status)
+	}
+	return nil
+}
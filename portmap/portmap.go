@@ -0,0 +1,130 @@
+// Package portmap chooses a port-mapping protocol for a gateway. Auto
+// probes NAT-PMP, then PCP, then UPnP IGD, and returns a PortMapper for the
+// first protocol the gateway answers.
+//
+// Usage:
+//
+//	mapper, err := portmap.Auto(ctx, gatewayIP)
+//	mapping, err := mapper.AddPortMapping("tcp", 8080, 8080, natpmp.DefaultLifetime)
+package portmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/upnp"
+)
+
+// PortMapper maps ports on a gateway. Its methods behave like those of
+// natpmp.Client.
+type PortMapper interface {
+	// GetExternalAddress returns the external address of the gateway and,
+	// where the protocol has one, the gateway's epoch.
+	GetExternalAddress() (netip.Addr, time.Duration, error)
+	// AddPortMapping adds, renews or (with a lifetime of 0) deletes a
+	// mapping.
+	AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (*natpmp.PortMapping, error)
+	// DeletePortMapping deletes the mapping for the internal port.
+	DeletePortMapping(protocol string, internalPort int) error
+}
+
+var (
+	_ PortMapper = (*natpmp.Client)(nil)
+	_ PortMapper = (*natpmp.PCPMapper)(nil)
+	_ PortMapper = (*upnp.Client)(nil)
+)
+
+// ErrNotFound is returned by Auto when the gateway answered none of the
+// protocols. The error also holds each protocol's failure.
+var ErrNotFound = errors.New("no port mapping protocol found")
+
+const defaultProbeTimeout = 2 * time.Second
+
+// Option is the type for configuring Auto.
+type Option func(*config)
+
+type config struct {
+	probeTimeout time.Duration
+	natpmpOpts   []natpmp.Option
+	upnpOpts     []upnp.Option
+}
+
+// ProbeTimeout returns an option which sets how long each protocol is given
+// to answer. The default is 2 seconds.
+func ProbeTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.probeTimeout = d
+		}
+	}
+}
+
+// NATPMPOptions returns an option which passes opts to the natpmp.Client
+// used for NAT-PMP and PCP, both while probing and in the returned
+// PortMapper.
+func NATPMPOptions(opts ...natpmp.Option) Option {
+	return func(c *config) {
+		c.natpmpOpts = append(c.natpmpOpts, opts...)
+	}
+}
+
+// UPnPOptions returns an option which passes opts to upnp.Discover.
+func UPnPOptions(opts ...upnp.Option) Option {
+	return func(c *config) {
+		c.upnpOpts = append(c.upnpOpts, opts...)
+	}
+}
+
+// Auto returns a PortMapper for the gateway: a natpmp.Client if it answers
+// NAT-PMP, a natpmp.PCPMapper if it answers NAT-PMP requests with an
+// unsupported version error and then answers PCP (the two share a port),
+// or else a upnp.Client for the Internet Gateway Device found with SSDP.
+func Auto(ctx context.Context, gateway net.IP, opts ...Option) (PortMapper, error) {
+	cfg := config{probeTimeout: defaultProbeTimeout}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	probeTimeout := func() time.Duration {
+		if deadline, ok := ctx.Deadline(); ok {
+			return max(min(cfg.probeTimeout, time.Until(deadline)), time.Millisecond)
+		}
+		return cfg.probeTimeout
+	}
+	probe := func() *natpmp.Client {
+		opts := append([]natpmp.Option{}, cfg.natpmpOpts...)
+		return natpmp.NewClient(gateway, append(opts, natpmp.Timeout(probeTimeout()))...)
+	}
+
+	var errs []error
+	_, _, err := probe().GetExternalAddress()
+	if err == nil {
+		return natpmp.NewClient(gateway, cfg.natpmpOpts...), nil
+	}
+	errs = append(errs, fmt.Errorf("NAT-PMP: %w", err))
+
+	if errors.Is(err, natpmp.UnsupportedVersion) && ctx.Err() == nil {
+		// ANNOUNCE leaves the gateway's mappings as they are.
+		_, err := natpmp.NewPCPMapper(probe()).Probe(ctx)
+		if err == nil {
+			return natpmp.NewPCPMapper(natpmp.NewClient(gateway, cfg.natpmpOpts...)), nil
+		}
+		errs = append(errs, fmt.Errorf("PCP: %w", err))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, probeTimeout())
+	defer cancel()
+	client, err := upnp.Discover(probeCtx, append([]upnp.Option{upnp.Gateway(gateway), upnp.Timeout(probeTimeout())}, cfg.upnpOpts...)...)
+	if err == nil {
+		return client, nil
+	}
+	errs = append(errs, fmt.Errorf("UPnP: %w", err))
+	return nil, fmt.Errorf("%w: %w", ErrNotFound, errors.Join(errs...))
+}
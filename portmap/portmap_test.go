@@ -0,0 +1,125 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/upnp"
+	"github.com/nveeser/go-natpmp/upnp/upnptest"
+)
+
+// fakeGateway answers on the NAT-PMP/PCP port of a local gateway.
+type fakeGateway struct {
+	conn *net.UDPConn
+	// natpmp answers NAT-PMP requests; otherwise they are answered with
+	// UNSUPP_VERSION if pcp is set, and not at all if neither is.
+	natpmp, pcp bool
+	// maps counts the PCP MAP requests.
+	maps *atomic.Int32
+}
+
+func startGateway(t *testing.T, g *fakeGateway) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to start UDP listener: %v", err)
+	}
+	g.conn = conn
+	g.maps = new(atomic.Int32)
+	t.Cleanup(func() { conn.Close() })
+	go g.serve()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil || n < 2 {
+			return
+		}
+		var resp []byte
+		switch {
+		case buf[0] == 0 && g.natpmp:
+			// External address response: 203.0.113.7, epoch 1000.
+			resp = []byte{0, 0x80, 0, 0, 0, 0, 0x03, 0xe8, 203, 0, 113, 7}
+		case buf[0] == 0 && g.pcp:
+			// PCP header with result UNSUPP_VERSION (RFC 6887 section 9).
+			resp = make([]byte, 24)
+			resp[0], resp[1], resp[3] = 2, buf[1]|0x80, 1
+		case buf[0] == 2 && g.pcp && buf[1] == 0 && n >= 24:
+			// Answer the ANNOUNCE request with the epoch.
+			resp = make([]byte, 24)
+			resp[0], resp[1] = 2, 0x80
+			binary.BigEndian.PutUint32(resp[8:], 1000)
+		case buf[0] == 2 && g.pcp && n >= 60:
+			// Grant the MAP request as asked.
+			g.maps.Add(1)
+			resp = make([]byte, 60)
+			copy(resp, buf[:60])
+			resp[1] |= 0x80
+			resp[2], resp[3] = 0, 0
+			binary.BigEndian.PutUint32(resp[8:], 1000)
+			clear(resp[12:24])
+			copy(resp[44:], net.ParseIP("203.0.113.7").To16())
+		default:
+			continue
+		}
+		g.conn.WriteToUDP(resp, from)
+	}
+}
+
+func TestAuto(t *testing.T) {
+	testCases := []struct {
+		name    string
+		gateway fakeGateway
+		upnp    bool
+		want    string
+	}{
+		{name: "NAT-PMP", gateway: fakeGateway{natpmp: true, pcp: true}, upnp: true, want: "*natpmp.Client"},
+		{name: "PCP", gateway: fakeGateway{pcp: true}, upnp: true, want: "*natpmp.PCPMapper"},
+		{name: "UPnP", upnp: true, want: "*upnp.Client"},
+		{name: "none"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			port := startGateway(t, &tc.gateway)
+			srv, err := upnptest.NewServer()
+			if err != nil {
+				t.Fatalf("upnptest.NewServer() failed: %v", err)
+			}
+			defer srv.Close()
+			ssdp := srv.SSDPAddr()
+			if !tc.upnp {
+				srv.Close()
+			}
+
+			m, err := Auto(context.Background(), net.IPv4(127, 0, 0, 1),
+				ProbeTimeout(500*time.Millisecond),
+				NATPMPOptions(natpmp.Port(port)),
+				UPnPOptions(upnp.SSDPAddr(ssdp)))
+			if tc.want == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("Auto() err=%v, want ErrNotFound", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Auto() failed: %v", err)
+			}
+			if got := fmt.Sprintf("%T", m); got != tc.want {
+				t.Errorf("Auto()=%s != %s", got, tc.want)
+			}
+			if n := tc.gateway.maps.Load(); n != 0 {
+				t.Errorf("Auto() sent %d MAP requests while probing", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Package portmaptest provides an in-memory portmap.PortMapper for testing
+// the packages which keep mappings on behalf of others.
+package portmaptest
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/portmap"
+)
+
+// ExternalAddress and Epoch are returned by Mapper.GetExternalAddress.
+var (
+	ExternalAddress = netip.MustParseAddr("203.0.113.5")
+	Epoch           = 1000 * time.Second
+)
+
+var _ portmap.PortMapper = (*Mapper)(nil)
+
+// Mapper is an in-memory PortMapper which records its calls. A new mapping
+// gets the requested external port, or the internal port if none was
+// requested, plus PortOffset; renewals keep the port until the mapping is
+// deleted. It is safe for concurrent use.
+type Mapper struct {
+	// PortOffset is added to the external port of new mappings.
+	PortOffset int
+	// MaxLifetime, when set, caps the lifetime granted.
+	MaxLifetime time.Duration
+
+	mu     sync.Mutex
+	err    error
+	mapped map[string]int
+	calls  []string
+}
+
+// GetExternalAddress returns ExternalAddress and Epoch.
+func (m *Mapper) GetExternalAddress() (netip.Addr, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return netip.Addr{}, 0, m.err
+	}
+	return ExternalAddress, Epoch, nil
+}
+
+// AddPortMapping records the call as "add <protocol> <internal port>
+// <requested port> <lifetime>", and grants the mapping.
+func (m *Mapper) AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (*natpmp.PortMapping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, fmt.Sprintf("add %s %d %d %s", protocol, internalPort, requestedExternalPort, lifetime))
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.mapped == nil {
+		m.mapped = make(map[string]int)
+	}
+	key := fmt.Sprintf("%s/%d", protocol, internalPort)
+	external, ok := m.mapped[key]
+	if !ok {
+		external = max(requestedExternalPort, internalPort) + m.PortOffset
+		m.mapped[key] = external
+	}
+	granted := lifetime
+	if m.MaxLifetime > 0 {
+		granted = min(granted, m.MaxLifetime)
+	}
+	return &natpmp.PortMapping{
+		InternalPort:       uint16(internalPort),
+		MappedExternalPort: uint16(external),
+		Lifetime:           granted,
+		RequestedLifetime:  lifetime,
+	}, nil
+}
+
+// DeletePortMapping records the call as "delete <protocol> <internal
+// port>", and forgets the mapping.
+func (m *Mapper) DeletePortMapping(protocol string, internalPort int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, fmt.Sprintf("delete %s %d", protocol, internalPort))
+	delete(m.mapped, fmt.Sprintf("%s/%d", protocol, internalPort))
+	return m.err
+}
+
+// SetErr makes every request fail with err, until it is set to nil.
+func (m *Mapper) SetErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// Calls returns the calls made so far, in order.
+func (m *Mapper) Calls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.calls...)
+}
@@ -0,0 +1,179 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// Proxy is a Backend which copies the traffic between the host's port and
+// the client in userspace, like docker-proxy. It needs no privileges, but
+// the client sees the connections coming from the host rather than from
+// the remote peer. The zero value listens on all of the host's addresses.
+type Proxy struct {
+	// ListenAddr is the host address the ports are opened on, normally the
+	// host's address on the network facing the gateway.
+	ListenAddr netip.Addr
+	// UDPIdleTimeout is how long a UDP flow is kept without traffic, 2
+	// minutes if zero.
+	UDPIdleTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners map[hostKey]io.Closer
+}
+
+var _ Backend = (*Proxy)(nil)
+
+// Forward opens the host's port and starts copying its traffic to the
+// target.
+func (p *Proxy) Forward(protocol string, hostPort int, target netip.AddrPort) error {
+	key := hostKey{protocol, hostPort}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listeners[key] != nil {
+		return fmt.Errorf("%s port %d is already forwarded", protocol, hostPort)
+	}
+	addr := netip.AddrPortFrom(p.ListenAddr, uint16(hostPort))
+	if !p.ListenAddr.IsValid() {
+		addr = netip.AddrPortFrom(netip.IPv6Unspecified(), uint16(hostPort))
+	}
+	var l io.Closer
+	switch protocol {
+	case "tcp":
+		tl, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(addr))
+		if err != nil {
+			return err
+		}
+		go proxyTCP(tl, target)
+		l = tl
+	case "udp":
+		conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			return err
+		}
+		idle := p.UDPIdleTimeout
+		if idle <= 0 {
+			idle = defaultUDPIdleTimeout
+		}
+		go proxyUDP(conn, target, idle)
+		l = conn
+	default:
+		return fmt.Errorf("unknown protocol %v", protocol)
+	}
+	if p.listeners == nil {
+		p.listeners = make(map[hostKey]io.Closer)
+	}
+	p.listeners[key] = l
+	return nil
+}
+
+// Stop closes the host's port. Connections already proxied are left to
+// finish.
+func (p *Proxy) Stop(protocol string, hostPort int) error {
+	key := hostKey{protocol, hostPort}
+	p.mu.Lock()
+	l := p.listeners[key]
+	delete(p.listeners, key)
+	p.mu.Unlock()
+	if l == nil {
+		return fmt.Errorf("%s port %d is not forwarded", protocol, hostPort)
+	}
+	return l.Close()
+}
+
+func proxyTCP(l *net.TCPListener, target netip.AddrPort) {
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.DialTCP("tcp", nil, net.TCPAddrFromAddrPort(target))
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			done := make(chan struct{})
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.CloseWrite()
+				close(done)
+			}()
+			io.Copy(conn, upstream)
+			conn.CloseWrite()
+			<-done
+		}()
+	}
+}
+
+// proxyUDP relays the datagrams of each remote address through its own
+// socket to the target, so that replies can be sent back to it.
+func proxyUDP(conn *net.UDPConn, target netip.AddrPort, idle time.Duration) {
+	var mu sync.Mutex
+	flows := make(map[netip.AddrPort]*net.UDPConn)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, f := range flows {
+			f.Close()
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, remote, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		f := flows[remote]
+		if f == nil {
+			f, err = net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(target))
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			flows[remote] = f
+			go func() {
+				replyUDP(conn, f, remote, idle)
+				mu.Lock()
+				delete(flows, remote)
+				mu.Unlock()
+				f.Close()
+			}()
+		}
+		mu.Unlock()
+		f.SetReadDeadline(time.Now().Add(idle))
+		f.Write(buf[:n])
+	}
+}
+
+// replyUDP copies the target's replies on the flow back to the remote
+// address, until the flow is idle or closed.
+func replyUDP(conn, flow *net.UDPConn, remote netip.AddrPort, idle time.Duration) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := flow.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				// Such as ECONNREFUSED while the client is not listening.
+				continue
+			}
+			return
+		}
+		flow.SetReadDeadline(time.Now().Add(idle))
+		if _, err := conn.WriteToUDPAddrPort(buf[:n], remote); err != nil {
+			return
+		}
+	}
+}
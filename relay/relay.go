@@ -0,0 +1,513 @@
+// Package relay is a NAT-PMP server for the containers or VMs on a bridge
+// network, which cannot reach the real gateway. A Relay answers their
+// requests by mapping a port of the host on the gateway, and has a Backend
+// forward the host's port on to the client. Applications behind the
+// bridge use NAT-PMP unchanged.
+//
+// Usage:
+//
+//	conn, err := net.ListenPacket("udp4", "172.17.0.1:5351")
+//	r := relay.New(natpmp.NewClient(gatewayIP), &relay.Proxy{}, relay.HostPorts(40000, 40999))
+//	defer r.Close()
+//	err = r.Serve(conn)
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+	"github.com/nveeser/go-natpmp/portmap"
+)
+
+// Backend sets up the inner hop of each mapping, from a port on the host
+// to the client behind the relay: a userspace Proxy, or for example DNAT
+// rules in the host's firewall.
+type Backend interface {
+	// Forward starts forwarding the protocol's traffic arriving on the
+	// host's port to the target. It fails if the port cannot be used, and
+	// the Relay tries another.
+	Forward(protocol string, hostPort int, target netip.AddrPort) error
+	// Stop stops forwarding the host's port.
+	Stop(protocol string, hostPort int) error
+}
+
+const (
+	// reapInterval is how often mappings which have not been renewed are
+	// removed.
+	reapInterval = 30 * time.Second
+	// maxPacketSize is the largest PCP message, so that PCP clients get
+	// an Unsupported Version response.
+	maxPacketSize = 1100
+
+	defaultMaxRequests          = 64
+	defaultMaxMappingsPerClient = 32
+)
+
+// Option is the type for configuring the Relay.
+type Option func(*Relay)
+
+// HostPorts returns an option which sets the range of host ports used when
+// the client's internal port is taken on the host. By default only the
+// client's internal port is tried.
+func HostPorts(first, last int) Option {
+	return func(r *Relay) {
+		if 0 < first && first <= last && last <= 65535 {
+			r.firstPort, r.lastPort = first, last
+		}
+	}
+}
+
+// MaxLifetime returns an option which caps the lifetime requested from the
+// gateway, so that clients renew at least this often. The default is
+// natpmp.DefaultLifetime.
+func MaxLifetime(d time.Duration) Option {
+	return func(r *Relay) {
+		if d >= time.Second {
+			r.maxLifetime = d
+		}
+	}
+}
+
+// MaxRequests returns an option which sets how many requests are answered
+// at once. Requests arriving meanwhile are dropped, and the clients
+// retransmit them. The default is 64.
+func MaxRequests(n int) Option {
+	return func(r *Relay) {
+		if n > 0 {
+			r.maxRequests = n
+		}
+	}
+}
+
+// MaxMappingsPerClient returns an option which sets how many mappings each
+// client may have. Further requests are answered with Out of Resources.
+// The default is 32.
+func MaxMappingsPerClient(n int) Option {
+	return func(r *Relay) {
+		if n > 0 {
+			r.maxPerClient = n
+		}
+	}
+}
+
+// WithClock returns an option which uses the specified Clock for the epoch
+// and lifetimes. Primarily for testing with a clock.Fake.
+func WithClock(c clock.Clock) Option {
+	return func(r *Relay) {
+		r.clock = c
+	}
+}
+
+// Relay answers NAT-PMP requests from the clients behind it. It is safe
+// for concurrent use.
+type Relay struct {
+	upstream    portmap.PortMapper
+	backend     Backend
+	clock       clock.Clock
+	firstPort   int
+	lastPort    int
+	maxLifetime time.Duration
+	start       time.Time
+	// maxRequests bounds the requests being answered, held in requests.
+	maxRequests  int
+	requests     chan struct{}
+	maxPerClient int
+
+	mu sync.Mutex
+	// mappings holds each client's mappings; a nil entry is a request
+	// still in progress.
+	mappings  map[clientKey]*relayed
+	hostPorts map[hostKey]bool
+	conns     map[net.PacketConn]bool
+	closed    bool
+
+	stop     chan struct{}
+	done     chan struct{}
+	closeErr error
+	once     sync.Once
+}
+
+// clientKey identifies a mapping as the client sees it.
+type clientKey struct {
+	protocol     string
+	client       netip.Addr
+	internalPort int
+}
+
+// hostKey identifies the port of a mapping on the host, as the gateway
+// sees it.
+type hostKey struct {
+	protocol string
+	port     int
+}
+
+type relayed struct {
+	hostPort     int
+	externalPort int
+	expires      time.Time
+}
+
+// New returns a Relay which maps host ports with the upstream PortMapper,
+// normally a natpmp.Client for the real gateway, and forwards them to the
+// clients with the backend.
+func New(upstream portmap.PortMapper, backend Backend, opts ...Option) *Relay {
+	r := &Relay{
+		upstream:    upstream,
+		backend:     backend,
+		clock:       clock.Real(),
+		maxLifetime: natpmp.DefaultLifetime,
+		maxRequests: defaultMaxRequests,
+		mappings:    make(map[clientKey]*relayed),
+		hostPorts:   make(map[hostKey]bool),
+		conns:       make(map[net.PacketConn]bool),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	r.maxPerClient = defaultMaxMappingsPerClient
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.requests = make(chan struct{}, r.maxRequests)
+	r.start = r.clock.Now()
+	go r.reap()
+	return r
+}
+
+// Serve answers the requests arriving on conn, normally bound to port 5351
+// of the host's address on the bridge, until conn fails or the Relay is
+// closed. Each request is answered on its own goroutine, as a request to
+// the gateway can take some time; a client which retransmits meanwhile is
+// answered once. Requests beyond MaxRequests are dropped.
+func (r *Relay) Serve(conn net.PacketConn) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return net.ErrClosed
+	}
+	r.conns[conn] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, conn)
+		r.mu.Unlock()
+	}()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		addr, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		select {
+		case r.requests <- struct{}{}:
+		default:
+			// Too many requests are being answered.
+			continue
+		}
+		client := addr.AddrPort()
+		packet := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-r.requests }()
+			resp := r.handle(client.Addr().Unmap(), packet)
+			if resp == nil {
+				return
+			}
+			if b, err := resp.MarshalBinary(); err == nil {
+				conn.WriteTo(b, net.UDPAddrFromAddrPort(client))
+			}
+		}()
+	}
+}
+
+// Close stops serving, and deletes the mappings from the gateway and the
+// backend.
+func (r *Relay) Close() error {
+	r.once.Do(func() {
+		close(r.stop)
+		<-r.done
+		r.mu.Lock()
+		r.closed = true
+		for conn := range r.conns {
+			conn.Close()
+		}
+		released := r.take(func(clientKey, *relayed) bool { return true })
+		r.mu.Unlock()
+		r.closeErr = r.release(released)
+	})
+	return r.closeErr
+}
+
+// epoch returns the seconds since the Relay started, so the clients
+// recreate their mappings after it restarts.
+func (r *Relay) epoch() uint32 {
+	return uint32(r.clock.Now().Sub(r.start) / time.Second)
+}
+
+// handle returns the response to the packet from the client, or nil if it
+// is to be dropped.
+func (r *Relay) handle(client netip.Addr, packet []byte) wire.Response {
+	req, err := wire.ParseRequest(packet)
+	switch {
+	case errors.Is(err, wire.ErrUnsupportedVersion):
+		return r.errorResponse(packet, wire.UnsupportedVersion)
+	case errors.Is(err, wire.ErrUnsupportedOpcode):
+		return r.errorResponse(packet, wire.UnsupportedOpcode)
+	case err != nil:
+		return nil
+	}
+	switch req := req.(type) {
+	case *wire.ExternalAddressRequest:
+		return r.externalAddress()
+	case *wire.MappingRequest:
+		return r.mapping(client, req)
+	}
+	return nil
+}
+
+func (r *Relay) errorResponse(packet []byte, result wire.ResultCode) wire.Response {
+	op := wire.Opcode(packet[1])
+	if op.IsResponse() {
+		return nil
+	}
+	return &wire.ErrorResponse{ResponseHeader: r.header(op, result)}
+}
+
+func (r *Relay) header(op wire.Opcode, result wire.ResultCode) wire.ResponseHeader {
+	return wire.ResponseHeader{Opcode: op.Response(), ResultCode: result, EpochSecs: r.epoch()}
+}
+
+func (r *Relay) externalAddress() wire.Response {
+	addr, _, err := r.upstream.GetExternalAddress()
+	if err != nil {
+		return &wire.ErrorResponse{ResponseHeader: r.header(wire.OpExternalAddress, resultCode(err))}
+	}
+	if !addr.Unmap().Is4() {
+		return &wire.ErrorResponse{ResponseHeader: r.header(wire.OpExternalAddress, wire.NetworkFailure)}
+	}
+	return &wire.ExternalAddressResponse{
+		ResponseHeader: r.header(wire.OpExternalAddress, wire.Success),
+		ExternalAddr:   addr.Unmap().As4(),
+	}
+}
+
+// mapping creates, renews or deletes the client's mapping. The gateway is
+// asked to map a host port, which the response rewrites to the client's
+// internal port.
+func (r *Relay) mapping(client netip.Addr, req *wire.MappingRequest) wire.Response {
+	protocol := "udp"
+	if req.Opcode == wire.OpMapTCP {
+		protocol = "tcp"
+	}
+	if req.LifetimeSecs == 0 {
+		return r.delete(client, protocol, req)
+	}
+	key := clientKey{protocol, client, int(req.InternalPort)}
+	r.mu.Lock()
+	m, ok := r.mappings[key]
+	if r.closed || (ok && m == nil) {
+		// The client retransmitted while the request is in progress.
+		r.mu.Unlock()
+		return nil
+	}
+	if !ok && r.clientMappings(client) >= r.maxPerClient {
+		r.mu.Unlock()
+		return &wire.ErrorResponse{ResponseHeader: r.header(req.Opcode, wire.OutOfResources)}
+	}
+	r.mappings[key] = nil
+	fresh := m == nil
+	r.mu.Unlock()
+	if fresh {
+		m = &relayed{hostPort: r.forward(key)}
+	}
+
+	restore := func() {
+		r.mu.Lock()
+		if !fresh {
+			r.mappings[key] = m
+			r.mu.Unlock()
+			return
+		}
+		delete(r.mappings, key)
+		r.mu.Unlock()
+		if m.hostPort != 0 {
+			r.backend.Stop(protocol, m.hostPort)
+			r.mu.Lock()
+			delete(r.hostPorts, hostKey{protocol, m.hostPort})
+			r.mu.Unlock()
+		}
+	}
+	if m.hostPort == 0 {
+		restore()
+		return &wire.ErrorResponse{ResponseHeader: r.header(req.Opcode, wire.OutOfResources)}
+	}
+	lifetime := min(time.Duration(req.LifetimeSecs)*time.Second, r.maxLifetime)
+	suggested := int(req.SuggestedExternalPort)
+	if suggested == 0 {
+		suggested = m.externalPort
+	}
+	granted, err := r.upstream.AddPortMapping(protocol, m.hostPort, suggested, lifetime)
+	if err != nil {
+		restore()
+		return &wire.ErrorResponse{ResponseHeader: r.header(req.Opcode, resultCode(err))}
+	}
+
+	r.mu.Lock()
+	m.externalPort = int(granted.MappedExternalPort)
+	m.expires = r.clock.Now().Add(granted.Lifetime)
+	if r.closed {
+		// Close did not see the mapping while it was in progress.
+		delete(r.mappings, key)
+		r.mu.Unlock()
+		r.release(map[clientKey]*relayed{key: m})
+		return nil
+	}
+	r.mappings[key] = m
+	r.mu.Unlock()
+	return &wire.MappingResponse{
+		ResponseHeader:     r.header(req.Opcode, wire.Success),
+		InternalPort:       req.InternalPort,
+		MappedExternalPort: granted.MappedExternalPort,
+		LifetimeSecs:       uint32(granted.Lifetime / time.Second),
+	}
+}
+
+// clientMappings returns the number of mappings the client has, including
+// those in progress. r.mu is held.
+func (r *Relay) clientMappings(client netip.Addr) int {
+	n := 0
+	for key := range r.mappings {
+		if key.client == client {
+			n++
+		}
+	}
+	return n
+}
+
+// forward chooses a free host port for the mapping, trying the client's
+// internal port first, and starts the backend forwarding it. It returns 0
+// if no port could be used. The backend may be slow, so it is called
+// without r.mu held, on a port reserved in r.hostPorts beforehand.
+func (r *Relay) forward(key clientKey) int {
+	target := netip.AddrPortFrom(key.client, uint16(key.internalPort))
+	try := func(port int) bool {
+		hk := hostKey{key.protocol, port}
+		r.mu.Lock()
+		if r.hostPorts[hk] {
+			r.mu.Unlock()
+			return false
+		}
+		r.hostPorts[hk] = true
+		r.mu.Unlock()
+		if r.backend.Forward(key.protocol, port, target) == nil {
+			return true
+		}
+		r.mu.Lock()
+		delete(r.hostPorts, hk)
+		r.mu.Unlock()
+		return false
+	}
+	if try(key.internalPort) {
+		return key.internalPort
+	}
+	for port := r.firstPort; port != 0 && port <= r.lastPort; port++ {
+		if try(port) {
+			return port
+		}
+	}
+	return 0
+}
+
+// delete removes the client's mapping for the internal port, or with an
+// internal port of 0 all of its mappings for the protocol. Deleting a
+// mapping which does not exist succeeds, as with a gateway.
+func (r *Relay) delete(client netip.Addr, protocol string, req *wire.MappingRequest) wire.Response {
+	r.mu.Lock()
+	released := r.take(func(key clientKey, _ *relayed) bool {
+		return key.client == client && key.protocol == protocol &&
+			(req.InternalPort == 0 || key.internalPort == int(req.InternalPort))
+	})
+	r.mu.Unlock()
+	if err := r.release(released); err != nil {
+		return &wire.ErrorResponse{ResponseHeader: r.header(req.Opcode, resultCode(err))}
+	}
+	return &wire.MappingResponse{
+		ResponseHeader: r.header(req.Opcode, wire.Success),
+		InternalPort:   req.InternalPort,
+	}
+}
+
+// take removes the mappings which match from r.mappings, skipping those
+// in progress. r.mu is held.
+func (r *Relay) take(match func(clientKey, *relayed) bool) map[clientKey]*relayed {
+	taken := make(map[clientKey]*relayed)
+	for key, m := range r.mappings {
+		if m != nil && match(key, m) {
+			delete(r.mappings, key)
+			taken[key] = m
+		}
+	}
+	return taken
+}
+
+// release deletes the mappings taken from r.mappings from the gateway and
+// the backend, then frees their host ports.
+func (r *Relay) release(taken map[clientKey]*relayed) error {
+	var errs []error
+	for key, m := range taken {
+		if err := r.upstream.DeletePortMapping(key.protocol, m.hostPort); err != nil {
+			errs = append(errs, err)
+		}
+		if err := r.backend.Stop(key.protocol, m.hostPort); err != nil {
+			errs = append(errs, fmt.Errorf("error stopping %s port %d: %w", key.protocol, m.hostPort, err))
+		}
+	}
+	r.mu.Lock()
+	for key, m := range taken {
+		delete(r.hostPorts, hostKey{key.protocol, m.hostPort})
+	}
+	r.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// reap removes the mappings whose clients stopped renewing them.
+func (r *Relay) reap() {
+	defer close(r.done)
+	timer := r.clock.NewTimer(reapInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-timer.C():
+		}
+		now := r.clock.Now()
+		r.mu.Lock()
+		expired := r.take(func(_ clientKey, m *relayed) bool { return !now.Before(m.expires) })
+		r.mu.Unlock()
+		r.release(expired)
+		timer.Reset(reapInterval)
+	}
+}
+
+// resultCode returns the result code for the clients when the gateway
+// fails a request.
+func resultCode(err error) wire.ResultCode {
+	var rc natpmp.ResultCodeErr
+	switch {
+	case errors.As(err, &rc) && rc != natpmp.UnsupportedVersion && rc != natpmp.UnsupportedOpcode:
+		return wire.ResultCode(rc)
+	case errors.Is(err, natpmp.ErrMappingOwned):
+		return wire.NotAuthorized
+	}
+	return wire.NetworkFailure
+}
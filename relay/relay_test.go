@@ -0,0 +1,379 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+	"github.com/nveeser/go-natpmp/natpmp/clock"
+	"github.com/nveeser/go-natpmp/natpmp/wire"
+	"github.com/nveeser/go-natpmp/portmap/portmaptest"
+)
+
+// fakeBackend records the forwarding, and fails for the busy host ports.
+type fakeBackend struct {
+	mu    sync.Mutex
+	busy  map[int]bool
+	calls []string
+}
+
+func (f *fakeBackend) Forward(protocol string, hostPort int, target netip.AddrPort) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.busy[hostPort] {
+		return fmt.Errorf("port %d in use", hostPort)
+	}
+	f.calls = append(f.calls, fmt.Sprintf("forward %s %d %s", protocol, hostPort, target))
+	return nil
+}
+
+func (f *fakeBackend) Stop(protocol string, hostPort int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, fmt.Sprintf("stop %s %d", protocol, hostPort))
+	return nil
+}
+
+func (f *fakeBackend) callLog() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// startRelay serves the relay on a loopback port, and returns a client
+// for it.
+func startRelay(t *testing.T, r *Relay) *natpmp.Client {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Serve(conn)
+	t.Cleanup(func() { r.Close() })
+	return natpmp.NewClient(net.IPv4(127, 0, 0, 1), natpmp.Port(conn.LocalAddr().(*net.UDPAddr).Port), natpmp.Timeout(5*time.Second))
+}
+
+func TestRelay(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1e9, 0))
+	upstream := &portmaptest.Mapper{PortOffset: 1000, MaxLifetime: time.Hour}
+	backend := &fakeBackend{busy: map[int]bool{5000: true, 40000: true}}
+	r := New(upstream, backend, HostPorts(40000, 40010), MaxLifetime(90*time.Minute), WithClock(fake))
+	client := startRelay(t, r)
+
+	fake.Advance(10 * time.Second)
+	addr, epoch, err := client.GetExternalAddress()
+	if err != nil || addr != netip.MustParseAddr("203.0.113.5") || epoch != 10*time.Second {
+		t.Errorf("GetExternalAddress()=%v, %s, %v; want the gateway's address and the relay's epoch", addr, epoch, err)
+	}
+
+	m, err := client.AddPortMapping("tcp", 8080, 80, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("AddPortMapping() failed: %v", err)
+	}
+	if m.InternalPort != 8080 || m.MappedExternalPort != 9080 || m.Lifetime != time.Hour {
+		t.Errorf("AddPortMapping()=%+v, want 8080 -> 9080 for 1h", m)
+	}
+	// The client's port is busy on the host, so one from the range is used.
+	m, err = client.AddPortMapping("udp", 5000, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("AddPortMapping() failed: %v", err)
+	}
+	if m.InternalPort != 5000 || m.MappedExternalPort != 41001 {
+		t.Errorf("AddPortMapping()=%+v, want 5000 -> 41001", m)
+	}
+	// Renewing keeps the host port and the external port.
+	if _, err := client.AddPortMapping("udp", 5000, 0, time.Hour); err != nil {
+		t.Fatalf("AddPortMapping() renewal failed: %v", err)
+	}
+	if err := client.DeletePortMapping("udp", 5000); err != nil {
+		t.Fatalf("DeletePortMapping() failed: %v", err)
+	}
+
+	upstream.SetErr(natpmp.OutOfResources)
+	if _, err := client.AddPortMapping("tcp", 22, 0, time.Hour); !errors.Is(err, natpmp.OutOfResources) {
+		t.Errorf("AddPortMapping() err=%v, want the gateway's OutOfResources", err)
+	}
+	upstream.SetErr(nil)
+
+	// The tcp mapping is not renewed, so it is removed after it expires.
+	fake.Advance(time.Hour + reapInterval)
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(upstream.Calls(), "delete tcp 8080") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired mapping not deleted; calls=%q", upstream.Calls())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	wantUpstream := []string{
+		"add tcp 8080 80 1h30m0s",
+		"add udp 40001 0 1h0m0s",
+		"add udp 40001 41001 1h0m0s",
+		"delete udp 40001",
+		"add tcp 22 0 1h0m0s",
+		"delete tcp 8080",
+	}
+	if got := upstream.Calls(); !slices.Equal(got, wantUpstream) {
+		t.Errorf("upstream calls=%q, want %q", got, wantUpstream)
+	}
+	wantBackend := []string{
+		"forward tcp 8080 127.0.0.1:8080",
+		"forward udp 40001 127.0.0.1:5000",
+		"stop udp 40001",
+		"forward tcp 22 127.0.0.1:22",
+		"stop tcp 22",
+		"stop tcp 8080",
+	}
+	if got := backend.callLog(); !slices.Equal(got, wantBackend) {
+		t.Errorf("backend calls=%q, want %q", got, wantBackend)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	client := netip.MustParseAddr("172.17.0.2")
+	testCases := []struct {
+		name   string
+		packet []byte
+		want   []byte
+	}{
+		{
+			name:   "pcp",
+			packet: append([]byte{2, 1}, make([]byte, 58)...),
+			want:   []byte{0, 0x81, 0, 1, 0, 0, 0, 0},
+		},
+		{
+			name:   "unknown opcode",
+			packet: []byte{0, 3},
+			want:   []byte{0, 0x83, 0, 5, 0, 0, 0, 0},
+		},
+		{
+			name:   "delete unknown mapping",
+			packet: []byte{0, 1, 0, 0, 0x13, 0x88, 0, 0, 0, 0, 0, 0},
+			want:   []byte{0, 0x81, 0, 0, 0, 0, 0, 0, 0x13, 0x88, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:   "short request",
+			packet: []byte{0, 1, 0, 0},
+		},
+		{
+			name:   "response",
+			packet: []byte{0, 0x80, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4},
+		},
+	}
+	r := New(&portmaptest.Mapper{PortOffset: 1000}, &fakeBackend{}, WithClock(clock.NewFake(time.Unix(1e9, 0))))
+	defer r.Close()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []byte
+			if resp := r.handle(client, tc.packet); resp != nil {
+				got, _ = resp.MarshalBinary()
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("handle()=%v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// slowBackend blocks forwarding the host port until released.
+type slowBackend struct {
+	*fakeBackend
+	port             int
+	started, release chan struct{}
+}
+
+func (s *slowBackend) Forward(protocol string, hostPort int, target netip.AddrPort) error {
+	if hostPort == s.port {
+		close(s.started)
+		<-s.release
+	}
+	return s.fakeBackend.Forward(protocol, hostPort, target)
+}
+
+func TestRelaySlowBackend(t *testing.T) {
+	backend := &slowBackend{fakeBackend: &fakeBackend{}, port: 6000, started: make(chan struct{}), release: make(chan struct{})}
+	r := New(&portmaptest.Mapper{PortOffset: 1000}, backend, WithClock(clock.NewFake(time.Unix(1e9, 0))))
+	defer r.Close()
+
+	slow := make(chan wire.Response)
+	go func() {
+		slow <- r.handle(netip.MustParseAddr("172.17.0.2"), []byte{0, 1, 0, 0, 0x17, 0x70, 0, 0, 0, 0, 0x0e, 0x10})
+	}()
+	<-backend.started
+	// Another client is served while the backend is busy.
+	resp := r.handle(netip.MustParseAddr("172.17.0.3"), []byte{0, 1, 0, 0, 0x1b, 0x58, 0, 0, 0, 0, 0x0e, 0x10})
+	if m, ok := resp.(*wire.MappingResponse); !ok || m.ResultCode != 0 || m.MappedExternalPort != 8000 {
+		t.Errorf("handle()=%+v, want 7000 -> 8000", resp)
+	}
+	close(backend.release)
+	if m, ok := (<-slow).(*wire.MappingResponse); !ok || m.ResultCode != 0 || m.MappedExternalPort != 7000 {
+		t.Errorf("handle()=%+v, want 6000 -> 7000", m)
+	}
+}
+
+func TestRelayMaxMappingsPerClient(t *testing.T) {
+	r := New(&portmaptest.Mapper{PortOffset: 1000}, &fakeBackend{}, MaxMappingsPerClient(2), WithClock(clock.NewFake(time.Unix(1e9, 0))))
+	defer r.Close()
+	request := func(client string, port byte) wire.ResultCode {
+		t.Helper()
+		resp := r.handle(netip.MustParseAddr(client), []byte{0, 1, 0, 0, 0x17, port, 0, 0, 0, 0, 0x0e, 0x10})
+		if resp == nil {
+			t.Fatalf("handle() dropped the request")
+		}
+		return resp.Result()
+	}
+	for _, port := range []byte{1, 2} {
+		if got := request("172.17.0.2", port); got != wire.Success {
+			t.Errorf("mapping %d: result %s", port, got)
+		}
+	}
+	if got := request("172.17.0.2", 3); got != wire.OutOfResources {
+		t.Errorf("third mapping: result %s, want %s", got, wire.OutOfResources)
+	}
+	// Renewals and other clients are not affected.
+	if got := request("172.17.0.2", 1); got != wire.Success {
+		t.Errorf("renewal: result %s", got)
+	}
+	if got := request("172.17.0.3", 3); got != wire.Success {
+		t.Errorf("other client: result %s", got)
+	}
+}
+
+func TestRelayMaxRequests(t *testing.T) {
+	backend := &slowBackend{fakeBackend: &fakeBackend{}, port: 6000, started: make(chan struct{}), release: make(chan struct{})}
+	r := New(&portmaptest.Mapper{PortOffset: 1000}, backend, MaxRequests(1), WithClock(clock.NewFake(time.Unix(1e9, 0))))
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Serve(conn)
+	defer r.Close()
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Write([]byte{0, 1, 0, 0, 0x17, 0x70, 0, 0, 0, 0, 0x0e, 0x10})
+	<-backend.started
+	// The relay is busy with the first request, so the second is dropped.
+	client.Write([]byte{0, 0})
+	// Give Serve time to read it before the first request finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(backend.release)
+	buf := make([]byte, 16)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() failed: %v", err)
+	}
+	if resp, err := wire.ParseResponse(buf[:n]); err != nil || resp.Op() != wire.OpMapUDP.Response() {
+		t.Errorf("response=%v, %v; want the mapping", resp, err)
+	}
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(buf); err == nil {
+		t.Errorf("the dropped request was answered")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	echoTCP, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoTCP.Close()
+	go func() {
+		for {
+			conn, err := echoTCP.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	echoUDP, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoUDP.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echoUDP.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echoUDP.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	p := &Proxy{ListenAddr: netip.MustParseAddr("127.0.0.1")}
+	testCases := []struct {
+		protocol string
+		target   net.Addr
+	}{
+		{"tcp", echoTCP.Addr()},
+		{"udp", echoUDP.LocalAddr()},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.protocol, func(t *testing.T) {
+			port := freePort(t, tc.protocol)
+			target := netip.MustParseAddrPort(tc.target.String())
+			if err := p.Forward(tc.protocol, port, target); err != nil {
+				t.Fatalf("Forward() failed: %v", err)
+			}
+			if err := p.Forward(tc.protocol, port, target); err == nil {
+				t.Errorf("Forward() of a forwarded port succeeded")
+			}
+			conn, err := net.Dial(tc.protocol, fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Errorf("read %q, %v through the proxy, want the echo", buf, err)
+			}
+			if err := p.Stop(tc.protocol, port); err != nil {
+				t.Errorf("Stop() failed: %v", err)
+			}
+			if err := p.Stop(tc.protocol, port); err == nil {
+				t.Errorf("Stop() of a stopped port succeeded")
+			}
+		})
+	}
+}
+
+// freePort returns a loopback port which is not in use.
+func freePort(t *testing.T, protocol string) int {
+	t.Helper()
+	if protocol == "tcp" {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr).Port
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
@@ -0,0 +1,276 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+const (
+	ssdpMulticastAddr = "239.255.255.250:1900"
+	igdDeviceType     = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	defaultTimeout    = 3 * time.Second
+	// maxDescription bounds the size of a device description.
+	maxDescription = 1 << 20
+)
+
+// serviceTypes are the services which can map ports, most preferred first.
+var serviceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// ErrNoGateway is returned by Discover when no Internet Gateway Device
+// answered.
+var ErrNoGateway = errors.New("no UPnP Internet Gateway Device found")
+
+// Option is the type for configuring discovery and the Client.
+type Option func(*config)
+
+type config struct {
+	ssdpAddr    string
+	gateway     netip.Addr
+	httpClient  *http.Client
+	description string
+	timeout     time.Duration
+}
+
+// SSDPAddr returns an option which sends discovery requests to addr instead
+// of the SSDP multicast address. Primarily for testing.
+func SSDPAddr(addr string) Option {
+	return func(c *config) {
+		c.ssdpAddr = addr
+	}
+}
+
+// Gateway returns an option which only accepts the Internet Gateway
+// Device at ip. Discover ignores SSDP responses from other hosts, and a
+// device whose description or control URL is on another host is refused,
+// so that another host on the network cannot pose as the router.
+func Gateway(ip net.IP) Option {
+	return func(c *config) {
+		c.gateway, _ = netip.AddrFromSlice(ip)
+		c.gateway = c.gateway.Unmap()
+	}
+}
+
+// HTTPClient returns an option which uses the specified http.Client to
+// fetch the device description and send SOAP requests.
+func HTTPClient(client *http.Client) Option {
+	return func(c *config) {
+		c.httpClient = client
+	}
+}
+
+// Description returns an option which sets the description given to the
+// mappings, shown in the router's UI.
+func Description(description string) Option {
+	return func(c *config) {
+		c.description = description
+	}
+}
+
+// Timeout returns an option which sets how long Discover waits for
+// gateways to answer, and the timeout for each HTTP request if no
+// http.Client is given.
+func Timeout(timeout time.Duration) Option {
+	return func(c *config) {
+		if timeout > 0 {
+			c.timeout = timeout
+		}
+	}
+}
+
+func newConfig(opts []Option) config {
+	cfg := config{
+		ssdpAddr:    ssdpMulticastAddr,
+		description: "go-natpmp",
+		timeout:     defaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.httpClient == nil {
+		cfg.httpClient = &http.Client{Timeout: cfg.timeout}
+	}
+	return cfg
+}
+
+// Discover finds an Internet Gateway Device on the local network with an
+// SSDP search and returns a Client for the first one which has a service
+// that can map ports. Unless the Gateway option is given, any host on the
+// network which answers is accepted.
+func Discover(ctx context.Context, opts ...Option) (*Client, error) {
+	cfg := newConfig(opts)
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	dst, err := net.ResolveUDPAddr("udp4", cfg.ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpMulticastAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: " + igdDeviceType + "\r\n" +
+		"\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), dst); err != nil {
+		return nil, fmt.Errorf("error sending SSDP search: %w", err)
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, errors.Join(append([]error{ErrNoGateway}, errs...)...)
+			}
+			return nil, err
+		}
+		if cfg.gateway.IsValid() && src.AddrPort().Addr().Unmap() != cfg.gateway {
+			continue
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+		c, err := newClient(ctx, location, cfg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return c, nil
+	}
+}
+
+// checkHost checks that the URL is on the gateway, if one was given.
+func (c config) checkHost(u *url.URL) error {
+	if !c.gateway.IsValid() {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err != nil || addr.Unmap() != c.gateway {
+		return fmt.Errorf("%s is not on the gateway %s", u, c.gateway)
+	}
+	return nil
+}
+
+// NewClient returns a Client for the gateway whose device description is
+// at location, as found by SSDP.
+func NewClient(ctx context.Context, location string, opts ...Option) (*Client, error) {
+	return newClient(ctx, location, newConfig(opts))
+}
+
+func newClient(ctx context.Context, location string, cfg config) (*Client, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkHost(base); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cfg.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching %s: %s", location, resp.Status)
+	}
+	var root rootDesc
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxDescription)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", location, err)
+	}
+	if root.URLBase != "" {
+		if base, err = url.Parse(root.URLBase); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, st := range serviceTypes {
+		svc, ok := root.Device.find(st)
+		if !ok {
+			continue
+		}
+		control, err := base.Parse(svc.ControlURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.checkHost(control); err != nil {
+			return nil, err
+		}
+		local, err := localAddr(control)
+		if err != nil {
+			return nil, err
+		}
+		return &Client{
+			controlURL:     control.String(),
+			serviceType:    st,
+			httpClient:     cfg.httpClient,
+			description:    cfg.description,
+			internalClient: local,
+			external:       make(map[mappingKey]int),
+		}, nil
+	}
+	return nil, fmt.Errorf("%s has no WANIPConnection or WANPPPConnection service", location)
+}
+
+type rootDesc struct {
+	URLBase string `xml:"URLBase"`
+	Device  device `xml:"device"`
+}
+
+type device struct {
+	DeviceType string    `xml:"deviceType"`
+	Services   []service `xml:"serviceList>service"`
+	Devices    []device  `xml:"deviceList>device"`
+}
+
+type service struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// find returns the service of the type in the device or its sub-devices.
+func (d *device) find(serviceType string) (service, bool) {
+	for _, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return s, true
+		}
+	}
+	for i := range d.Devices {
+		if s, ok := d.Devices[i].find(serviceType); ok {
+			return s, true
+		}
+	}
+	return service{}, false
+}
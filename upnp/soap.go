@@ -0,0 +1,92 @@
+package upnp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// arg is an argument to a SOAP action. UPnP requires the arguments in the
+// order the service description lists them, so they are kept in a slice.
+type arg struct {
+	name, value string
+}
+
+// maxSOAPResponse bounds the size of a response read from the gateway.
+const maxSOAPResponse = 64 << 10
+
+// call invokes the action on the gateway's control URL and returns the
+// values of the output arguments by name.
+func (c *Client) call(ctx context.Context, action string, args []arg) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` + "\n" +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + c.serviceType + `">`)
+	for _, a := range args {
+		body.WriteString("<" + a.name + ">")
+		xml.EscapeText(&body, []byte(a.value))
+		body.WriteString("</" + a.name + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", strconv.Quote(c.serviceType+"#"+action))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	values, err := soapValues(io.LimitReader(resp.Body, maxSOAPResponse))
+	switch {
+	case resp.StatusCode == http.StatusInternalServerError && values["errorCode"] != "":
+		code, _ := strconv.Atoi(values["errorCode"])
+		return nil, &Error{Code: ErrorCode(code), Description: values["errorDescription"]}
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	case err != nil:
+		return nil, fmt.Errorf("error parsing SOAP response: %w", err)
+	}
+	return values, nil
+}
+
+// soapValues returns the text of each element in the SOAP response which
+// has no child elements, by its local name. Both the output arguments and
+// the fields of a UPnPError fault are such elements.
+func soapValues(r io.Reader) (map[string]string, error) {
+	d := xml.NewDecoder(r)
+	values := make(map[string]string)
+	var name string
+	var text strings.Builder
+	leaf := false
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return values, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name, leaf = t.Name.Local, true
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if leaf {
+				values[name] = text.String()
+			}
+			leaf = false
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package upnp implements a UPnP Internet Gateway Device (IGD) client for
+// mapping ports, for the many consumer routers which support UPnP but not
+// NAT-PMP or PCP. Client has the same methods as natpmp.Client, so either
+// can be used as a portmap.PortMapper.
+//
+// Usage:
+//
+//	client, err := upnp.Discover(ctx)
+//	mapping, err := client.AddPortMapping("tcp", 8080, 8080, natpmp.DefaultLifetime)
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nveeser/go-natpmp/natpmp"
+)
+
+// ErrorCode is a UPnP error code returned by the gateway. The codes most
+// often seen when mapping ports are provided as constants, so a failure can
+// be checked with errors.Is(err, upnp.ConflictInMappingEntry).
+type ErrorCode int
+
+const (
+	InvalidAction                ErrorCode = 401
+	ActionFailed                 ErrorCode = 501
+	NoSuchEntryInArray           ErrorCode = 714
+	ConflictInMappingEntry       ErrorCode = 718
+	OnlyPermanentLeasesSupported ErrorCode = 725
+)
+
+func (e ErrorCode) Error() string {
+	return fmt.Sprintf("UPnP error %d", int(e))
+}
+
+// Error is a SOAP fault returned by the gateway. It matches its ErrorCode
+// using errors.Is.
+type Error struct {
+	Code        ErrorCode
+	Description string
+}
+
+func (e *Error) Is(err error) bool { return err == e.Code }
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", int(e.Code), e.Description)
+}
+
+// maxLease is the longest lease IGD:2 gateways accept (one week).
+const maxLease = 604800 * time.Second
+
+// Client is a UPnP IGD client for one gateway's WANIPConnection or
+// WANPPPConnection service. It is safe for concurrent use.
+type Client struct {
+	controlURL  string
+	serviceType string
+	httpClient  *http.Client
+	description string
+	// internalClient is this host's address on the gateway's network.
+	internalClient netip.Addr
+
+	mu sync.Mutex
+	// external holds the external port of each mapping, since the gateway
+	// identifies mappings by their external port.
+	external map[mappingKey]int
+}
+
+type mappingKey struct {
+	protocol     string
+	internalPort int
+}
+
+// GetExternalAddress returns the external address of the router. There is
+// no epoch in UPnP, so the returned duration is always 0.
+func (c *Client) GetExternalAddress() (addr netip.Addr, duration time.Duration, err error) {
+	result, err := c.call(context.Background(), "GetExternalIPAddress", nil)
+	if err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("GetExternalIPAddress Failed: %w", err)
+	}
+	addr, err = netip.ParseAddr(strings.TrimSpace(result["NewExternalIPAddress"]))
+	if err != nil {
+		return netip.Addr{}, 0, fmt.Errorf("GetExternalIPAddress Failed: %w", err)
+	}
+	return addr, 0, nil
+}
+
+// AddPortMapping adds (or, with a lifetime of 0, deletes) a port mapping,
+// with the same arguments as natpmp.Client.AddPortMapping. UPnP maps
+// exactly the requested external port (the internal port if 0) or fails,
+// typically with ConflictInMappingEntry. A gateway which only supports
+// permanent mappings is sent a lease of 0, and the returned Lifetime is 0.
+func (c *Client) AddPortMapping(protocol string, internalPort, requestedExternalPort int, lifetime time.Duration) (*natpmp.PortMapping, error) {
+	if lifetime == 0 {
+		return &natpmp.PortMapping{InternalPort: uint16(internalPort)}, c.DeletePortMapping(protocol, internalPort)
+	}
+	proto, err := upnpProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+	if lifetime < 0 {
+		return nil, fmt.Errorf("%w: %s is negative", natpmp.ErrInvalidLifetime, lifetime)
+	}
+	lease := min(lifetime.Round(time.Second), maxLease)
+	if lease == 0 {
+		return nil, fmt.Errorf("%w: %s rounds to 0 seconds, which deletes the mapping", natpmp.ErrInvalidLifetime, lifetime)
+	}
+	external := requestedExternalPort
+	if external == 0 {
+		external = internalPort
+	}
+
+	granted := lease
+	args := func(lease time.Duration) []arg {
+		return []arg{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(external)},
+			{"NewProtocol", proto},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", c.internalClient.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", c.description},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		}
+	}
+	_, err = c.call(context.Background(), "AddPortMapping", args(lease))
+	if errors.Is(err, OnlyPermanentLeasesSupported) {
+		granted = 0
+		_, err = c.call(context.Background(), "AddPortMapping", args(0))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("AddPortMapping Failed: %w", err)
+	}
+	c.mu.Lock()
+	c.external[mappingKey{protocol, internalPort}] = external
+	c.mu.Unlock()
+	return &natpmp.PortMapping{
+		InternalPort:       uint16(internalPort),
+		MappedExternalPort: uint16(external),
+		Lifetime:           granted,
+		RequestedLifetime:  lease,
+		InternalAddr:       c.internalClient,
+	}, nil
+}
+
+// DeletePortMapping deletes the mapping for the internal port. Mappings not
+// made by this Client are assumed to use the internal port externally.
+func (c *Client) DeletePortMapping(protocol string, internalPort int) error {
+	proto, err := upnpProtocol(protocol)
+	if err != nil {
+		return err
+	}
+	key := mappingKey{protocol, internalPort}
+	c.mu.Lock()
+	external, ok := c.external[key]
+	c.mu.Unlock()
+	if !ok {
+		external = internalPort
+	}
+	_, err = c.call(context.Background(), "DeletePortMapping", []arg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", proto},
+	})
+	if err != nil {
+		return fmt.Errorf("DeletePortMapping Failed: %w", err)
+	}
+	c.mu.Lock()
+	delete(c.external, key)
+	c.mu.Unlock()
+	return nil
+}
+
+func upnpProtocol(protocol string) (string, error) {
+	switch protocol {
+	case "udp":
+		return "UDP", nil
+	case "tcp":
+		return "TCP", nil
+	}
+	return "", fmt.Errorf("unknown protocol %v", protocol)
+}
+
+// localAddr returns the local address used to reach the host in the URL.
+// Dialing UDP sends nothing; it only picks the route.
+func localAddr(u *url.URL) (netip.Addr, error) {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	if !addr.IsValid() || addr.IsUnspecified() {
+		return netip.Addr{}, fmt.Errorf("no local address to reach %s", u.Host)
+	}
+	return addr, nil
+}
@@ -0,0 +1,244 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nveeser/go-natpmp/upnp/upnptest"
+)
+
+func newServer(t *testing.T) *upnptest.Server {
+	t.Helper()
+	srv, err := upnptest.NewServer()
+	if err != nil {
+		t.Fatalf("upnptest.NewServer() failed: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDiscover(t *testing.T) {
+	srv := newServer(t)
+	c, err := Discover(context.Background(), SSDPAddr(srv.SSDPAddr()), Timeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Discover() failed: %v", err)
+	}
+	if c.serviceType != upnptest.ServiceType {
+		t.Errorf("serviceType=%q != %q", c.serviceType, upnptest.ServiceType)
+	}
+	if want := srv.Location()[:len(srv.Location())-len("/rootDesc.xml")] + upnptest.ControlPath; c.controlURL != want {
+		t.Errorf("controlURL=%q != %q", c.controlURL, want)
+	}
+	if want := netip.MustParseAddr("127.0.0.1"); c.internalClient != want {
+		t.Errorf("internalClient=%v != %v", c.internalClient, want)
+	}
+}
+
+func TestDiscoverNoGateway(t *testing.T) {
+	srv := newServer(t)
+	addr := srv.SSDPAddr()
+	srv.Close()
+	_, err := Discover(context.Background(), SSDPAddr(addr), Timeout(100*time.Millisecond))
+	if !errors.Is(err, ErrNoGateway) {
+		t.Errorf("Discover() err=%v, want ErrNoGateway", err)
+	}
+}
+
+func TestDiscoverGateway(t *testing.T) {
+	testCases := []struct {
+		name     string
+		gateway  net.IP
+		location func(*upnptest.Server) string
+		wantErr  bool
+	}{
+		{name: "gateway", gateway: net.IPv4(127, 0, 0, 1)},
+		{name: "other host", gateway: net.IPv4(127, 0, 0, 2), wantErr: true},
+		{
+			name:    "location elsewhere",
+			gateway: net.IPv4(127, 0, 0, 1),
+			location: func(s *upnptest.Server) string {
+				return strings.Replace(s.Location(), "127.0.0.1", "localhost", 1)
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t)
+			if tc.location != nil {
+				srv.SetAdvertisedLocation(tc.location(srv))
+			}
+			_, err := Discover(context.Background(), SSDPAddr(srv.SSDPAddr()), Gateway(tc.gateway), Timeout(200*time.Millisecond))
+			if tc.wantErr {
+				if !errors.Is(err, ErrNoGateway) {
+					t.Errorf("Discover() err=%v, want ErrNoGateway", err)
+				}
+			} else if err != nil {
+				t.Errorf("Discover() failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestClient(t *testing.T) {
+	testCases := []struct {
+		name         string
+		srv          func(*upnptest.Server)
+		requested    int
+		lifetime     time.Duration
+		wantExternal uint16
+		wantLifetime time.Duration
+		wantLeases   []string
+		wantErr      error
+	}{
+		{
+			name:         "success",
+			lifetime:     time.Hour,
+			wantExternal: 8080,
+			wantLifetime: time.Hour,
+			wantLeases:   []string{"3600"},
+		},
+		{
+			name:         "requested external port",
+			requested:    9090,
+			lifetime:     time.Hour,
+			wantExternal: 9090,
+			wantLifetime: time.Hour,
+			wantLeases:   []string{"3600"},
+		},
+		{
+			name:         "lease capped at one week",
+			lifetime:     30 * 24 * time.Hour,
+			wantExternal: 8080,
+			wantLifetime: maxLease,
+			wantLeases:   []string{"604800"},
+		},
+		{
+			name:         "permanent leases only",
+			srv:          func(s *upnptest.Server) { s.PermanentOnly = true },
+			lifetime:     time.Hour,
+			wantExternal: 8080,
+			wantLifetime: 0,
+			wantLeases:   []string{"3600", "0"},
+		},
+		{
+			name:       "conflict",
+			srv:        func(s *upnptest.Server) { s.Faults = map[string]int{"AddPortMapping": 718} },
+			lifetime:   time.Hour,
+			wantLeases: []string{"3600"},
+			wantErr:    ConflictInMappingEntry,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newServer(t)
+			if tc.srv != nil {
+				tc.srv(srv)
+			}
+			c, err := NewClient(context.Background(), srv.Location(), Description("test"))
+			if err != nil {
+				t.Fatalf("NewClient() failed: %v", err)
+			}
+			m, err := c.AddPortMapping("tcp", 8080, tc.requested, tc.lifetime)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("AddPortMapping() err=%v, want %v", err, tc.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("AddPortMapping() failed: %v", err)
+			} else {
+				if m.MappedExternalPort != tc.wantExternal {
+					t.Errorf("MappedExternalPort=%d != %d", m.MappedExternalPort, tc.wantExternal)
+				}
+				if m.Lifetime != tc.wantLifetime {
+					t.Errorf("Lifetime=%s != %s", m.Lifetime, tc.wantLifetime)
+				}
+			}
+
+			var leases []string
+			for _, call := range srv.Calls() {
+				if call.Action != "AddPortMapping" {
+					continue
+				}
+				leases = append(leases, call.Get("NewLeaseDuration"))
+				for name, want := range map[string]string{
+					"NewProtocol":               "TCP",
+					"NewInternalPort":           "8080",
+					"NewInternalClient":         "127.0.0.1",
+					"NewPortMappingDescription": "test",
+				} {
+					if got := call.Get(name); got != want {
+						t.Errorf("%s=%q != %q", name, got, want)
+					}
+				}
+			}
+			if len(leases) != len(tc.wantLeases) {
+				t.Fatalf("leases=%q != %q", leases, tc.wantLeases)
+			}
+			for i := range leases {
+				if leases[i] != tc.wantLeases[i] {
+					t.Errorf("leases=%q != %q", leases, tc.wantLeases)
+				}
+			}
+		})
+	}
+}
+
+func TestDeletePortMapping(t *testing.T) {
+	srv := newServer(t)
+	c, err := NewClient(context.Background(), srv.Location())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	if _, err := c.AddPortMapping("udp", 5000, 6000, time.Hour); err != nil {
+		t.Fatalf("AddPortMapping() failed: %v", err)
+	}
+	if _, err := c.AddPortMapping("udp", 5000, 0, 0); err != nil {
+		t.Fatalf("AddPortMapping(lifetime=0) failed: %v", err)
+	}
+	// Unknown to the Client, so the internal port is assumed.
+	if err := c.DeletePortMapping("tcp", 7000); err != nil {
+		t.Fatalf("DeletePortMapping() failed: %v", err)
+	}
+	var got []string
+	for _, call := range srv.Calls() {
+		if call.Action == "DeletePortMapping" {
+			got = append(got, call.Get("NewProtocol")+" "+call.Get("NewExternalPort"))
+		}
+	}
+	want := []string{"UDP 6000", "TCP 7000"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("deleted %q != %q", got, want)
+	}
+}
+
+func TestGetExternalAddress(t *testing.T) {
+	srv := newServer(t)
+	c, err := NewClient(context.Background(), srv.Location())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	addr, _, err := c.GetExternalAddress()
+	if err != nil {
+		t.Fatalf("GetExternalAddress() failed: %v", err)
+	}
+	if want := netip.MustParseAddr(srv.ExternalIP); addr != want {
+		t.Errorf("GetExternalAddress()=%v != %v", addr, want)
+	}
+
+	srv = newServer(t)
+	srv.Faults = map[string]int{"GetExternalIPAddress": 501}
+	c, err = NewClient(context.Background(), srv.Location())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	var upnpErr *Error
+	if _, _, err := c.GetExternalAddress(); !errors.As(err, &upnpErr) || upnpErr.Code != ActionFailed {
+		t.Errorf("GetExternalAddress() err=%v, want ActionFailed", err)
+	}
+}
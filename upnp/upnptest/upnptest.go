@@ -0,0 +1,264 @@
+// Package upnptest provides a local UPnP Internet Gateway Device for
+// testing: an SSDP responder and the HTTP server for its description and
+// WANIPConnection control URL.
+package upnptest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// ServiceType is the service implemented by the Server.
+const ServiceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+// ControlPath is the path of the Server's control URL.
+const ControlPath = "/ctl/IPConn"
+
+// Call is a SOAP action received by the Server.
+type Call struct {
+	Action string
+	// Args holds the arguments, in the order they were sent.
+	Args []Arg
+}
+
+// Arg is an argument to a SOAP action.
+type Arg struct {
+	Name, Value string
+}
+
+// Get returns the value of the named argument.
+func (c Call) Get(name string) string {
+	for _, a := range c.Args {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Server is a fake Internet Gateway Device. Set its fields before the
+// first request.
+type Server struct {
+	// ExternalIP is returned by GetExternalIPAddress.
+	ExternalIP string
+	// PermanentOnly rejects leases other than 0 with error 725,
+	// OnlyPermanentLeasesSupported, like many older gateways.
+	PermanentOnly bool
+	// Faults holds a UPnP error code to return for an action.
+	Faults map[string]int
+
+	ssdp *net.UDPConn
+	http *httptest.Server
+
+	mu    sync.Mutex
+	calls []Call
+	// advertised replaces Location in SSDP responses, when set.
+	advertised string
+}
+
+// NewServer starts a Server on the loopback address.
+func NewServer() (*Server, error) {
+	ssdp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{ExternalIP: "203.0.113.9", ssdp: ssdp}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rootDesc.xml", s.serveDescription)
+	mux.HandleFunc(ControlPath, s.serveControl)
+	s.http = httptest.NewServer(mux)
+	go s.serveSSDP()
+	return s, nil
+}
+
+// SSDPAddr returns the address to send M-SEARCH requests to, in place of
+// the SSDP multicast address.
+func (s *Server) SSDPAddr() string { return s.ssdp.LocalAddr().String() }
+
+// Location returns the URL of the device description.
+func (s *Server) Location() string { return s.http.URL + "/rootDesc.xml" }
+
+// SetAdvertisedLocation makes SSDP responses advertise location instead of
+// Location, such as a URL on another host.
+func (s *Server) SetAdvertisedLocation(location string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advertised = location
+}
+
+// Calls returns the SOAP actions received so far.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Close stops the Server.
+func (s *Server) Close() {
+	s.ssdp.Close()
+	s.http.Close()
+}
+
+func (s *Server) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := s.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" {
+			continue
+		}
+		location := s.Location()
+		s.mu.Lock()
+		if s.advertised != "" {
+			location = s.advertised
+		}
+		s.mu.Unlock()
+		resp := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=120\r\n" +
+			"ST: " + req.Header.Get("ST") + "\r\n" +
+			"USN: uuid:upnptest::" + req.Header.Get("ST") + "\r\n" +
+			"LOCATION: " + location + "\r\n" +
+			"\r\n"
+		s.ssdp.WriteToUDP([]byte(resp), from)
+	}
+}
+
+const description = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <serviceList>
+      <service>
+        <serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+        <controlURL>/ctl/L3F</controlURL>
+      </service>
+    </serviceList>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>` + ServiceType + `</serviceType>
+                <controlURL>` + ControlPath + `</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+func (s *Server) serveDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/xml")
+	io.WriteString(w, description)
+}
+
+func (s *Server) serveControl(w http.ResponseWriter, r *http.Request) {
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	service, action, ok := strings.Cut(soapAction, "#")
+	if r.Method != http.MethodPost || !ok || service != ServiceType {
+		http.Error(w, "bad SOAPAction", http.StatusBadRequest)
+		return
+	}
+	args, err := actionArgs(r.Body, action)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	call := Call{Action: action, Args: args}
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+
+	if code, ok := s.Faults[action]; ok {
+		fault(w, code)
+		return
+	}
+	var out string
+	switch action {
+	case "GetExternalIPAddress":
+		out = "<NewExternalIPAddress>" + s.ExternalIP + "</NewExternalIPAddress>"
+	case "AddPortMapping":
+		if s.PermanentOnly && call.Get("NewLeaseDuration") != "0" {
+			fault(w, 725)
+			return
+		}
+	case "DeletePortMapping":
+	default:
+		fault(w, 401)
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body>
+</s:Envelope>`, action, ServiceType, out, action)
+}
+
+func fault(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>error %d</errorDescription></UPnPError></detail>
+</s:Fault></s:Body>
+</s:Envelope>`, code, code)
+}
+
+// actionArgs returns the child elements of the action element in the
+// SOAP request body.
+func actionArgs(r io.Reader, action string) ([]Arg, error) {
+	d := xml.NewDecoder(r)
+	var args []Arg
+	depth, actionDepth := 0, -1
+	var name string
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case t.Name.Local == action && actionDepth < 0:
+				actionDepth = depth
+			case actionDepth >= 0 && depth == actionDepth+1:
+				name = t.Name.Local
+				text.Reset()
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if actionDepth >= 0 && depth == actionDepth+1 {
+				args = append(args, Arg{Name: name, Value: text.String()})
+			}
+			depth--
+		}
+	}
+	if actionDepth < 0 {
+		return nil, fmt.Errorf("no %s element", action)
+	}
+	return args, nil
+}